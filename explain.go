@@ -0,0 +1,191 @@
+// Copyright 2019 Bytedance Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tagexpr
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Explain re-evaluates the tag expression by the selector expression,
+// and returns the indented trace of the result of each sub-expression, such as:
+//  A@: $ > 0 && $ < 10 => true
+//    && => true
+//      > => true
+//        $ => 5
+//        0 => 0
+//      < => true
+//        $ => 5
+//        10 => 10
+// NOTE:
+//  The operands skipped by the short-circuit evaluation are traced too;
+//  The arguments of the built-in functions with several arguments are not traced;
+//  The fields referenced by other fields, such as (A)$, are resolved once within the Explain.
+func (t *TagExpr) Explain(selector string) string {
+	expr, ok := t.s.exprs[selector]
+	if !ok {
+		return ""
+	}
+	t = t.beginPass()
+	defer t.endPass()
+	var b strings.Builder
+	field := getFieldSelector(selector)
+	fmt.Fprintf(&b, "%s: %s => %s\n", selector, expr.raw, formatResult(expr.run(field, t)))
+	t.explainNode(&b, expr.expr, field, 1)
+	return b.String()
+}
+
+func (t *TagExpr) explainNode(b *strings.Builder, e ExprNode, field string, depth int) {
+	if e == nil {
+		return
+	}
+	switch r := e.(type) {
+	case *groupExprNode:
+		if r.boolPrefix == nil {
+			t.explainNode(b, r.rightOperand, field, depth)
+			return
+		}
+	case *funcCallExprNode:
+		t.explainNode(b, r.rightOperand, field, depth)
+		return
+	}
+	fmt.Fprintf(b, "%s%s => %s\n", strings.Repeat("  ", depth), explainLabel(e), formatResult(t.explainRun(e, field)))
+	switch r := e.(type) {
+	case *tupleExprNode:
+		for _, arg := range r.args {
+			t.explainNode(b, arg, field, depth+1)
+		}
+	case *selectorExprNode:
+	case *condExprNode:
+		t.explainNode(b, r.leftOperand, field, depth+1)
+		t.explainNode(b, r.rightOperand.LeftOperand(), field, depth+1)
+		t.explainNode(b, r.rightOperand.RightOperand(), field, depth+1)
+	default:
+		t.explainNode(b, e.LeftOperand(), field, depth+1)
+		t.explainNode(b, e.RightOperand(), field, depth+1)
+	}
+}
+
+// explainRun evaluates the sub-expression, the result is an error if the evaluation is aborted.
+func (t *TagExpr) explainRun(e ExprNode, field string) (r interface{}) {
+	defer func() {
+		if p := recover(); p != nil {
+			ee, ok := p.(*evalError)
+			if !ok {
+				panic(p)
+			}
+			r = ee.err
+		}
+	}()
+	t.funcCalls = 0
+	return e.Run(field, t)
+}
+
+func explainLabel(e ExprNode) string {
+	switch r := e.(type) {
+	case *groupExprNode:
+		return explainBoolPrefix(r.boolPrefix) + "()"
+	case *tupleExprNode:
+		return "(,)"
+	case *stringExprNode:
+		return "'" + r.val + "'"
+	case *digitalExprNode:
+		if r.fractional {
+			return strconv.FormatFloat(r.val, 'f', -1, 64)
+		}
+		return strconv.FormatInt(r.ival, 10)
+	case *boolExprNode:
+		return strconv.FormatBool(r.val)
+	case *currFieldNameExprNode:
+		return "$name"
+	case *selectorExprNode:
+		label := "$"
+		switch {
+		case r.alias:
+			label = "('" + r.field + "')$"
+		case r.field != "":
+			label = "(" + r.field + ")$"
+		}
+		for _, sub := range r.subExprs {
+			if fn, ok := sub.(*fieldNameExprNode); ok {
+				label += "." + string(fn.name)
+			} else if mn, ok := sub.(*methodNameExprNode); ok {
+				label += "." + string(mn.name) + "()"
+			} else {
+				label += "[" + explainLabel(unwrapGroup(sub)) + "]"
+			}
+		}
+		return explainBoolPrefix(r.boolPrefix) + label
+	case *additionExprNode:
+		return "+"
+	case *subtractionExprNode:
+		return "-"
+	case *multiplicationExprNode:
+		return "*"
+	case *divisionExprNode:
+		return "/"
+	case *remainderExprNode:
+		return "%"
+	case *equalExprNode:
+		return "=="
+	case *notEqualExprNode:
+		return "!="
+	case *inExprNode:
+		if r.negate {
+			return "not in"
+		}
+		return "in"
+	case *numCompareExprNode:
+		return explainLabel(r.generic)
+	case *greaterExprNode:
+		return ">"
+	case *greaterEqualExprNode:
+		return ">="
+	case *lessExprNode:
+		return "<"
+	case *lessEqualExprNode:
+		return "<="
+	case *andExprNode:
+		return "&&"
+	case *orExprNode:
+		return "||"
+	case *condExprNode:
+		return "?:"
+	case *stringCheckFnExprNode:
+		return r.name + "()"
+	case *aggregateFnExprNode:
+		return r.name + "()"
+	case *sliceElemFnExprNode:
+		if r.count {
+			return "count()"
+		}
+		if r.parent {
+			return "parentIndex()"
+		}
+		return "index()"
+	}
+	name := reflect.TypeOf(e).Elem().Name()
+	return strings.TrimSuffix(name, "FnExprNode") + "()"
+}
+
+// explainBoolPrefix returns the ! prefix of the bool value, such as !$ or !!$.
+func explainBoolPrefix(boolPrefix *bool) string {
+	if boolPrefix == nil || *boolPrefix {
+		return ""
+	}
+	return "!"
+}
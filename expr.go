@@ -15,12 +15,28 @@
 package tagexpr
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
 )
 
 // Expr expression
 type Expr struct {
 	expr ExprNode
+	raw  string
+	// crossField whether the expression references other struct fields
+	crossField bool
+	// fractional whether the expression contains fractional number literals
+	fractional bool
+	// volatile whether the expression contains the functions whose results vary, such as rand()
+	volatile bool
+	cache    *resultCache
 }
 
 // parseExpr parses the expression.
@@ -28,9 +44,13 @@ func parseExpr(expr string) (*Expr, error) {
 	e := newGroupExprNode()
 	p := &Expr{
 		expr: e,
+		raw:  expr,
 	}
-	s := expr
-	_, err := p.parseExprNode(&s, e)
+	s, err := desugarPipes(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%q (syntax incorrect): %s", expr, err.Error())
+	}
+	_, err = p.parseExprNode(&s, e)
 	if err != nil {
 		return nil, fmt.Errorf("%q (syntax incorrect): %s", expr, err.Error())
 	}
@@ -39,31 +59,359 @@ func parseExpr(expr string) (*Expr, error) {
 	if err != nil {
 		return nil, err
 	}
+	prepareLiteralSets(e)
+	if !p.crossField && !p.volatile {
+		p.cache = newResultCache()
+	}
 	return p, nil
 }
 
-// run calculates the value of expression.
-func (p *Expr) run(field string, tagExpr *TagExpr) interface{} {
+// specialize specializes the nodes with the type of the struct field that the expression belongs to.
+func (p *Expr) specialize(fieldType reflect.Type) {
+	specializeComparisons(p.expr, fieldType)
+}
+
+// desugarPipes rewrites the pipelines such as `$ |> f |> g(1)` to `g(f($), 1)`,
+// the left value of |> becomes the first argument of the function on the right.
+// The pipelines are delimited by the parentheses, the commas and the operators of lower priority, see pipeBoundary.
+func desugarPipes(expr string) (string, error) {
+	if !strings.Contains(expr, "|>") {
+		return expr, nil
+	}
+	var out strings.Builder
+	var stages []string
+	var stage strings.Builder
+	flush := func(sep string) error {
+		item, err := foldPipeline(append(stages, stage.String()))
+		if err != nil {
+			return err
+		}
+		out.WriteString(item + sep)
+		stages = stages[:0]
+		stage.Reset()
+		return nil
+	}
+	for i := 0; i < len(expr); i++ {
+		switch c, n := expr[i], pipeBoundary(expr, i); {
+		case c == '\'':
+			j := skipQuoted(expr, i)
+			stage.WriteString(expr[i:j])
+			i = j - 1
+		case c == '(':
+			j := matchParen(expr, i)
+			if j < 0 {
+				stage.WriteString(expr[i:])
+				i = len(expr)
+				continue
+			}
+			inner, err := desugarPipes(expr[i+1 : j])
+			if err != nil {
+				return "", err
+			}
+			stage.WriteString("(" + inner + ")")
+			i = j
+		case c == '|' && i+1 < len(expr) && expr[i+1] == '>':
+			stages = append(stages, stage.String())
+			stage.Reset()
+			i++
+		case c == ',':
+			if err := flush(","); err != nil {
+				return "", err
+			}
+		case n > 0:
+			if err := flush(expr[i : i+n]); err != nil {
+				return "", err
+			}
+			i += n - 1
+		default:
+			stage.WriteByte(c)
+		}
+	}
+	if err := flush(""); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// pipeBoundary returns the length of the operator at @i that has a lower priority than |>,
+// such as the comparisons, in, &&, || and the conditional, 0 if absent.
+func pipeBoundary(s string, i int) int {
+	rest := s[i:]
+	for _, op := range [...]string{"&&", "||", "==", "!=", "<=", ">="} {
+		if strings.HasPrefix(rest, op) {
+			return 2
+		}
+	}
+	switch rest[0] {
+	case '<', '>', ':':
+		return 1
+	case '?':
+		// the optional steps of the selectors, such as $?[0]?.Y
+		if len(rest) > 1 && (rest[1] == '[' || rest[1] == '.') {
+			return 0
+		}
+		return 1
+	case 'i':
+		if strings.HasPrefix(rest, "in") && i > 0 && (s[i-1] == ' ' || s[i-1] == ')') &&
+			(len(rest) == 2 || rest[2] == ' ' || rest[2] == '(') {
+			return 2
+		}
+	}
+	return 0
+}
+
+var pipeFnRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+func foldPipeline(stages []string) (string, error) {
+	acc := stages[0]
+	for _, stage := range stages[1:] {
+		if strings.TrimSpace(acc) == "" {
+			return "", errors.New("missing the left value of |>")
+		}
+		stage = strings.TrimLeft(stage, " \t\n")
+		name := pipeFnRegexp.FindString(stage)
+		if name == "" {
+			return "", fmt.Errorf("the right of |> is not a function: %q", stage)
+		}
+		rest := stage[len(name):]
+		args := strings.TrimSpace(acc)
+		if strings.HasPrefix(rest, "(") {
+			j := matchParen(rest, 0)
+			if j < 0 {
+				return "", fmt.Errorf("parsing pos: %q", rest)
+			}
+			if moreArgs := strings.TrimSpace(rest[1:j]); moreArgs != "" {
+				args += ", " + moreArgs
+			}
+			rest = rest[j+1:]
+		}
+		acc = name + "(" + args + ")" + rest
+	}
+	return acc, nil
+}
+
+// skipQuoted returns the index after the string literal starting at @i.
+func skipQuoted(s string, i int) int {
+	for j := i + 1; j < len(s); j++ {
+		if s[j] == '\'' && s[j-1] != '\\' {
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// matchParen returns the index of the parenthesis closing the one at @i, -1 if absent.
+func matchParen(s string, i int) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\'':
+			j = skipQuoted(s, j) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// run calculates the value of expression,
+// the result is an error if the evaluation is aborted.
+func (p *Expr) run(field string, tagExpr *TagExpr) (r interface{}) {
+	defer func() {
+		if e := recover(); e != nil {
+			ee, ok := e.(*evalError)
+			if !ok {
+				panic(e)
+			}
+			r = ee.err
+		}
+	}()
+	if tagExpr != nil {
+		tagExpr.funcCalls = 0
+	}
+	if p.cache != nil && tagExpr.getVM().resultCache {
+		if key, ok := resultCacheKey(tagExpr.getValue(field, nil)); ok {
+			if r, ok := p.cache.get(key); ok {
+				return r
+			}
+			r := p.expr.Run(field, tagExpr)
+			p.cache.set(key, r)
+			return r
+		}
+	}
 	return p.expr.Run(field, tagExpr)
 }
 
+// evalError aborts the evaluation of an expression.
+type evalError struct {
+	err error
+}
+
+// failEval aborts the evaluation of the current expression with the error.
+func failEval(format string, a ...interface{}) {
+	panic(&evalError{err: fmt.Errorf(format, a...)})
+}
+
+const maxResultCacheSize = 4096
+
+// resultCache memoizes the results of an expression that only
+// references the current field, keyed by the field value.
+// The reads do not lock, so the concurrent evaluations of the same expression do not contend.
+type resultCache struct {
+	m atomic.Value // *sync.Map
+	n int64
+}
+
+func newResultCache() *resultCache {
+	c := new(resultCache)
+	c.m.Store(new(sync.Map))
+	return c
+}
+
+func (c *resultCache) get(key interface{}) (interface{}, bool) {
+	return c.m.Load().(*sync.Map).Load(key)
+}
+
+func (c *resultCache) len() int {
+	return int(atomic.LoadInt64(&c.n))
+}
+
+// set stores the result, the cache is reset when it has about maxResultCacheSize results.
+func (c *resultCache) set(key, result interface{}) {
+	m := c.m.Load().(*sync.Map)
+	if _, loaded := m.LoadOrStore(key, result); loaded {
+		m.Store(key, result)
+		return
+	}
+	if atomic.AddInt64(&c.n, 1) > maxResultCacheSize {
+		c.m.Store(new(sync.Map))
+		atomic.StoreInt64(&c.n, 0)
+	}
+}
+
+// resultCacheKey returns the cache key of the field value,
+// only the basic values can be cached.
+func resultCacheKey(v interface{}) (interface{}, bool) {
+	switch r := v.(type) {
+	case float64:
+		return r, !math.IsNaN(r)
+	case int64, string, bool, nil:
+		return r, true
+	}
+	return nil, false
+}
+
 func (p *Expr) parseOperand(expr *string) (e ExprNode) {
+	if e = p.readFnExprNode(expr); e != nil {
+		return newFuncCallExprNode(e)
+	}
+	if e = readStringExprNode(expr); e != nil {
+		return e
+	}
+	if e = readDigitalExprNode(expr); e != nil {
+		if e.(*digitalExprNode).fractional {
+			p.fractional = true
+		}
+		return e
+	}
+	if e = readBoolExprNode(expr); e != nil {
+		return e
+	}
+	if e = readNilExprNode(expr); e != nil {
+		return e
+	}
+	if e = readElemExprNode(expr); e != nil {
+		return e
+	}
+	if e = readCurrFieldNameExprNode(expr); e != nil {
+		return e
+	}
+	return nil
+}
+
+// readFnExprNode reads the built-in function call.
+func (p *Expr) readFnExprNode(expr *string) (e ExprNode) {
 	if e = p.readLenFnExprNode(expr); e != nil {
 		return e
 	}
 	if e = p.readRegexpFnExprNode(expr); e != nil {
 		return e
 	}
+	if e = p.readRegexpReplaceFnExprNode(expr); e != nil {
+		return e
+	}
 	if e = p.readSprintfFnExprNode(expr); e != nil {
 		return e
 	}
-	if e = readStringExprNode(expr); e != nil {
+	if e = p.readNumberFnExprNode(expr); e != nil {
 		return e
 	}
-	if e = readDigitalExprNode(expr); e != nil {
+	if e = p.readStringCheckFnExprNode(expr); e != nil {
 		return e
 	}
-	if e = readBoolExprNode(expr); e != nil {
+	if e = p.readOnlyCharsFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readEditDistanceFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readIsStepFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readAtFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readCoalesceAllFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readLuhnFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readOneofFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readJSONGetFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readSliceElemFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readLookupFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readLabelFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readSelfTagFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readIPInCIDRFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readSetCountFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readFindFirstFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readTakeFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readUniqueByFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readAggregateFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readRandFnExprNode(expr); e != nil {
+		return e
+	}
+	if e = p.readFuncExprNode(expr); e != nil {
 		return e
 	}
 	return nil
@@ -79,6 +427,10 @@ func (*Expr) parseOperator(expr *string) (e ExprNode) {
 			*expr = (*expr)[2:]
 		}
 	}()
+	if n := readInOperator(s); n > 0 {
+		*expr = s[n:]
+		return newInExprNode(strings.HasPrefix(s, "not"))
+	}
 	a := s[:2]
 	switch a {
 	// case "<<":
@@ -124,11 +476,37 @@ func (*Expr) parseOperator(expr *string) (e ExprNode) {
 	return nil
 }
 
+// readInOperator returns the length of the leading in or not in operator, 0 if it is absent.
+func readInOperator(s string) int {
+	n := 0
+	if strings.HasPrefix(s, "not") && len(s) > 3 && unicode.IsSpace(rune(s[3])) {
+		n = len(s) - len(strings.TrimLeftFunc(s[3:], unicode.IsSpace))
+	}
+	if !strings.HasPrefix(s[n:], "in") || len(s) == n+2 {
+		return 0
+	}
+	if c := s[n+2]; c != '(' && !unicode.IsSpace(rune(c)) {
+		return 0
+	}
+	return n + 2
+}
+
 func (p *Expr) parseExprNode(expr *string, e ExprNode) (ExprNode, error) {
 	trimLeftSpace(expr)
 	if *expr == "" {
 		return nil, nil
 	}
+	if grp, ok := e.(*groupExprNode); ok && grp.RightOperand() == nil {
+		operand, err := p.readCondExprNode(expr)
+		if err != nil {
+			return nil, err
+		}
+		if operand != nil {
+			e.SetRightOperand(operand)
+			operand.SetParent(e)
+			return operand, nil
+		}
+	}
 	operand := p.readSelectorExprNode(expr)
 	if operand == nil {
 		var subExprNode *string
@@ -138,11 +516,20 @@ func (p *Expr) parseExprNode(expr *string, e ExprNode) (ExprNode, error) {
 			if err != nil {
 				return nil, err
 			}
+			if *trimLeftSpace(subExprNode) != "" {
+				operand, err = p.readTupleExprNode(operand, subExprNode)
+				if err != nil {
+					return nil, err
+				}
+			}
 		} else {
 			operand = p.parseOperand(expr)
 		}
 	}
 	if operand == nil {
+		if err := undefinedFunc(*expr); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("parsing pos: %q", *expr)
 	}
 
@@ -169,18 +556,124 @@ func (p *Expr) parseExprNode(expr *string, e ExprNode) (ExprNode, error) {
 	return p.parseExprNode(expr, operator)
 }
 
-func (p *Expr) checkSyntax() error {
+// readCondExprNode reads the conditional expression such as `cond ? a : b`
+// that spans the sub-expression, which ends at the comma or the unmatched parenthesis,
+// return nil if it is not a conditional expression.
+func (p *Expr) readCondExprNode(expr *string) (ExprNode, error) {
+	s := *expr
+	q, c, end := splitCond(s)
+	if q < 0 {
+		return nil, nil
+	}
+	if c < 0 {
+		return nil, fmt.Errorf("missing ':' of the conditional operator: %q", s[q:end])
+	}
+	var operands [3]ExprNode
+	for i, sub := range [3]string{s[:q], s[q+1 : c], s[c+1 : end]} {
+		grp := newGroupExprNode()
+		_, err := p.parseExprNode(&sub, grp)
+		if err != nil {
+			return nil, err
+		}
+		if grp.RightOperand() == nil || *trimLeftSpace(&sub) != "" {
+			return nil, fmt.Errorf("parsing pos: %q", s)
+		}
+		sortPriority(grp.RightOperand())
+		operands[i] = grp
+	}
+	*expr = s[end:]
+	return newCondExprNode(operands[0], operands[1], operands[2]), nil
+}
+
+// splitCond returns the indexes of the first ? and its matching : of the sub-expression,
+// and the end of the sub-expression, the indexes are -1 if absent.
+// NOTE:
+//  The ? of the optional selector steps such as $?.X and $?[0] are skipped
+func splitCond(s string) (q, c, end int) {
+	q, c = -1, -1
+	var depth, nested int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			i = skipQuoted(s, i) - 1
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth == 0 {
+				return q, c, i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return q, c, i
+			}
+		case '?':
+			if depth > 0 || c >= 0 || i+1 < len(s) && (s[i+1] == '.' || s[i+1] == '[') {
+				continue
+			}
+			if q < 0 {
+				q = i
+			} else {
+				nested++
+			}
+		case ':':
+			if depth > 0 || q < 0 || c >= 0 {
+				continue
+			}
+			if nested > 0 {
+				nested--
+			} else {
+				c = i
+			}
+		}
+	}
+	return q, c, len(s)
+}
 
+func (p *Expr) checkSyntax() error {
+	if err := checkTupleArity(p.expr); err != nil {
+		return fmt.Errorf("%q (syntax incorrect): %s", p.raw, err.Error())
+	}
 	return nil
 }
 
+func checkTupleArity(e ExprNode) error {
+	if e == nil {
+		return nil
+	}
+	switch e.(type) {
+	case *equalExprNode, *notEqualExprNode:
+		left, ok0 := e.LeftOperand().(*tupleExprNode)
+		right, ok1 := e.RightOperand().(*tupleExprNode)
+		if ok0 && ok1 && len(left.args) != len(right.args) {
+			return fmt.Errorf("tuple arity mismatch: %d != %d", len(left.args), len(right.args))
+		}
+	}
+	if err := checkTupleArity(e.LeftOperand()); err != nil {
+		return err
+	}
+	return checkTupleArity(e.RightOperand())
+}
+
+// prepareLiteralSets precomputes the members of the literal sets of the in operators.
+func prepareLiteralSets(e ExprNode) {
+	if e == nil {
+		return
+	}
+	if ie, ok := e.(*inExprNode); ok {
+		ie.prepareLiteralSet()
+	}
+	prepareLiteralSets(e.LeftOperand())
+	prepareLiteralSets(e.RightOperand())
+}
+
 /**
  * Priority:
  * () bool string float64 !
  * * / %
  * + -
  * < <= > >=
- * == !=
+ * == != in
  * &&
  * ||
 **/
@@ -209,7 +702,7 @@ func getPriority(e ExprNode) (i int) {
 		return 5
 	case *lessExprNode, *lessEqualExprNode, *greaterExprNode, *greaterEqualExprNode: // < <= > >=
 		return 4
-	case *equalExprNode, *notEqualExprNode: // == !=
+	case *equalExprNode, *notEqualExprNode, *inExprNode: // == != in
 		return 3
 	case *andExprNode: // &&
 		return 2
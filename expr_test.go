@@ -46,6 +46,8 @@ func TestExpr(t *testing.T) {
 		// Join string
 		{expr: "'true '+('a')", val: "true a"},
 		{expr: "'a'+('b'+'c')+'d'", val: "abcd"},
+		{expr: "'a'+true", val: "atrue"},
+		{expr: "(1>2)+'a'", val: "falsea"},
 		// Arithmetic operator
 		{expr: "1+7+2", val: 10.0},
 		{expr: "1+(7)+(2)", val: 10.0},
@@ -114,6 +116,39 @@ func TestExpr(t *testing.T) {
 		{expr: "true&&true || false", val: true},
 		{expr: "true&&false || false", val: false},
 		{expr: "true && false || true ", val: true},
+		// Conditional
+		{expr: "1 > 0 ? 'big' : 'small'", val: "big"},
+		{expr: "1 < 0 ? 'big' : 'small'", val: "small"},
+		{expr: "1<0?1:2", val: 2.0},
+		{expr: "false ? 1 : true ? 2 : 3", val: 2.0},
+		{expr: "false ? 1 : false ? 2 : 3", val: 3.0},
+		{expr: "true ? false ? 1 : 2 : 3", val: 2.0},
+		{expr: "1 + 1 == 2 || false ? 'a' + 'b' : 'c'", val: "ab"},
+		{expr: "(true ? 1 : 2) + 10", val: 11.0},
+		{expr: "'' ? 1 : 2", val: 2.0},
+		{expr: "'x' ? (1, 2) : 3", val: []interface{}{1.0, 2.0}},
+		{expr: "sprintf('%v', true ? 'a:b' : '?')", val: "a:b"},
+		// Nil
+		{expr: "nil == nil", val: true},
+		{expr: "nil != 0", val: true},
+		// Tuple
+		{expr: "(1, 'a') == (1, 'a')", val: true},
+		{expr: "(1, 'a', true) == (1, 'a', false)", val: false},
+		{expr: "(1+1, 'a') != (2, 'a')", val: false},
+		{expr: "((1, 2), 3) == ((1, 2), 3)", val: true},
+		{expr: "(1, 2) == 1", val: false},
+		// Membership
+		{expr: "2 in (1, 2, 3)", val: true},
+		{expr: "4 in (1, 2, 3)", val: false},
+		{expr: "4 not in (1, 2, 3)", val: true},
+		{expr: "'b' in ('a','b')", val: true},
+		{expr: "'c' not  in('a','b')", val: true},
+		{expr: "1.5 in (1, 1.5)", val: true},
+		{expr: "true in (false)", val: false},
+		{expr: "1+1 in (1, 1+1)", val: true},
+		{expr: "(1, 2) in ((1, 2), (3, 4))", val: true},
+		{expr: "1 in (1, 2) && 3 not in (1, 2)", val: true},
+		{expr: "'1' in (1, 2)", val: false},
 	}
 	for _, c := range cases {
 		t.Log(c.expr)
@@ -141,6 +176,7 @@ func TestPriority(t *testing.T) {
 		{expr: "(true||false)&&false||false", val: false},
 		{expr: "true||false&&false||false", val: true},
 		{expr: "true||1<0&&'a'!='a'||0!=0", val: true},
+		{expr: "1+2 in (3) && 1<2 in (true)", val: true},
 	}
 	for _, c := range cases {
 		t.Log(c.expr)
@@ -172,11 +208,140 @@ func TestBuiltInFunc(t *testing.T) {
 		{expr: "regexp('a\\d','a')", val: false},
 		{expr: "regexp('^a\\d$','a')", val: false},
 
+		{expr: "regexpReplace(' a  b\tc ','\\s+',' ')", val: " a b c "},
+		{expr: "regexpReplace('2019-06-01','(\\d+)-(\\d+)-(\\d+)','$3/$2/$1')", val: "01/06/2019"},
+		{expr: "regexpReplace('abc','\\d','x')", val: "abc"},
+		{expr: "regexpReplace(1,'\\d','x')", val: nil},
+
 		{expr: "sprintf('test string: %s','a')", val: "test string: a"},
 		{expr: "sprintf('test string: %s','a'+'b')", val: "test string: ab"},
 		{expr: "sprintf('test string: %s,%v','a',1)", val: "test string: a,1"},
 		{expr: "sprintf('')+'a'", val: "a"},
 		{expr: "sprintf('%v',10+2*2)", val: "14"},
+		{expr: "sprintf('%v-%v',1,true)", val: "1-true"},
+		{expr: "sprintf('%s,%t',true,false)", val: "true,false"},
+
+		{expr: "number('1.5')", val: 1.5},
+		{expr: "number(' -2 ')+1", val: -1.0},
+		{expr: "number(2)", val: 2.0},
+		{expr: "number('3,14')", val: nil},
+		{expr: "number(true)", val: nil},
+
+		{expr: "isASCII('abc 123~')", val: true},
+		{expr: "isASCII('héllo')", val: false},
+		{expr: "isASCII('')", val: true},
+		{expr: "isASCII(1)", val: nil},
+
+		{expr: "' a b ' |> regexpReplace('\\s+', '') |> len", val: 2.0},
+		{expr: "'{\"a\":\"1-2\"}' |> jsonGet('a') |> regexpReplace('-', '') |> number", val: 12.0},
+		{expr: "('ab' |> len) > 1 && ('abc' |> len > 2)", val: true},
+		{expr: "'a' + 'bc' |> len", val: 3.0},
+		{expr: "sprintf('%v,%v', 'ab' |> len, 'a' |> at(0) |> isAlpha)", val: "2,true"},
+		{expr: "'a|>b' |> len", val: 4.0},
+		{expr: "'ab' != '' && 'ab' |> len > 1", val: true},
+		{expr: "'' == 'x' || 'abc' |> len == 3", val: true},
+		{expr: "2 < 'abc' |> len && 'a' |> len <= 1", val: true},
+		{expr: "'ab' |> len >= 2 ? 'abc' |> len : 0", val: 3.0},
+		{expr: "'ab' |> len in (1, 2)", val: true},
+		{expr: "'ab' |> len not in (1, 2)", val: false},
+
+		{expr: "isDigit('0123')", val: true},
+		{expr: "isDigit('abc')", val: false},
+		{expr: "isDigit('12a')", val: false},
+		{expr: "isDigit('')", val: false},
+		{expr: "isDigit(1)", val: nil},
+		{expr: "isAlpha('0123')", val: false},
+		{expr: "isAlpha('abcé')", val: true},
+		{expr: "isAlpha('12a')", val: false},
+		{expr: "isAlpha('')", val: false},
+		{expr: "isAlphaNumeric('0123')", val: true},
+		{expr: "isAlphaNumeric('abc')", val: true},
+		{expr: "isAlphaNumeric('12a')", val: true},
+		{expr: "isAlphaNumeric('12 a')", val: false},
+		{expr: "isAlphaNumeric('')", val: false},
+		{expr: "onlyChars('c0ffee', 'abcdefABCDEF0123456789')", val: true},
+		{expr: "onlyChars('c0ffeg', 'abcdefABCDEF0123456789')", val: false},
+		{expr: "onlyChars('', 'abc')", val: true},
+		{expr: "onlyChars('héhé', 'hé')", val: true},
+		{expr: "onlyChars('a', '')", val: false},
+		{expr: "onlyChars(1, 'abc')", val: nil},
+		{expr: "editDistance('kitten', 'kitten')", val: 0.0},
+		{expr: "editDistance('kitten', 'sitten')", val: 1.0},
+		{expr: "editDistance('kitten', 'sitting')", val: 3.0},
+		{expr: "editDistance('abc', 'xyz')", val: 3.0},
+		{expr: "editDistance('', 'héllo')", val: 5.0},
+		{expr: "editDistance('héllo', 'hello') <= 2", val: true},
+		{expr: "editDistance('a', 1)", val: nil},
+		{expr: "isStep(1.75, 0.25)", val: true},
+		{expr: "isStep(1.8, 0.25)", val: false},
+		{expr: "isStep(0.3, 0.1)", val: true},
+		{expr: "isStep(-6, 3)", val: true},
+		{expr: "isStep(0, 0.5)", val: true},
+		{expr: "isStep(1.1, 0.1)", val: true},
+		{expr: "isStep(123456.7, 0.1)", val: true},
+		{expr: "isStep(-0.3, 0.1)", val: true},
+		{expr: "isStep(1000000000.5, 0.5)", val: true},
+		{expr: "isStep(1000000000.4, 1)", val: false},
+		{expr: "isStep(10000000.005, 0.01)", val: false},
+		{expr: "isStep(0.000001, 1)", val: false},
+		{expr: "isStep('1', 0.5)", val: nil},
+
+		{expr: "isIP('10.1.2.3')", val: true},
+		{expr: "isIP('::1')", val: true},
+		{expr: "isIP('10.1.2')", val: false},
+		{expr: "isIPv4('10.1.2.3')", val: true},
+		{expr: "isIPv4('::ffff:10.1.2.3')", val: true},
+		{expr: "isIPv4('fe80::1')", val: false},
+		{expr: "isIPv6('fe80::1')", val: true},
+		{expr: "isIPv6('10.1.2.3')", val: false},
+		{expr: "isIPv6('x')", val: false},
+		{expr: "ipInCIDR('10.1.2.3', '10.0.0.0/8')", val: true},
+		{expr: "ipInCIDR('11.1.2.3', '10.0.0.0/8')", val: false},
+		{expr: "ipInCIDR('2001:db8::1', '2001:db8::/32')", val: true},
+		{expr: "ipInCIDR('10.1.2.3', '2001:db8::/32')", val: false},
+		{expr: "ipInCIDR('10.1.2', '10.0.0.0/8')", val: false},
+		{expr: "ipInCIDR(1, '10.0.0.0/8')", val: nil},
+
+		{expr: "isJSON('{\"a\":[1,true]}')", val: true},
+		{expr: "isJSON('{\"a\":}')", val: false},
+		{expr: "isJSON('')", val: false},
+		{expr: "isJSON(1)", val: nil},
+
+		{expr: "jsonGet('{\"a\":{\"b\":[1,{\"c\":\"x\"}]}}','a.b.1.c')", val: "x"},
+		{expr: "jsonGet('{\"a\":{\"b\":2}}','a.b')+1", val: 3.0},
+		{expr: "jsonGet('{\"a\":{\"b\":2}}','a.c')", val: nil},
+		{expr: "jsonGet('{\"a\":[1]}','a.1')", val: nil},
+		{expr: "jsonGet('{\"a\"','a')", val: nil},
+		{expr: "isUTF8('héllo, 世界')", val: true},
+		{expr: "isUTF8('\xff\xfe')", val: false},
+
+		{expr: "isBlank('')", val: true},
+		{expr: "isBlank(' \t\n')", val: true},
+		{expr: "isBlank('\u00a0\u3000')", val: true},
+		{expr: "isBlank(' a ')", val: false},
+		{expr: "isBlank(0)", val: nil},
+		{expr: "notBlank('')", val: false},
+		{expr: "notBlank('\u3000')", val: false},
+		{expr: "notBlank('a')", val: true},
+
+		{expr: "at('héllo',1,'n/a')", val: "é"},
+		{expr: "at('héllo',5,'n/a')", val: "n/a"},
+		{expr: "at('héllo',-1,'n/a')", val: "n/a"},
+		{expr: "at('abc',3)", val: nil},
+		{expr: "at(1,0,'n/a')", val: "n/a"},
+
+		{expr: "coalesceAll('a','b')", val: "a"},
+		{expr: "coalesceAll('',0,'c')", val: 0.0},
+		{expr: "coalesceAll('',false)", val: false},
+		{expr: "coalesceAll('')", val: nil},
+
+		{expr: "luhn('4111111111111111')", val: true},
+		{expr: "luhn('79927398713')", val: true},
+		{expr: "luhn('79927398710')", val: false},
+		{expr: "luhn(79927398713)", val: true},
+		{expr: "luhn('4111-1111')", val: false},
+		{expr: "luhn('')", val: false},
+		{expr: "luhn(true)", val: nil},
 	}
 	for _, c := range cases {
 		t.Log(c.expr)
@@ -204,9 +369,59 @@ func TestSyntaxIncorrect(t *testing.T) {
 		{incorrectExpr: "regexp()"},
 		{incorrectExpr: "regexp('^'+'a','a')"},
 		{incorrectExpr: "regexp('^a','a','b')"},
+		{incorrectExpr: "regexpReplace('a','a')"},
+		{incorrectExpr: "regexpReplace('a','^'+'a','b')"},
+		{incorrectExpr: "regexpReplace('a','(','b')"},
 		{incorrectExpr: "sprintf()"},
 		{incorrectExpr: "sprintf(0)"},
 		{incorrectExpr: "sprintf('a'+'b')"},
+		{incorrectExpr: "number(1,2)"},
+		{incorrectExpr: "number(1,)"},
+		{incorrectExpr: "isASCII('a','b')"},
+		{incorrectExpr: "at('a')"},
+		{incorrectExpr: "at('a',1,2,3)"},
+		{incorrectExpr: "coalesceAll()"},
+		{incorrectExpr: "mutuallyExclusive()"},
+		{incorrectExpr: "exactlyOne()"},
+		{incorrectExpr: "findFirst($)"},
+		{incorrectExpr: "findFirst($, '# + + 1')"},
+		{incorrectExpr: "findFirst($, 'a'+'b')"},
+		{incorrectExpr: "$[ ]"},
+		{incorrectExpr: "$?[ ] == nil"},
+		{incorrectExpr: "any($)"},
+		{incorrectExpr: "all($, #v, 1)"},
+		{incorrectExpr: "filter()"},
+		{incorrectExpr: "sum($, #v, #k)"},
+		{incorrectExpr: "any($, '# + + 1')"},
+		{incorrectExpr: "take($)"},
+		{incorrectExpr: "takeLast($, 1, 2)"},
+		{incorrectExpr: "selfTag()"},
+		{incorrectExpr: "onlyChars('a')"},
+		{incorrectExpr: "onlyChars('a', 'a'+'b')"},
+		{incorrectExpr: "editDistance('a')"},
+		{incorrectExpr: "rand(1)"},
+		{incorrectExpr: "true ? 1"},
+		{incorrectExpr: "true ? 1 ? 2 : 3"},
+		{incorrectExpr: "true ? : 3"},
+		{incorrectExpr: "? 1 : 2"},
+		{incorrectExpr: "true ? 1 : "},
+		{incorrectExpr: "randInt()"},
+		{incorrectExpr: "randInt(1,2)"},
+		{incorrectExpr: "jsonGet('{}')"},
+		{incorrectExpr: "ipInCIDR('10.1.2.3', '10.0.0.0/33')"},
+		{incorrectExpr: "ipInCIDR('10.1.2.3')"},
+		{incorrectExpr: "jsonGet('{}','')"},
+		{incorrectExpr: "jsonGet('{}','a'+'b')"},
+		{incorrectExpr: "(1 2)"},
+		{incorrectExpr: "(1,)"},
+		{incorrectExpr: "!(1,2)"},
+		{incorrectExpr: "in (1)"},
+		{incorrectExpr: "|> len"},
+		{incorrectExpr: "'a' |> 1"},
+		{incorrectExpr: "'a' |> len(()"},
+		{incorrectExpr: "1 in (1,)"},
+		{incorrectExpr: "(1, 2) == (1, 2, 3)"},
+		{incorrectExpr: "true && (1, 2) != (1, 2, 3)"},
 	}
 	for _, c := range cases {
 		_, err := parseExpr(c.incorrectExpr)
@@ -217,3 +432,105 @@ func TestSyntaxIncorrect(t *testing.T) {
 		}
 	}
 }
+
+type countingExprNode struct {
+	exprBackground
+	val   interface{}
+	count int
+}
+
+func (ce *countingExprNode) Run(string, *TagExpr) interface{} {
+	ce.count++
+	return ce.val
+}
+
+func TestCoalesceAllLazy(t *testing.T) {
+	var cases = []struct {
+		vals   []interface{}
+		val    interface{}
+		counts []int
+	}{
+		{vals: []interface{}{"a", nil, "default"}, val: "a", counts: []int{1, 0, 0}},
+		{vals: []interface{}{nil, "b", "default"}, val: "b", counts: []int{1, 1, 0}},
+		{vals: []interface{}{nil, "", "default"}, val: "default", counts: []int{1, 1, 1}},
+	}
+	for _, c := range cases {
+		vm, err := parseExpr("coalesceAll(1,2,3)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := vm.expr.RightOperand().RightOperand().(*coalesceAllFnExprNode)
+		args := make([]*countingExprNode, len(c.vals))
+		for i, v := range c.vals {
+			args[i] = &countingExprNode{val: v}
+			e.args[i] = args[i]
+		}
+		val := vm.run("", nil)
+		if !reflect.DeepEqual(val, c.val) {
+			t.Fatalf("got: %v, want: %v", val, c.val)
+		}
+		for i, a := range args {
+			if a.count != c.counts[i] {
+				t.Fatalf("arg %d evaluated %d times, want: %d", i, a.count, c.counts[i])
+			}
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	expr := "!(len((A)$[0]) > 1.5) && regexp('^a,b$', $) || $!='x'"
+	want := []Token{
+		{TokenOperator, "!", 0, 1},
+		{TokenLeftParen, "(", 1, 2},
+		{TokenFunc, "len", 2, 5},
+		{TokenLeftParen, "(", 5, 6},
+		{TokenSelector, "(A)$[0]", 6, 13},
+		{TokenRightParen, ")", 13, 14},
+		{TokenOperator, ">", 15, 16},
+		{TokenNumber, "1.5", 17, 20},
+		{TokenRightParen, ")", 20, 21},
+		{TokenOperator, "&&", 22, 24},
+		{TokenFunc, "regexp", 25, 31},
+		{TokenLeftParen, "(", 31, 32},
+		{TokenString, "'^a,b$'", 32, 39},
+		{TokenComma, ",", 39, 40},
+		{TokenSelector, "$", 41, 42},
+		{TokenRightParen, ")", 42, 43},
+		{TokenOperator, "||", 44, 46},
+		{TokenSelector, "$", 47, 48},
+		{TokenOperator, "!=", 48, 50},
+		{TokenString, "'x'", 50, 53},
+	}
+	tokens, err := New("").Tokens(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("got: %v\nwant: %v", tokens, want)
+	}
+	for _, tok := range tokens {
+		if expr[tok.Start:tok.End] != tok.Text {
+			t.Fatalf("token %v does not match its range", tok)
+		}
+	}
+	tokens, err = New("").Tokens("$ |> len |> at(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Token{
+		{TokenSelector, "$", 0, 1},
+		{TokenOperator, "|>", 2, 4},
+		{TokenFunc, "len", 5, 8},
+		{TokenOperator, "|>", 9, 11},
+		{TokenFunc, "at", 12, 14},
+		{TokenLeftParen, "(", 14, 15},
+		{TokenNumber, "0", 15, 16},
+		{TokenRightParen, ")", 16, 17},
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("got: %v\nwant: %v", tokens, want)
+	}
+	if _, err = New("").Tokens("1 + + 'a'"); err == nil {
+		t.Fatal("want syntax error")
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2019 Bytedance Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tagexpr
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// --------------------------- Compiled Plan ---------------------------
+
+// maxPlanDepth the depth limit of each operand stack of a plan,
+// the stacks are arrays on the goroutine stack, so the evaluation does not allocate.
+const maxPlanDepth = 16
+
+// planType the static type of a value of the plan
+type planType uint8
+
+const (
+	planNumber planType = iota + 1
+	planString
+	planBool
+)
+
+// planOp the instruction of the plan, each one works on the operand stack of its type
+type planOp uint8
+
+const (
+	opNumber     planOp = iota + 1 // push the number literal
+	opString                       // push the string literal
+	opBool                         // push the bool literal
+	opLoadNumber                   // push the numeric field at the offset
+	opLoadString                   // push the string field at the offset
+	opLoadBool                     // push the bool field at the offset
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opRem
+	opNumberEQ
+	opNumberNE
+	opNumberGT
+	opNumberGE
+	opNumberLT
+	opNumberLE
+	opStringEQ
+	opStringNE
+	opStringGT
+	opStringGE
+	opStringLT
+	opStringLE
+	opBoolEQ
+	opBoolNE
+	opNumberTruth // pop the number and push whether it is not 0
+	opStringTruth // pop the string and push whether it is not ""
+	opAnd         // jump with the false on the top, pop the true otherwise
+	opOr          // jump with the true on the top, pop the false otherwise
+)
+
+type planInstr struct {
+	op     planOp
+	kind   reflect.Kind // the kind of the numeric field of opLoadNumber
+	offset uintptr      // the field offset of the load instructions
+	num    float64
+	str    string
+	b      bool
+	jump   int // the instruction index that opAnd and opOr jump to
+	// cross the other struct field read by the load instructions, empty for the current field
+	cross string
+}
+
+// plan the flat instructions that the expression tree of a selector is lowered to,
+// with the field values read at their offsets in the struct.
+// It covers the number, string and bool literals, the plain fields without sub-selectors,
+// the arithmetic of numbers and the comparisons, && and || of them.
+type plan struct {
+	instrs []planInstr
+	result planType
+}
+
+// compilePlans compiles the plans of the expressions of the struct, see compilePlan.
+func (s *Struct) compilePlans() {
+	for _, selector := range s.selectorList {
+		if pl := s.compilePlan(selector, s.exprs[selector]); pl != nil {
+			if s.plans == nil {
+				s.plans = make(map[string]*plan)
+			}
+			s.plans[selector] = pl
+		}
+	}
+}
+
+// compilePlan returns the plan of the expression of the selector,
+// or nil if the expression contains the nodes that a plan does not cover.
+func (s *Struct) compilePlan(selector string, expr *Expr) *plan {
+	c := &planCompiler{
+		s:         s,
+		currField: getFieldSelector(selector),
+		pl:        new(plan),
+	}
+	typ, ok := c.compile(expr.expr)
+	if !ok {
+		return nil
+	}
+	c.pl.result = typ
+	return c.pl
+}
+
+type planCompiler struct {
+	s         *Struct
+	currField string
+	pl        *plan
+	// depths the current and the maximum depths of the operand stacks by planType
+	depths, maxDepths [planBool + 1]int
+}
+
+func (c *planCompiler) emit(in planInstr, pop [planBool + 1]int, push planType) bool {
+	for typ, n := range pop {
+		c.depths[typ] -= n
+	}
+	if push != 0 {
+		c.depths[push]++
+		if c.depths[push] > c.maxDepths[push] {
+			c.maxDepths[push] = c.depths[push]
+		}
+		if c.maxDepths[push] > maxPlanDepth {
+			return false
+		}
+	}
+	c.pl.instrs = append(c.pl.instrs, in)
+	return true
+}
+
+func pops(typ planType, n int) (r [planBool + 1]int) {
+	r[typ] = n
+	return r
+}
+
+func (c *planCompiler) compile(e ExprNode) (planType, bool) {
+	switch r := e.(type) {
+	case *groupExprNode:
+		if r.boolPrefix != nil || r.LeftOperand() != nil || r.RightOperand() == nil {
+			return 0, false
+		}
+		return c.compile(r.RightOperand())
+	case *digitalExprNode:
+		if r.bigVal != nil {
+			return 0, false
+		}
+		return planNumber, c.emit(planInstr{op: opNumber, num: r.val}, pops(0, 0), planNumber)
+	case *stringExprNode:
+		return planString, c.emit(planInstr{op: opString, str: r.val}, pops(0, 0), planString)
+	case *boolExprNode:
+		return planBool, c.emit(planInstr{op: opBool, b: r.val}, pops(0, 0), planBool)
+	case *selectorExprNode:
+		return c.compileSelector(r)
+	case *numCompareExprNode:
+		return c.compile(r.generic)
+	case *andExprNode:
+		return c.compileLogic(r, opAnd)
+	case *orExprNode:
+		return c.compileLogic(r, opOr)
+	}
+	if e == nil || e.LeftOperand() == nil || e.RightOperand() == nil {
+		return 0, false
+	}
+	arith, numOp, strOp, boolOp := planOpsOf(e)
+	if numOp == 0 {
+		return 0, false
+	}
+	t0, ok := c.compile(e.LeftOperand())
+	if !ok {
+		return 0, false
+	}
+	t1, ok := c.compile(e.RightOperand())
+	if !ok || t0 != t1 {
+		return 0, false
+	}
+	switch {
+	case t0 == planNumber && arith:
+		return planNumber, c.emit(planInstr{op: numOp}, pops(planNumber, 2), planNumber)
+	case t0 == planNumber:
+		return planBool, c.emit(planInstr{op: numOp}, pops(planNumber, 2), planBool)
+	case t0 == planString && strOp != 0:
+		return planBool, c.emit(planInstr{op: strOp}, pops(planString, 2), planBool)
+	case t0 == planBool && boolOp != 0:
+		return planBool, c.emit(planInstr{op: boolOp}, pops(planBool, 2), planBool)
+	}
+	return 0, false
+}
+
+// planOpsOf returns the instructions of the binary operator by the operand type,
+// arith whether the operator is the arithmetic of numbers.
+func planOpsOf(e ExprNode) (arith bool, numOp, strOp, boolOp planOp) {
+	switch e.(type) {
+	case *additionExprNode:
+		return true, opAdd, 0, 0
+	case *subtractionExprNode:
+		return true, opSub, 0, 0
+	case *multiplicationExprNode:
+		return true, opMul, 0, 0
+	case *divisionExprNode:
+		return true, opDiv, 0, 0
+	case *remainderExprNode:
+		return true, opRem, 0, 0
+	case *equalExprNode:
+		return false, opNumberEQ, opStringEQ, opBoolEQ
+	case *notEqualExprNode:
+		return false, opNumberNE, opStringNE, opBoolNE
+	case *greaterExprNode:
+		return false, opNumberGT, opStringGT, 0
+	case *greaterEqualExprNode:
+		return false, opNumberGE, opStringGE, 0
+	case *lessExprNode:
+		return false, opNumberLT, opStringLT, 0
+	case *lessEqualExprNode:
+		return false, opNumberLE, opStringLE, 0
+	}
+	return false, 0, 0, 0
+}
+
+// compileLogic compiles && and ||, the right operand is skipped if the left one decides the result.
+func (c *planCompiler) compileLogic(e ExprNode, op planOp) (planType, bool) {
+	if !c.compileTruth(e.LeftOperand()) {
+		return 0, false
+	}
+	jump := len(c.pl.instrs)
+	if !c.emit(planInstr{op: op}, pops(planBool, 1), 0) || !c.compileTruth(e.RightOperand()) {
+		return 0, false
+	}
+	c.pl.instrs[jump].jump = len(c.pl.instrs)
+	return planBool, true
+}
+
+// compileTruth compiles the operand of && and || converted to bool like isTruthy.
+func (c *planCompiler) compileTruth(e ExprNode) bool {
+	typ, ok := c.compile(e)
+	switch {
+	case !ok:
+		return false
+	case typ == planNumber:
+		return c.emit(planInstr{op: opNumberTruth}, pops(planNumber, 1), planBool)
+	case typ == planString:
+		return c.emit(planInstr{op: opStringTruth}, pops(planString, 1), planBool)
+	}
+	return true
+}
+
+func (c *planCompiler) compileSelector(se *selectorExprNode) (planType, bool) {
+	if se.ref || se.boolPrefix != nil || len(se.subExprs) > 0 {
+		return 0, false
+	}
+	field := se.field
+	if field == "" {
+		field = c.currField
+	} else {
+		if se.alias {
+			field = c.s.aliases[field]
+		}
+	}
+	f, ok := c.s.fields[field]
+	if !ok || f.valueGetter == nil {
+		return 0, false
+	}
+	sf, offset, ok := fieldOffset(c.s.typ, field)
+	if !ok || sf.Type != f.Type || sf.Type.PkgPath() != "" || sf.Type.Name() == "" {
+		return 0, false
+	}
+	in := planInstr{kind: sf.Type.Kind(), offset: offset}
+	if se.field != "" {
+		in.cross = field
+	}
+	switch in.kind {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		in.op = opLoadNumber
+		return planNumber, c.emit(in, pops(0, 0), planNumber)
+	case reflect.String:
+		in.op = opLoadString
+		return planString, c.emit(in, pops(0, 0), planString)
+	case reflect.Bool:
+		in.op = opLoadBool
+		return planBool, c.emit(in, pops(0, 0), planBool)
+	}
+	return 0, false
+}
+
+// fieldOffset returns the struct field of the selector, such as A.B, and its offset in the struct,
+// it is false if the field is not reached through the values of the nested structs.
+func fieldOffset(t reflect.Type, field string) (reflect.StructField, uintptr, bool) {
+	var offset uintptr
+	for {
+		name := field
+		idx := strings.IndexByte(field, '.')
+		if idx >= 0 {
+			name = field[:idx]
+		}
+		sf, ok := t.FieldByName(name)
+		if !ok || len(sf.Index) != 1 {
+			return reflect.StructField{}, 0, false
+		}
+		offset += sf.Offset
+		if idx < 0 {
+			return sf, offset, true
+		}
+		if sf.Type.Kind() != reflect.Struct {
+			return reflect.StructField{}, 0, false
+		}
+		t, field = sf.Type, field[idx+1:]
+	}
+}
+
+// plansApply reports whether the options of the vm leave the values of the plan unchanged,
+// the plans only evaluate the float64 numbers of the default options.
+func (vm *VM) plansApply() bool {
+	return !vm.planDisabled && !vm.integerMode && vm.fieldValueHook == nil && !vm.emptyStringIsNil &&
+		vm.nanComparison == NaNIEEE && atomic.LoadInt32(&vm.numExtractors) == 0
+}
+
+// run evaluates the plan with the struct of the TagExpr,
+// it is false if the expression tree should be evaluated instead,
+// such as for the integers that float64 can not represent exactly.
+func (pl *plan) run(t *TagExpr) (interface{}, bool) {
+	// within an outer pass, such as Range, the other fields are read from the values resolved once
+	// like the expression tree, and the single evaluation reads them at their offsets
+	shared := t.passes > 1
+	var (
+		nums       [maxPlanDepth]float64
+		strs       [maxPlanDepth]string
+		bools      [maxPlanDepth]bool
+		nn, ns, nb int
+		instrs     = pl.instrs
+		vm         = t.s.vm
+		ok         bool
+		pc         int
+		base       = t.ptr
+	)
+	for pc < len(instrs) {
+		in := &instrs[pc]
+		pc++
+		switch in.op {
+		case opNumber:
+			nums[nn] = in.num
+			nn++
+		case opString:
+			strs[ns] = in.str
+			ns++
+		case opBool:
+			bools[nb] = in.b
+			nb++
+		case opLoadNumber:
+			if in.cross != "" && shared {
+				nums[nn], ok = t.getCrossFieldValue(in.cross, nil).(float64)
+				ok = ok && math.Abs(nums[nn]) < maxExactInt
+			} else {
+				nums[nn], ok = loadNumber(in.kind, base+in.offset)
+			}
+			if !ok {
+				return nil, false
+			}
+			nn++
+		case opLoadString:
+			if in.cross != "" && shared {
+				if strs[ns], ok = t.getCrossFieldValue(in.cross, nil).(string); !ok {
+					return nil, false
+				}
+			} else {
+				strs[ns] = *(*string)(unsafe.Pointer(base + in.offset))
+			}
+			ns++
+		case opLoadBool:
+			if in.cross != "" && shared {
+				if bools[nb], ok = t.getCrossFieldValue(in.cross, nil).(bool); !ok {
+					return nil, false
+				}
+			} else {
+				bools[nb] = *(*bool)(unsafe.Pointer(base + in.offset))
+			}
+			nb++
+		case opNumberTruth:
+			nn--
+			bools[nb] = nums[nn] != 0
+			nb++
+		case opStringTruth:
+			ns--
+			bools[nb] = strs[ns] != ""
+			nb++
+		case opAnd:
+			if !bools[nb-1] {
+				pc = in.jump
+			} else {
+				nb--
+			}
+		case opOr:
+			if bools[nb-1] {
+				pc = in.jump
+			} else {
+				nb--
+			}
+		case opStringEQ, opStringNE, opStringGT, opStringGE, opStringLT, opStringLE:
+			ns -= 2
+			bools[nb] = compareStringsOp(vm, in.op, strs[ns], strs[ns+1])
+			nb++
+		case opBoolEQ, opBoolNE:
+			nb--
+			bools[nb-1] = (bools[nb-1] == bools[nb]) == (in.op == opBoolEQ)
+		case opAdd, opSub, opMul, opDiv, opRem:
+			nn--
+			nums[nn-1] = arithOp(vm, in.op, nums[nn-1], nums[nn])
+		default:
+			nn -= 2
+			bools[nb] = compareNumbersOp(in.op, nums[nn], nums[nn+1])
+			nb++
+		}
+	}
+	switch pl.result {
+	case planNumber:
+		return nums[0], true
+	case planString:
+		return strs[0], true
+	}
+	return bools[0], true
+}
+
+// arithOp calculates the number like the arithmetic operators of the float64 numbers.
+func arithOp(vm *VM, op planOp, v0, v1 float64) float64 {
+	switch op {
+	case opAdd:
+		return v0 + v1
+	case opSub:
+		return v0 - v1
+	case opMul:
+		return v0 * v1
+	case opDiv:
+		if v1 == 0 {
+			return math.NaN()
+		}
+		return v0 / v1
+	}
+	i1 := vm.toInt(v1)
+	if i1 == 0 {
+		return math.NaN()
+	}
+	return float64(vm.toInt(v0) % i1)
+}
+
+func compareNumbersOp(op planOp, v0, v1 float64) bool {
+	switch op {
+	case opNumberEQ:
+		return v0 == v1
+	case opNumberNE:
+		return v0 != v1
+	case opNumberGT:
+		return v0 > v1
+	case opNumberGE:
+		return v0 >= v1
+	case opNumberLT:
+		return v0 < v1
+	}
+	return v0 <= v1
+}
+
+func compareStringsOp(vm *VM, op planOp, v0, v1 string) bool {
+	switch op {
+	case opStringEQ:
+		return v0 == v1
+	case opStringNE:
+		return v0 != v1
+	}
+	c := vm.compareStrings(v0, v1)
+	switch op {
+	case opStringGT:
+		return c > 0
+	case opStringGE:
+		return c >= 0
+	case opStringLT:
+		return c < 0
+	}
+	return c <= 0
+}
+
+// loadNumber reads the numeric field like getFloat64,
+// it is false for the integers beyond the exact range of float64.
+func loadNumber(kind reflect.Kind, ptr uintptr) (float64, bool) {
+	p := unsafe.Pointer(ptr)
+	switch kind {
+	case reflect.Float32:
+		return float64(*(*float32)(p)), true
+	case reflect.Float64:
+		return *(*float64)(p), true
+	case reflect.Int:
+		return exactInt(int64(*(*int)(p)))
+	case reflect.Int8:
+		return float64(*(*int8)(p)), true
+	case reflect.Int16:
+		return float64(*(*int16)(p)), true
+	case reflect.Int32:
+		return float64(*(*int32)(p)), true
+	case reflect.Int64:
+		return exactInt(*(*int64)(p))
+	case reflect.Uint:
+		return exactUint(uint64(*(*uint)(p)))
+	case reflect.Uint8:
+		return float64(*(*uint8)(p)), true
+	case reflect.Uint16:
+		return float64(*(*uint16)(p)), true
+	case reflect.Uint32:
+		return float64(*(*uint32)(p)), true
+	case reflect.Uint64:
+		return exactUint(*(*uint64)(p))
+	case reflect.Uintptr:
+		return exactUint(uint64(*(*uintptr)(p)))
+	}
+	return 0, false
+}
+
+func exactInt(i int64) (float64, bool) {
+	return float64(i), i <= maxExactInt && i >= -maxExactInt
+}
+
+func exactUint(u uint64) (float64, bool) {
+	return float64(u), u <= maxExactInt
+}
@@ -15,15 +15,105 @@
 package tagexpr
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
+	"net"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
+	"unicode/utf8"
 )
 
 // --------------------------- Built-in function ---------------------------
 
+// funcCallExprNode counts the calls of the built-in function @rightOperand
+type funcCallExprNode struct{ exprBackground }
+
+func newFuncCallExprNode(fn ExprNode) ExprNode {
+	e := &funcCallExprNode{}
+	e.SetRightOperand(fn)
+	fn.SetParent(e)
+	return e
+}
+
+func (fe *funcCallExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if max := tagExpr.getVM().maxFuncCalls; max > 0 {
+		tagExpr.funcCalls++
+		if tagExpr.funcCalls > max {
+			failEval("function calls exceed the limit %d", max)
+		}
+	}
+	return fe.rightOperand.Run(currField, tagExpr)
+}
+
+// readFnArgs reads the comma-separated arguments of the function call @name(...).
+func (p *Expr) readFnArgs(expr *string, name string) ([]ExprNode, bool) {
+	if !strings.HasPrefix(*expr, name+"(") {
+		return nil, false
+	}
+	lastStr := *expr
+	*expr = (*expr)[len(name):]
+	subExprNode := readPairedSymbol(expr, '(', ')')
+	if subExprNode == nil {
+		*expr = lastStr
+		return nil, false
+	}
+	var args []ExprNode
+	trimLeftSpace(subExprNode)
+	for *subExprNode != "" {
+		operand := newGroupExprNode()
+		_, err := p.parseExprNode(subExprNode, operand)
+		if err != nil {
+			*expr = lastStr
+			return nil, false
+		}
+		sortPriority(operand.RightOperand())
+		args = append(args, operand)
+		trimLeftSpace(subExprNode)
+		if *subExprNode == "" {
+			break
+		}
+		if (*subExprNode)[0] != ',' {
+			*expr = lastStr
+			return nil, false
+		}
+		*subExprNode = (*subExprNode)[1:]
+		if *trimLeftSpace(subExprNode) == "" {
+			*expr = lastStr
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// readFnArg reads the only argument of the function call @name(...),
+// the current struct field value is used when it is omitted.
+func (p *Expr) readFnArg(expr *string, name string) (ExprNode, bool) {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, name)
+	if !ok {
+		return nil, false
+	}
+	switch len(args) {
+	case 0:
+		operand := newGroupExprNode()
+		var currFieldVal = "$"
+		p.parseExprNode(&currFieldVal, operand)
+		return operand, true
+	case 1:
+		return args[0], true
+	default:
+		*expr = lastStr
+		return nil, false
+	}
+}
+
 type lenFnExprNode struct{ exprBackground }
 
 func (p *Expr) readLenFnExprNode(expr *string) ExprNode {
@@ -55,7 +145,8 @@ func (le *lenFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	switch v := param.(type) {
 	case string:
 		return float64(len(v))
-	case float64, bool:
+	case float64, int64, bool:
+		tagExpr.getVM().mismatchFuncArg("len", 1, "string, slice, array, map or chan", v)
 		return nil
 	}
 	defer func() { recover() }()
@@ -117,17 +208,96 @@ func (re *regexpFnExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	param := re.rightOperand.Run(currField, tagExpr)
 	switch v := param.(type) {
 	case string:
+		tagExpr.getVM().checkStringFuncLen("regexp", v)
 		return re.re.MatchString(v)
-	case float64, bool:
+	case float64, int64, bool:
+		tagExpr.getVM().mismatchFuncArg("regexp", 2, "string", v)
 		return nil
 	}
 	v := reflect.ValueOf(param)
 	if v.Kind() == reflect.String {
+		tagExpr.getVM().checkStringFuncLen("regexp", v.String())
 		return re.re.MatchString(v.String())
 	}
+	tagExpr.getVM().mismatchFuncArg("regexp", 2, "string", param)
 	return nil
 }
 
+type regexpReplaceFnExprNode struct {
+	exprBackground
+	args []ExprNode
+	re   *regexp.Regexp
+	repl string
+}
+
+func (p *Expr) readRegexpReplaceFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "regexpReplace")
+	if !ok {
+		return nil
+	}
+	if len(args) != 3 {
+		*expr = lastStr
+		return nil
+	}
+	pattern, ok := stringLiteral(args[1])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	repl, ok := stringLiteral(args[2])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	rege, err := regexp.Compile(pattern)
+	if err != nil {
+		*expr = lastStr
+		return nil
+	}
+	return &regexpReplaceFnExprNode{args: args[:1], re: rege, repl: repl}
+}
+
+// Run replaces the matches of the pattern in the string,
+// $1 in the replacement refers to the first submatch.
+func (re *regexpReplaceFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	param := re.args[0].Run(currField, tagExpr)
+	var s string
+	switch v := param.(type) {
+	case string:
+		s = v
+	case nil, float64, int64, bool:
+		tagExpr.getVM().mismatchFuncArg("regexpReplace", 1, "string", v)
+		return nil
+	default:
+		vv := derefValue(reflect.ValueOf(v))
+		if vv.Kind() != reflect.String {
+			tagExpr.getVM().mismatchFuncArg("regexpReplace", 1, "string", v)
+			return nil
+		}
+		s = vv.String()
+	}
+	tagExpr.getVM().checkStringFuncLen("regexpReplace", s)
+	return re.re.ReplaceAllString(s, re.repl)
+}
+
+// stringLiteral returns the value of the function argument
+// if it is a single string literal.
+func stringLiteral(arg ExprNode) (string, bool) {
+	for {
+		grp, ok := arg.(*groupExprNode)
+		if !ok || grp.boolPrefix != nil || grp.LeftOperand() != nil {
+			break
+		}
+		arg = grp.RightOperand()
+	}
+	se, ok := arg.(*stringExprNode)
+	if !ok || se.LeftOperand() != nil || se.RightOperand() != nil {
+		return "", false
+	}
+	return se.val, true
+}
+
 type sprintfFnExprNode struct {
 	exprBackground
 	format string
@@ -180,7 +350,1462 @@ func (se *sprintfFnExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 		args = make([]interface{}, n)
 		for i, e := range se.args {
 			args[i] = e.Run(currField, tagExpr)
+			switch v := args[i].(type) {
+			case bool:
+				args[i] = boolFormatter{b: v, vm: tagExpr.getVM()}
+			case float64, int64:
+				if loc := tagExpr.getVM().numberLocale; loc != nil {
+					args[i] = numberFormatter{v: v, loc: loc}
+				}
+			}
 		}
 	}
 	return fmt.Sprintf(se.format, args...)
 }
+
+// boolFormatter formats the bool argument of sprintf with the bool strings of the vm,
+// for the verbs other than %s and %v, it is formatted as usual.
+type boolFormatter struct {
+	b  bool
+	vm *VM
+}
+
+func (bf boolFormatter) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 's', 'v':
+		fmt.Fprint(f, bf.vm.formatBool(bf.b))
+	default:
+		fmt.Fprintf(f, "%"+string(verb), bf.b)
+	}
+}
+
+// numberFormatter formats the numeric argument of sprintf with the separators of the locale
+// set by vm.SetNumberFormatLocale, the width pads the localized number with spaces.
+type numberFormatter struct {
+	v   interface{} // float64 or int64
+	loc *numberLocale
+}
+
+func (nf numberFormatter) Format(f fmt.State, verb rune) {
+	var s string
+	switch verb {
+	case 'v', 'd', 'f', 'F', 'g', 'G', 'e', 'E':
+		s = nf.format(f, verb)
+	default:
+		fmt.Fprintf(f, "%"+string(verb), nf.v)
+		return
+	}
+	width, ok := f.Width()
+	if n := utf8.RuneCountInString(s); ok && n < width {
+		pad := strings.Repeat(" ", width-n)
+		if f.Flag('-') {
+			s += pad
+		} else {
+			s = pad + s
+		}
+	}
+	fmt.Fprint(f, s)
+}
+
+// format formats the number without width, then localizes the separators.
+func (nf numberFormatter) format(f fmt.State, verb rune) string {
+	spec := "%"
+	for _, flag := range "+ #" {
+		if f.Flag(int(flag)) {
+			spec += string(flag)
+		}
+	}
+	if prec, ok := f.Precision(); ok {
+		spec += "." + strconv.Itoa(prec)
+	}
+	v := nf.v
+	switch x := v.(type) {
+	case float64:
+		if verb == 'd' {
+			return fmt.Sprintf("%d", v)
+		}
+		if verb == 'v' && spec == "%" && math.Abs(x) < 1e21 {
+			return nf.localize(strconv.FormatFloat(x, 'f', -1, 64))
+		}
+	case int64:
+		if verb != 'v' && verb != 'd' {
+			return fmt.Sprintf("%"+string(verb), v)
+		}
+	}
+	return nf.localize(fmt.Sprintf(spec+string(verb), v))
+}
+
+// localize groups the integer digits and replaces the decimal point of the formatted number.
+func (nf numberFormatter) localize(s string) string {
+	start := strings.IndexAny(s, "0123456789")
+	if start < 0 {
+		return s // NaN, Inf
+	}
+	end := start
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	var b strings.Builder
+	b.WriteString(s[:start])
+	for i := start; i < end; i++ {
+		if i > start && (end-i)%3 == 0 {
+			b.WriteString(nf.loc.group)
+		}
+		b.WriteByte(s[i])
+	}
+	rest := s[end:]
+	if strings.HasPrefix(rest, ".") {
+		b.WriteString(nf.loc.decimal)
+		rest = rest[1:]
+	}
+	b.WriteString(rest)
+	return b.String()
+}
+
+type numberFnExprNode struct{ exprBackground }
+
+func (p *Expr) readNumberFnExprNode(expr *string) ExprNode {
+	operand, ok := p.readFnArg(expr, "number")
+	if !ok {
+		return nil
+	}
+	e := &numberFnExprNode{}
+	e.SetRightOperand(operand)
+	return e
+}
+
+func (ne *numberFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	switch v := ne.rightOperand.Run(currField, tagExpr).(type) {
+	case float64, int64:
+		return v
+	case string:
+		return tagExpr.getVM().parseNumber(v)
+	default:
+		tagExpr.getVM().mismatchFuncArg("number", 1, "number or string", v)
+	}
+	return nil
+}
+
+// stringCheckFuncs the built-in functions that check whether a string value meets the condition
+var stringCheckFuncs = map[string]func(string) bool{
+	"isASCII": isASCII,
+	"isUTF8":  utf8.ValidString,
+	"isBlank": isBlank,
+	"isJSON": func(s string) bool {
+		return json.Valid([]byte(s))
+	},
+	"isIP": func(s string) bool {
+		return net.ParseIP(s) != nil
+	},
+	"isIPv4": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil
+	},
+	"isIPv6": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() == nil
+	},
+	"isDigit": func(s string) bool {
+		return allRunes(s, unicode.IsDigit)
+	},
+	"isAlpha": func(s string) bool {
+		return allRunes(s, unicode.IsLetter)
+	},
+	"isAlphaNumeric": func(s string) bool {
+		return allRunes(s, func(r rune) bool {
+			return unicode.IsLetter(r) || unicode.IsDigit(r)
+		})
+	},
+	"notBlank": func(s string) bool {
+		return !isBlank(s)
+	},
+}
+
+var fnNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\(`)
+
+type stringCheckFnExprNode struct {
+	exprBackground
+	name  string
+	check func(string) bool
+}
+
+func (p *Expr) readStringCheckFnExprNode(expr *string) ExprNode {
+	name := strings.TrimSuffix(fnNameRegexp.FindString(*expr), "(")
+	check, ok := stringCheckFuncs[name]
+	if !ok {
+		return nil
+	}
+	operand, ok := p.readFnArg(expr, name)
+	if !ok {
+		return nil
+	}
+	e := &stringCheckFnExprNode{name: name, check: check}
+	e.SetRightOperand(operand)
+	return e
+}
+
+func (se *stringCheckFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	v := se.rightOperand.Run(currField, tagExpr)
+	if s, ok := v.(string); ok {
+		return se.check(s)
+	}
+	tagExpr.getVM().mismatchFuncArg(se.name, 1, "string", v)
+	return nil
+}
+
+// allRunes reports whether the string is not empty and all its runes meet the condition.
+func allRunes(s string, f func(rune) bool) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !f(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isBlank(s string) bool {
+	return len(strings.TrimSpace(s)) == 0
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// onlyCharsFnExprNode onlyChars((X)$, 'abc'), whether every character of the string is in the whitelist
+type onlyCharsFnExprNode struct {
+	exprBackground
+	allowed map[rune]struct{}
+}
+
+func (p *Expr) readOnlyCharsFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "onlyChars")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	whitelist, ok := stringLiteral(args[1])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	allowed := make(map[rune]struct{}, len(whitelist))
+	for _, r := range whitelist {
+		allowed[r] = struct{}{}
+	}
+	e := &onlyCharsFnExprNode{allowed: allowed}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+// Run reports whether all the characters of the string are allowed, true if it is empty.
+func (oe *onlyCharsFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	v := oe.rightOperand.Run(currField, tagExpr)
+	s, ok := v.(string)
+	if !ok {
+		tagExpr.getVM().mismatchFuncArg("onlyChars", 1, "string", v)
+		return nil
+	}
+	tagExpr.getVM().checkStringFuncLen("onlyChars", s)
+	for _, r := range s {
+		if _, ok := oe.allowed[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// editDistanceFnExprNode editDistance((X)$, 'expected'), the Levenshtein distance between the strings
+type editDistanceFnExprNode struct {
+	exprBackground
+	args []ExprNode
+}
+
+func (p *Expr) readEditDistanceFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "editDistance")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	return &editDistanceFnExprNode{args: args}
+}
+
+// editDistanceMaxRunes the maximum rune count of the inputs of editDistance,
+// which takes the time of the product of the rune counts
+const editDistanceMaxRunes = 1024
+
+// Run returns the count of the single-character insertions, deletions and substitutions
+// that change one string into the other, return nil if either is not a string.
+// The evaluation is aborted if an input has more than editDistanceMaxRunes runes.
+func (ee *editDistanceFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vm := tagExpr.getVM()
+	var s [2]string
+	for i, arg := range ee.args {
+		v := arg.Run(currField, tagExpr)
+		str, ok := v.(string)
+		if !ok {
+			vm.mismatchFuncArg("editDistance", i+1, "string", v)
+			return nil
+		}
+		vm.checkStringFuncLen("editDistance", str)
+		if n := utf8.RuneCountInString(str); n > editDistanceMaxRunes {
+			failEval("editDistance: input length %d exceeds the limit %d runes", n, editDistanceMaxRunes)
+		}
+		s[i] = str
+	}
+	return float64(levenshtein([]rune(s[0]), []rune(s[1])))
+}
+
+// isStepFnExprNode isStep((X)$, 0.25), whether the number is an integer multiple of the step
+type isStepFnExprNode struct {
+	exprBackground
+	args []ExprNode
+}
+
+func (p *Expr) readIsStepFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "isStep")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	return &isStepFnExprNode{args: args}
+}
+
+// stepTolerance the tolerance of the quotient of isStep in ULPs, such as 0.3/0.1 = 2.9999999999999996
+const stepTolerance = 4
+
+// Run returns whether the number is an integer multiple of the step, within the float tolerance,
+// return nil if either is not a number, the evaluation is aborted if the step is not positive.
+func (ie *isStepFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vm := tagExpr.getVM()
+	var n [2]interface{}
+	for i, arg := range ie.args {
+		v := arg.Run(currField, tagExpr)
+		switch v.(type) {
+		case float64, int64:
+		default:
+			vm.mismatchFuncArg("isStep", i+1, "number", v)
+			return nil
+		}
+		n[i] = v
+	}
+	if x, ok := n[0].(int64); ok {
+		if step, ok := n[1].(int64); ok {
+			if step <= 0 {
+				failEval("isStep: the step must be positive, got %d", step)
+			}
+			return x%step == 0
+		}
+	}
+	x, step := toFloat64(n[0]), toFloat64(n[1])
+	if !(step > 0) || math.IsInf(step, 1) {
+		failEval("isStep: the step must be positive, got %v", step)
+	}
+	q := x / step
+	if math.IsNaN(q) || math.IsInf(q, 0) {
+		return false
+	}
+	r := math.Abs(math.Round(q))
+	return math.Abs(math.Abs(q)-r) <= stepTolerance*(math.Nextafter(r, math.Inf(1))-r)
+}
+
+// toFloat64 converts the float64 or int64 number to float64.
+func toFloat64(v interface{}) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+func levenshtein(a, b []rune) int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur := row[j]
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			row[j] = minInt(minInt(row[j]+1, row[j-1]+1), prev+cost)
+			prev = cur
+		}
+	}
+	return row[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type atFnExprNode struct {
+	exprBackground
+	args []ExprNode
+}
+
+func (p *Expr) readAtFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "at")
+	if !ok {
+		return nil
+	}
+	if n := len(args); n < 2 || n > 3 {
+		*expr = lastStr
+		return nil
+	}
+	return &atFnExprNode{args: args}
+}
+
+func (ae *atFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	var def interface{}
+	if len(ae.args) == 3 {
+		def = ae.args[2].Run(currField, tagExpr)
+	}
+	idx := ae.args[1].Run(currField, tagExpr)
+	i, ok := tagExpr.getVM().toIndex(idx)
+	if !ok {
+		tagExpr.getVM().mismatchFuncArg("at", 2, "number", idx)
+		return def
+	}
+	if i < 0 {
+		return def
+	}
+	switch v := ae.args[0].Run(currField, tagExpr).(type) {
+	case string:
+		for _, r := range v {
+			if i == 0 {
+				return string(r)
+			}
+			i--
+		}
+		return def
+	case nil, float64, int64, bool:
+		return def
+	default:
+		vv := derefValue(reflect.ValueOf(v))
+		switch vv.Kind() {
+		case reflect.Slice, reflect.Array:
+			if i < vv.Len() {
+				return tagExpr.getVM().elemInterface(vv.Index(i))
+			}
+		}
+		return def
+	}
+}
+
+type coalesceAllFnExprNode struct {
+	exprBackground
+	args []ExprNode
+}
+
+func (p *Expr) readCoalesceAllFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "coalesceAll")
+	if !ok {
+		return nil
+	}
+	if len(args) == 0 {
+		*expr = lastStr
+		return nil
+	}
+	return &coalesceAllFnExprNode{args: args}
+}
+
+// Run returns the first argument that is neither nil nor empty,
+// the later arguments are not evaluated once one is chosen.
+func (ce *coalesceAllFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	for _, e := range ce.args {
+		if v := e.Run(currField, tagExpr); !isNilOrEmpty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func isNilOrEmpty(v interface{}) bool {
+	switch r := v.(type) {
+	case nil:
+		return true
+	case string:
+		return r == ""
+	case float64, bool:
+		return false
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return vv.Len() == 0
+	}
+	return false
+}
+
+type luhnFnExprNode struct{ exprBackground }
+
+func (p *Expr) readLuhnFnExprNode(expr *string) ExprNode {
+	operand, ok := p.readFnArg(expr, "luhn")
+	if !ok {
+		return nil
+	}
+	e := &luhnFnExprNode{}
+	e.SetRightOperand(operand)
+	return e
+}
+
+func (le *luhnFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	switch v := le.rightOperand.Run(currField, tagExpr).(type) {
+	case string:
+		return isLuhn(v)
+	case float64:
+		return isLuhn(strconv.FormatFloat(v, 'f', -1, 64))
+	case int64:
+		return isLuhn(strconv.FormatInt(v, 10))
+	default:
+		tagExpr.getVM().mismatchFuncArg("luhn", 1, "number or string", v)
+	}
+	return nil
+}
+
+// isLuhn reports whether the digit string passes the Luhn checksum.
+func isLuhn(s string) bool {
+	if s == "" {
+		return false
+	}
+	var sum int
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+type oneofFnExprNode struct{ exprBackground }
+
+func (p *Expr) readOneofFnExprNode(expr *string) ExprNode {
+	operand, ok := p.readFnArg(expr, "oneof")
+	if !ok {
+		return nil
+	}
+	e := &oneofFnExprNode{}
+	e.SetRightOperand(operand)
+	return e
+}
+
+// Run unwraps the set variant of the protobuf oneof field,
+// which is a pointer to a struct with the only field, return nil if it is unset.
+func (oe *oneofFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	switch v := oe.rightOperand.Run(currField, tagExpr).(type) {
+	case nil, string, float64, int64, bool:
+		return nil
+	default:
+		vv := derefValue(reflect.ValueOf(v))
+		if vv.Kind() != reflect.Struct || vv.NumField() != 1 {
+			return nil
+		}
+		return tagExpr.getVM().elemInterface(vv.Field(0))
+	}
+}
+
+type jsonGetFnExprNode struct {
+	exprBackground
+	path []string
+}
+
+func (p *Expr) readJSONGetFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "jsonGet")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	path, ok := stringLiteral(args[1])
+	if !ok || path == "" {
+		*expr = lastStr
+		return nil
+	}
+	e := &jsonGetFnExprNode{path: strings.Split(path, ".")}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+// Run returns the value at the dotted path of the JSON string,
+// the array elements are selected by the numeric keys.
+// It returns nil if the JSON is invalid or the path is absent.
+func (je *jsonGetFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	param := je.rightOperand.Run(currField, tagExpr)
+	s, ok := param.(string)
+	if !ok {
+		tagExpr.getVM().mismatchFuncArg("jsonGet", 1, "string", param)
+		return nil
+	}
+	tagExpr.getVM().checkStringFuncLen("jsonGet", s)
+	var v interface{}
+	if json.Unmarshal([]byte(s), &v) != nil {
+		return nil
+	}
+	for _, key := range je.path {
+		switch r := v.(type) {
+		case map[string]interface{}:
+			v, ok = r[key]
+			if !ok {
+				return nil
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(r) {
+				return nil
+			}
+			v = r[i]
+		default:
+			return nil
+		}
+	}
+	if f, ok := v.(float64); ok && tagExpr.getVM().integerMode {
+		i, _ := toInt64(f)
+		return i
+	}
+	return v
+}
+
+type sliceElemFnExprNode struct {
+	exprBackground
+	count  bool
+	parent bool
+}
+
+func (p *Expr) readSliceElemFnExprNode(expr *string) ExprNode {
+	for _, name := range [3]string{"index", "count", "parentIndex"} {
+		lastStr := *expr
+		args, ok := p.readFnArgs(expr, name)
+		if !ok {
+			continue
+		}
+		if len(args) != 0 {
+			*expr = lastStr
+			return nil
+		}
+		// the results vary by the element, not by the field value
+		p.volatile = true
+		return &sliceElemFnExprNode{count: name == "count", parent: name == "parentIndex"}
+	}
+	return nil
+}
+
+// Run returns the element index or the element count of vm.RunSlice or vm.RunRecursive,
+// the evaluation is aborted outside the elements, except that parentIndex() is nil.
+func (se *sliceElemFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil || tagExpr.count == 0 {
+		switch {
+		case se.parent:
+			return nil
+		case se.count:
+			failEval("count() is only available to the elements of vm.RunSlice or vm.RunRecursive")
+		}
+		failEval("index() is only available to the elements of vm.RunSlice or vm.RunRecursive")
+	}
+	if se.count {
+		return float64(tagExpr.count)
+	}
+	return float64(tagExpr.index)
+}
+
+type lookupFnExprNode struct {
+	exprBackground
+	table string
+}
+
+func (p *Expr) readLookupFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "lookup")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	table, ok := stringLiteral(args[0])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	// the tables can be replaced by vm.RegisterTable after the results are cached
+	p.volatile = true
+	e := &lookupFnExprNode{table: table}
+	e.SetRightOperand(args[1])
+	return e
+}
+
+// Run returns the value of the key in the table registered by vm.RegisterTable,
+// return nil if the key is absent. The evaluation is aborted if the table is not registered.
+func (le *lookupFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vm := tagExpr.getVM()
+	table, ok := vm.lookupTable(le.table)
+	if !ok {
+		failEval("lookup: unregistered table %q", le.table)
+	}
+	key := le.rightOperand.Run(currField, tagExpr)
+	if key == nil {
+		return nil
+	}
+	k := safeConvert(reflect.ValueOf(key), table.Type().Key())
+	if !k.IsValid() {
+		return nil
+	}
+	return vm.elemInterface(table.MapIndex(k))
+}
+
+type labelFnExprNode struct{ exprBackground }
+
+func (p *Expr) readLabelFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "label")
+	if !ok {
+		return nil
+	}
+	if len(args) != 0 {
+		*expr = lastStr
+		return nil
+	}
+	return &labelFnExprNode{}
+}
+
+// Run returns the label of the current struct field, return nil without struct.
+func (le *labelFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil {
+		return nil
+	}
+	return tagExpr.label(currField)
+}
+
+// selfTagFnExprNode selfTag('json'), the value of the tag key of the current struct field
+type selfTagFnExprNode struct{ exprBackground }
+
+func (p *Expr) readSelfTagFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "selfTag")
+	if !ok {
+		return nil
+	}
+	if len(args) != 1 {
+		*expr = lastStr
+		return nil
+	}
+	e := &selfTagFnExprNode{}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+// Run returns the value of the tag key of the current struct field,
+// return nil if the key is absent or without struct.
+func (se *selfTagFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	v := se.rightOperand.Run(currField, tagExpr)
+	key, ok := v.(string)
+	if !ok {
+		tagExpr.getVM().mismatchFuncArg("selfTag", 1, "string", v)
+		return nil
+	}
+	if tagExpr == nil {
+		return nil
+	}
+	return tagExpr.selfTag(currField, key)
+}
+
+type ipInCIDRFnExprNode struct {
+	exprBackground
+	ipNet *net.IPNet
+}
+
+func (p *Expr) readIPInCIDRFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "ipInCIDR")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	cidr, ok := stringLiteral(args[1])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		*expr = lastStr
+		return nil
+	}
+	e := &ipInCIDRFnExprNode{ipNet: ipNet}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+// Run reports whether the string is an IP within the CIDR,
+// return false if it is not an IP, and nil if it is not a string.
+func (ie *ipInCIDRFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	v := ie.rightOperand.Run(currField, tagExpr)
+	s, ok := v.(string)
+	if !ok {
+		tagExpr.getVM().mismatchFuncArg("ipInCIDR", 1, "string", v)
+		return nil
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && ie.ipNet.Contains(ip)
+}
+
+type setCountFnExprNode struct {
+	exprBackground
+	args []ExprNode
+	// exactlyOne whether exactly one argument should be set, otherwise at most one
+	exactlyOne bool
+}
+
+func (p *Expr) readSetCountFnExprNode(expr *string) ExprNode {
+	for _, name := range [2]string{"mutuallyExclusive", "exactlyOne"} {
+		lastStr := *expr
+		args, ok := p.readFnArgs(expr, name)
+		if !ok {
+			continue
+		}
+		if len(args) == 0 {
+			*expr = lastStr
+			return nil
+		}
+		return &setCountFnExprNode{args: args, exactlyOne: name == "exactlyOne"}
+	}
+	return nil
+}
+
+// Run reports whether at most one (or exactly one) argument is not zero.
+func (se *setCountFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	var n int
+	for _, e := range se.args {
+		if !isZeroValue(e.Run(currField, tagExpr)) {
+			n++
+			if n > 1 {
+				return false
+			}
+		}
+	}
+	return n == 1 || !se.exactlyOne
+}
+
+// isZeroValue reports whether the value is nil, false, 0, empty or the zero struct.
+func isZeroValue(v interface{}) bool {
+	switch r := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !r
+	case float64:
+		return r == 0
+	case int64:
+		return r == 0
+	case string:
+		return r == ""
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return vv.Len() == 0
+	}
+	return vv.IsZero()
+}
+
+// readPredicateArg reads the predicate argument of the aggregate functions such as any,
+// which is a sub-expression of the element such as #v > 10, or its string literal such as '# > 10'.
+func (p *Expr) readPredicateArg(arg ExprNode) (ExprNode, bool) {
+	if _, ok := stringLiteral(arg); !ok {
+		return arg, true
+	}
+	return p.readLiteralPredicate(arg)
+}
+
+// readLiteralPredicate parses the string literal predicate of the functions such as findFirst, e.g. '# > 10'.
+func (p *Expr) readLiteralPredicate(arg ExprNode) (ExprNode, bool) {
+	s, ok := stringLiteral(arg)
+	if !ok {
+		return nil, false
+	}
+	pred, err := parseExpr(s)
+	if err != nil {
+		return nil, false
+	}
+	if pred.crossField {
+		p.crossField = true
+	}
+	if pred.fractional {
+		p.fractional = true
+	}
+	if pred.volatile {
+		p.volatile = true
+	}
+	return pred.expr, true
+}
+
+// findFirstFnExprNode findFirst((X)$, '# > 10'), the first element of
+// struct field X(type: slice, array) that satisfies the predicate, nil if absent
+type findFirstFnExprNode struct {
+	exprBackground
+	pred ExprNode
+}
+
+func (p *Expr) readFindFirstFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "findFirst")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	pred, ok := p.readLiteralPredicate(args[1])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	e := &findFirstFnExprNode{pred: pred}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+func (fe *findFirstFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil {
+		return nil
+	}
+	v := fe.rightOperand.Run(currField, tagExpr)
+	switch v.(type) {
+	case nil, float64, int64, string, bool:
+		return nil
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil
+	}
+	vm := tagExpr.getVM()
+	for i := 0; i < vv.Len(); i++ {
+		elem := vm.elemInterface(vv.Index(i))
+		if tagExpr.evalElem(currField, float64(i), elem, fe.pred) == true {
+			return elem
+		}
+	}
+	return nil
+}
+
+// uniqueByFnExprNode uniqueBy((X)$, '#.ID'), whether the keys computed by the sub-expression
+// are distinct across the elements of struct field X(type: slice, array), nil if X is not a collection
+type uniqueByFnExprNode struct {
+	exprBackground
+	key ExprNode
+}
+
+func (p *Expr) readUniqueByFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	args, ok := p.readFnArgs(expr, "uniqueBy")
+	if !ok {
+		return nil
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	key, ok := p.readLiteralPredicate(args[1])
+	if !ok {
+		*expr = lastStr
+		return nil
+	}
+	e := &uniqueByFnExprNode{key: key}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+func (ue *uniqueByFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil {
+		return nil
+	}
+	v := ue.rightOperand.Run(currField, tagExpr)
+	switch v.(type) {
+	case nil, float64, int64, string, bool:
+		return nil
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil
+	}
+	// bigKey the key of a *big.Int, compared by value
+	type bigKey string
+	vm := tagExpr.getVM()
+	seen := make(map[interface{}]struct{}, vv.Len())
+	for i := 0; i < vv.Len(); i++ {
+		k := tagExpr.evalElem(currField, float64(i), vm.elemInterface(vv.Index(i)), ue.key)
+		switch x := k.(type) {
+		case *big.Int:
+			k = bigKey(x.String())
+		case nil, float64, int64, string, bool:
+		default:
+			if !reflect.TypeOf(k).Comparable() {
+				failEval("uniqueBy: the key of element %d is not comparable: %T", i, k)
+			}
+		}
+		if _, ok := seen[k]; ok {
+			return false
+		}
+		seen[k] = struct{}{}
+	}
+	return true
+}
+
+// aggregateFnExprNode the aggregate functions over the elements #v and their keys #k
+// of struct field X(type: slice, array, map):
+//  any((X)$, #v > 0) whether the predicate is true for any element,
+//  all((X)$, #v > 0) whether the predicate is true for all the elements,
+//  filter((X)$, #v > 0) the slice or map of the elements for which the predicate is true,
+//  sum((X)$) or sum((X)$, #v.Price) the sum of the numeric elements or their sub-expression values.
+type aggregateFnExprNode struct {
+	exprBackground
+	name string
+	pred ExprNode // nil for the sum of the elements
+}
+
+func (p *Expr) readAggregateFnExprNode(expr *string) ExprNode {
+	for _, name := range [4]string{"any", "all", "filter", "sum"} {
+		lastStr := *expr
+		args, ok := p.readFnArgs(expr, name)
+		if !ok {
+			continue
+		}
+		e := &aggregateFnExprNode{name: name}
+		switch {
+		case len(args) == 0 && name == "sum":
+			operand := newGroupExprNode()
+			var currFieldVal = "$"
+			p.parseExprNode(&currFieldVal, operand)
+			args = []ExprNode{operand}
+		case len(args) == 1 && name == "sum":
+		case len(args) == 2:
+			if e.pred, ok = p.readPredicateArg(args[1]); !ok {
+				*expr = lastStr
+				return nil
+			}
+		default:
+			*expr = lastStr
+			return nil
+		}
+		e.SetRightOperand(args[0])
+		return e
+	}
+	return nil
+}
+
+// Run returns nil if the value is not a slice, array or map,
+// the map elements are iterated in the order of the sorted keys.
+func (ae *aggregateFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil {
+		return nil
+	}
+	v := ae.rightOperand.Run(currField, tagExpr)
+	switch v.(type) {
+	case nil, float64, int64, string, bool:
+		return nil
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	vm := tagExpr.getVM()
+	var keys []reflect.Value
+	switch vv.Kind() {
+	case reflect.Slice, reflect.Array:
+	case reflect.Map:
+		keys = sortedMapKeys(vm, vv)
+	default:
+		return nil
+	}
+	var result reflect.Value
+	switch ae.name {
+	case "filter":
+		if keys != nil {
+			result = reflect.MakeMap(vv.Type())
+		} else {
+			result = reflect.MakeSlice(reflect.SliceOf(vv.Type().Elem()), 0, vv.Len())
+		}
+	}
+	var sum interface{} = float64(0)
+	if vm.integerMode {
+		sum = int64(0)
+	}
+	for i := 0; i < vv.Len(); i++ {
+		var key interface{}
+		var elem reflect.Value
+		if keys != nil {
+			key, elem = vm.elemInterface(keys[i]), vv.MapIndex(keys[i])
+		} else {
+			key, elem = float64(i), vv.Index(i)
+		}
+		val := vm.elemInterface(elem)
+		if ae.name == "sum" {
+			if ae.pred != nil {
+				val = tagExpr.evalElem(currField, key, val, ae.pred)
+			}
+			if sum = vm.addNumber(sum, val); sum == nil {
+				return nil
+			}
+			continue
+		}
+		ok := tagExpr.evalElem(currField, key, val, ae.pred) == true
+		switch ae.name {
+		case "any":
+			if ok {
+				return true
+			}
+		case "all":
+			if !ok {
+				return false
+			}
+		case "filter":
+			if !ok {
+				continue
+			}
+			if keys != nil {
+				result.SetMapIndex(keys[i], elem)
+			} else {
+				result = reflect.Append(result, elem)
+			}
+		}
+	}
+	switch ae.name {
+	case "any":
+		return false
+	case "all":
+		return true
+	case "filter":
+		return result.Interface()
+	}
+	return sum
+}
+
+// addNumber adds the element @v to the sum of the numbers, the nil elements are skipped,
+// return nil if it is not a number.
+func (vm *VM) addNumber(sum, v interface{}) interface{} {
+	switch v.(type) {
+	case nil:
+		return sum
+	case float64, int64, *big.Int, *big.Float:
+	default:
+		vm.mismatchFuncArg("sum", 1, "numbers", v)
+		return nil
+	}
+	if r, ok := bigArith('+', sum, v); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(sum, v); ok {
+		return vm.checkedInt('+', i0, i1)
+	}
+	return toFloat64(sum) + toFloat64(v)
+}
+
+// sortedMapKeys returns the keys of the map sorted by their values, the numbers before the strings.
+func sortedMapKeys(vm *VM, m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	vals := make([]interface{}, len(keys))
+	for i, k := range keys {
+		vals[i] = vm.elemInterface(k)
+	}
+	sort.Sort(mapKeys{keys: keys, vals: vals})
+	return keys
+}
+
+// mapKeys sorts the map keys by their expression values
+type mapKeys struct {
+	keys []reflect.Value
+	vals []interface{}
+}
+
+func (m mapKeys) Len() int { return len(m.keys) }
+
+func (m mapKeys) Swap(i, j int) {
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+	m.vals[i], m.vals[j] = m.vals[j], m.vals[i]
+}
+
+func (m mapKeys) Less(i, j int) bool {
+	a, b := m.vals[i], m.vals[j]
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+		return true
+	}
+	if _, ok := b.(float64); ok {
+		return false
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// takeFnExprNode take((X)$, n) the first n elements, or takeLast((X)$, n) the last n elements
+// of struct field X(type: slice, array) when last, all the elements if there are fewer than n
+type takeFnExprNode struct {
+	exprBackground
+	last bool
+	n    ExprNode
+}
+
+func (p *Expr) readTakeFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	name := "take"
+	args, ok := p.readFnArgs(expr, name)
+	if !ok {
+		name = "takeLast"
+		if args, ok = p.readFnArgs(expr, name); !ok {
+			return nil
+		}
+	}
+	if len(args) != 2 {
+		*expr = lastStr
+		return nil
+	}
+	e := &takeFnExprNode{last: name == "takeLast", n: args[1]}
+	e.SetRightOperand(args[0])
+	return e
+}
+
+// Run returns the sub-slice, or the slice of the copied elements for the array,
+// return nil if the operand is not a slice or an array.
+func (te *takeFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vm := tagExpr.getVM()
+	name := "take"
+	if te.last {
+		name = "takeLast"
+	}
+	nv := te.n.Run(currField, tagExpr)
+	n, ok := vm.toIndex(nv)
+	if !ok {
+		vm.mismatchFuncArg(name, 2, "number", nv)
+		return nil
+	}
+	v := te.rightOperand.Run(currField, tagExpr)
+	switch v.(type) {
+	case nil, float64, int64, string, bool:
+		return nil
+	}
+	vv := derefValue(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.Slice:
+	case reflect.Array:
+		s := reflect.MakeSlice(reflect.SliceOf(vv.Type().Elem()), vv.Len(), vv.Len())
+		reflect.Copy(s, vv)
+		vv = s
+	default:
+		return nil
+	}
+	l := vv.Len()
+	if n < 0 {
+		n = 0
+	} else if n > l {
+		n = l
+	}
+	if te.last {
+		return vv.Slice(l-n, l).Interface()
+	}
+	return vv.Slice(0, n).Interface()
+}
+
+// randFnExprNode rand() in [0, 1), or randInt(n) in [0, n) when isInt,
+// from the source set by vm.SetRandSource
+type randFnExprNode struct {
+	exprBackground
+	isInt bool
+}
+
+func (p *Expr) readRandFnExprNode(expr *string) ExprNode {
+	lastStr := *expr
+	if args, ok := p.readFnArgs(expr, "rand"); ok {
+		if len(args) != 0 {
+			*expr = lastStr
+			return nil
+		}
+		p.volatile = true
+		return &randFnExprNode{}
+	}
+	operand, ok := p.readFnArgs(expr, "randInt")
+	if !ok {
+		return nil
+	}
+	if len(operand) != 1 {
+		*expr = lastStr
+		return nil
+	}
+	p.volatile = true
+	e := &randFnExprNode{isInt: true}
+	e.SetRightOperand(operand[0])
+	return e
+}
+
+func (re *randFnExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vm := tagExpr.getVM()
+	if !re.isInt {
+		return vm.randFloat64()
+	}
+	v := re.rightOperand.Run(currField, tagExpr)
+	n, ok := vm.toIndex(v)
+	if !ok {
+		vm.mismatchFuncArg("randInt", 1, "number", v)
+		return nil
+	}
+	if n <= 0 {
+		return nil
+	}
+	r := vm.randIntn(n)
+	if vm.integerMode {
+		return int64(r)
+	}
+	return float64(r)
+}
+
+// builtinFuncNames the names of the built-in functions and the reserved words,
+// that can not be registered by RegisterFunc
+var builtinFuncNames = map[string]bool{
+	"len": true, "regexp": true, "regexpReplace": true, "sprintf": true, "number": true,
+	"at": true, "coalesceAll": true, "luhn": true, "oneof": true, "jsonGet": true,
+	"index": true, "count": true, "lookup": true, "label": true, "ipInCIDR": true,
+	"mutuallyExclusive": true, "exactlyOne": true, "findFirst": true, "rand": true, "randInt": true,
+	"take": true, "takeLast": true, "selfTag": true, "onlyChars": true, "editDistance": true,
+	"parentIndex": true, "uniqueBy": true, "isStep": true, "any": true, "all": true, "filter": true,
+	"sum": true, "true": true, "false": true, "nil": true, "in": true, "not": true,
+}
+
+func init() {
+	for name := range stringCheckFuncs {
+		builtinFuncNames[name] = true
+	}
+}
+
+var (
+	userFuncs   = make(map[string]func(args ...interface{}) interface{})
+	userFuncsRW sync.RWMutex
+	identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// RegisterFunc registers the function that can be called by name in the expressions,
+// such as RegisterFunc("between", fn) for between($, 1, 10).
+// NOTE:
+//  The name must be an identifier other than the built-in functions,
+//  the functions should be registered before the expressions using them are parsed,
+//  the arguments are the values of the argument expressions, such as float64, string, bool or nil,
+//  and the integral numbers of the result are converted to float64, or int64 in the integer mode;
+//  The results of the expressions calling them are not cached by vm.SetResultCache
+func RegisterFunc(name string, fn func(args ...interface{}) interface{}) error {
+	if !identRegexp.MatchString(name) {
+		return fmt.Errorf("invalid function name: %q", name)
+	}
+	if builtinFuncNames[name] {
+		return fmt.Errorf("reserved function name: %q", name)
+	}
+	if fn == nil {
+		return fmt.Errorf("nil function: %q", name)
+	}
+	userFuncsRW.Lock()
+	userFuncs[name] = fn
+	userFuncsRW.Unlock()
+	return nil
+}
+
+func lookupFunc(name string) (func(args ...interface{}) interface{}, bool) {
+	userFuncsRW.RLock()
+	fn, ok := userFuncs[name]
+	userFuncsRW.RUnlock()
+	return fn, ok
+}
+
+// funcExprNode the call of the function registered by RegisterFunc
+type funcExprNode struct {
+	exprBackground
+	fn   func(args ...interface{}) interface{}
+	args []ExprNode
+}
+
+func (p *Expr) readFuncExprNode(expr *string) ExprNode {
+	name := strings.TrimSuffix(fnNameRegexp.FindString(*expr), "(")
+	fn, ok := lookupFunc(name)
+	if !ok {
+		return nil
+	}
+	args, ok := p.readFnArgs(expr, name)
+	if !ok {
+		return nil
+	}
+	// the registered functions may be impure, such as reading a clock or a config
+	p.volatile = true
+	return &funcExprNode{fn: fn, args: args}
+}
+
+func (fe *funcExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	args := make([]interface{}, len(fe.args))
+	for i, arg := range fe.args {
+		args[i] = arg.Run(currField, tagExpr)
+	}
+	return tagExpr.getVM().elemInterface(reflect.ValueOf(fe.fn(args...)))
+}
+
+// undefinedFunc returns the error if the expression starts with
+// the call of the function that is neither built-in nor registered.
+func undefinedFunc(expr string) error {
+	name := strings.TrimSuffix(fnNameRegexp.FindString(expr), "(")
+	if name == "" || builtinFuncNames[name] {
+		return nil
+	}
+	if _, ok := lookupFunc(name); ok {
+		return nil
+	}
+	return fmt.Errorf("undefined function %q", name)
+}
@@ -15,6 +15,9 @@
 package tagexpr
 
 import (
+	"fmt"
+	"math/big"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -64,12 +67,53 @@ func (ge *groupExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	return nil
 }
 
+// tupleExprNode parenthesized comma-separated list, such as ((A)$, (B)$)
+type tupleExprNode struct {
+	exprBackground
+	args []ExprNode
+}
+
+// readTupleExprNode reads the rest elements of the tuple whose first element is @first.
+func (p *Expr) readTupleExprNode(first ExprNode, subExprNode *string) (ExprNode, error) {
+	if first.(*groupExprNode).boolPrefix != nil {
+		return nil, fmt.Errorf("parsing pos: %q", *subExprNode)
+	}
+	sortPriority(first.RightOperand())
+	e := &tupleExprNode{args: []ExprNode{first}}
+	for *subExprNode != "" {
+		if (*subExprNode)[0] != ',' {
+			return nil, fmt.Errorf("parsing pos: %q", *subExprNode)
+		}
+		*subExprNode = (*subExprNode)[1:]
+		operand := newGroupExprNode()
+		_, err := p.parseExprNode(subExprNode, operand)
+		if err != nil {
+			return nil, err
+		}
+		if operand.RightOperand() == nil {
+			return nil, fmt.Errorf("parsing pos: empty tuple element")
+		}
+		sortPriority(operand.RightOperand())
+		e.args = append(e.args, operand)
+		trimLeftSpace(subExprNode)
+	}
+	return e, nil
+}
+
+func (te *tupleExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	vals := make([]interface{}, len(te.args))
+	for i, e := range te.args {
+		vals[i] = e.Run(currField, tagExpr)
+	}
+	return vals
+}
+
 type boolExprNode struct {
 	exprBackground
 	val bool
 }
 
-var boolRegexp = regexp.MustCompile(`^!*(true|false)([\|&!= \t]{1}|$)`)
+var boolRegexp = regexp.MustCompile(`^!*(true|false)([\|&!=,\) \t]{1}|$)`)
 
 func readBoolExprNode(expr *string) ExprNode {
 	s := boolRegexp.FindString(*expr)
@@ -100,6 +144,102 @@ func readBoolExprNode(expr *string) ExprNode {
 
 func (be *boolExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return be.val }
 
+// elemExprNode the element # or #v in the predicates of the functions such as findFirst,
+// or its field such as #v.A.B if the element is a struct, or the key #k of the element
+type elemExprNode struct {
+	exprBackground
+	key    bool
+	fields []string
+}
+
+var (
+	elemBindingRegexp = regexp.MustCompile(`^#[kv]\b`)
+	elemFieldRegexp   = regexp.MustCompile(`^\s*\.([a-zA-Z_]\w*)`)
+)
+
+func readElemExprNode(expr *string) ExprNode {
+	if !strings.HasPrefix(*expr, "#") {
+		return nil
+	}
+	e := &elemExprNode{}
+	if b := elemBindingRegexp.FindString(*expr); b != "" {
+		e.key = b == "#k"
+		*expr = (*expr)[len(b):]
+	} else {
+		*expr = (*expr)[1:]
+	}
+	for {
+		m := elemFieldRegexp.FindStringSubmatch(*expr)
+		if m == nil {
+			return e
+		}
+		*expr = (*expr)[len(m[0]):]
+		e.fields = append(e.fields, m[1])
+	}
+}
+
+func (ee *elemExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil || len(tagExpr.elems) == 0 {
+		failEval("# is only available to the predicates of the functions such as findFirst")
+	}
+	binding := tagExpr.elems[len(tagExpr.elems)-1]
+	elem := binding.val
+	if ee.key {
+		elem = binding.key
+	}
+	for _, name := range ee.fields {
+		v := derefValue(reflect.ValueOf(elem))
+		if !v.IsValid() {
+			return nil
+		}
+		if v.Kind() != reflect.Struct {
+			failEval("#.%s: the element is not a struct: %s", name, v.Type().String())
+		}
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			failEval("#.%s: no such field of %s", name, v.Type().String())
+		}
+		elem = tagExpr.getVM().elemInterface(f)
+	}
+	return elem
+}
+
+// currFieldNameExprNode $name, the selector of the current struct field, such as A.B
+type currFieldNameExprNode struct{ exprBackground }
+
+var currFieldNameRegexp = regexp.MustCompile(`^\$name\b`)
+
+func readCurrFieldNameExprNode(expr *string) ExprNode {
+	s := currFieldNameRegexp.FindString(*expr)
+	if s == "" {
+		return nil
+	}
+	*expr = (*expr)[len(s):]
+	return &currFieldNameExprNode{}
+}
+
+// Run returns the current field selector, return nil without struct.
+func (fe *currFieldNameExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr == nil {
+		return nil
+	}
+	return currField
+}
+
+type nilExprNode struct{ exprBackground }
+
+var nilRegexp = regexp.MustCompile(`^nil([\|&!=,\) \t]{1}|$)`)
+
+func readNilExprNode(expr *string) ExprNode {
+	if nilRegexp.FindString(*expr) == "" {
+		return nil
+	}
+	*expr = (*expr)[3:]
+	return &nilExprNode{}
+}
+
+func (ne *nilExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return nil }
+
 type stringExprNode struct {
 	exprBackground
 	val string
@@ -119,9 +259,15 @@ func (se *stringExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 type digitalExprNode struct {
 	exprBackground
 	val float64
+	// ival the exact value of the integral literal for the integer mode
+	ival       int64
+	fractional bool
+	// bigVal the exact value of the integral literal that float64 can not represent,
+	// used by the comparisons and the big arithmetic only, see exactLiteral
+	bigVal *big.Int
 }
 
-var digitalRegexp = regexp.MustCompile(`^[\+\-]?\d+(\.\d+)?([\+\-\*\/%><\|&!=\^ \t\\]|$)`)
+var digitalRegexp = regexp.MustCompile(`^[\+\-]?\d+(\.\d+)?([\+\-\*\/%><\|&!=\^,\) \t\\]|$)`)
 
 func readDigitalExprNode(expr *string) ExprNode {
 	s := digitalRegexp.FindString(*expr)
@@ -135,10 +281,27 @@ func readDigitalExprNode(expr *string) ExprNode {
 	*expr = (*expr)[len(s):]
 	e := &digitalExprNode{}
 	e.val, _ = strconv.ParseFloat(s, 64)
+	var err error
+	e.ival, err = strconv.ParseInt(s, 10, 64)
+	e.fractional = strings.Contains(s, ".")
+	if !e.fractional && (err != nil || e.ival > 1<<53 || e.ival < -1<<53) {
+		e.bigVal, _ = new(big.Int).SetString(s, 10)
+	}
 	return e
 }
 
-func (de *digitalExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return de.val }
+func (de *digitalExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr.getVM().integerMode {
+		if de.fractional {
+			failEval("fractional number %v in integer mode", de.val)
+		}
+		if de.bigVal != nil && !de.bigVal.IsInt64() {
+			return new(big.Int).Set(de.bigVal)
+		}
+		return de.ival
+	}
+	return de.val
+}
 
 func trimLeftSpace(p *string) *string {
 	*p = strings.TrimLeftFunc(*p, unicode.IsSpace)
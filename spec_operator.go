@@ -14,7 +14,13 @@
 
 package tagexpr
 
-import "math"
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
 
 // --------------------------- Operator ---------------------------
 
@@ -26,6 +32,14 @@ func (ae *additionExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	// positive number or Addition
 	v0 := ae.leftOperand.Run(currField, tagExpr)
 	v1 := ae.rightOperand.Run(currField, tagExpr)
+	checkFuncOperands("+", v0, v1)
+	v0, v1 = exactLiterals(ae.leftOperand, ae.rightOperand, v0, v1)
+	if r, ok := bigArith('+', v0, v1); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return tagExpr.getVM().checkedInt('+', i0, i1)
+	}
 	switch r := v0.(type) {
 	case float64:
 		var v float64
@@ -33,10 +47,18 @@ func (ae *additionExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 		r += v
 		return r
 	case string:
-		var v string
-		v, _ = v1.(string)
-		r += v
+		switch v := v1.(type) {
+		case string:
+			r += v
+		case bool:
+			r += tagExpr.getVM().formatBool(v)
+		}
 		return r
+	case bool:
+		if v, ok := v1.(string); ok {
+			return tagExpr.getVM().formatBool(r) + v
+		}
+		return v1
 	default:
 		return v1
 	}
@@ -47,8 +69,18 @@ type multiplicationExprNode struct{ exprBackground }
 func newMultiplicationExprNode() ExprNode { return &multiplicationExprNode{} }
 
 func (ae *multiplicationExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
-	v0, _ := ae.leftOperand.Run(currField, tagExpr).(float64)
-	v1, _ := ae.rightOperand.Run(currField, tagExpr).(float64)
+	r0 := ae.leftOperand.Run(currField, tagExpr)
+	r1 := ae.rightOperand.Run(currField, tagExpr)
+	checkFuncOperands("*", r0, r1)
+	r0, r1 = exactLiterals(ae.leftOperand, ae.rightOperand, r0, r1)
+	if r, ok := bigArith('*', r0, r1); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(r0, r1); ok {
+		return tagExpr.getVM().checkedInt('*', i0, i1)
+	}
+	v0, _ := r0.(float64)
+	v1, _ := r1.(float64)
 	return v0 * v1
 }
 
@@ -57,11 +89,24 @@ type divisionExprNode struct{ exprBackground }
 func newDivisionExprNode() ExprNode { return &divisionExprNode{} }
 
 func (de *divisionExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
-	v1, _ := de.rightOperand.Run(currField, tagExpr).(float64)
+	r1 := de.rightOperand.Run(currField, tagExpr)
+	r0 := de.leftOperand.Run(currField, tagExpr)
+	checkFuncOperands("/", r0, r1)
+	r0, r1 = exactLiterals(de.leftOperand, de.rightOperand, r0, r1)
+	if r, ok := bigArith('/', r0, r1); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(r0, r1); ok {
+		if i1 == 0 {
+			failEval("integer division by zero")
+		}
+		return tagExpr.getVM().checkedInt('/', i0, i1)
+	}
+	v1, _ := r1.(float64)
 	if v1 == 0 {
 		return math.NaN()
 	}
-	v0, _ := de.leftOperand.Run(currField, tagExpr).(float64)
+	v0, _ := r0.(float64)
 	return v0 / v1
 }
 
@@ -70,8 +115,18 @@ type subtractionExprNode struct{ exprBackground }
 func newSubtractionExprNode() ExprNode { return &subtractionExprNode{} }
 
 func (de *subtractionExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
-	v0, _ := de.leftOperand.Run(currField, tagExpr).(float64)
-	v1, _ := de.rightOperand.Run(currField, tagExpr).(float64)
+	r0 := de.leftOperand.Run(currField, tagExpr)
+	r1 := de.rightOperand.Run(currField, tagExpr)
+	checkFuncOperands("-", r0, r1)
+	r0, r1 = exactLiterals(de.leftOperand, de.rightOperand, r0, r1)
+	if r, ok := bigArith('-', r0, r1); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(r0, r1); ok {
+		return tagExpr.getVM().checkedInt('-', i0, i1)
+	}
+	v0, _ := r0.(float64)
+	v1, _ := r1.(float64)
 	return v0 - v1
 }
 
@@ -80,12 +135,27 @@ type remainderExprNode struct{ exprBackground }
 func newRemainderExprNode() ExprNode { return &remainderExprNode{} }
 
 func (re *remainderExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
-	v1, _ := re.rightOperand.Run(currField, tagExpr).(float64)
-	if v1 == 0 {
+	r1 := re.rightOperand.Run(currField, tagExpr)
+	r0 := re.leftOperand.Run(currField, tagExpr)
+	checkFuncOperands("%", r0, r1)
+	r0, r1 = exactLiterals(re.leftOperand, re.rightOperand, r0, r1)
+	if r, ok := bigArith('%', r0, r1); ok {
+		return r
+	}
+	if i0, i1, ok := intOperands(r0, r1); ok {
+		if i1 == 0 {
+			failEval("integer division by zero")
+		}
+		return i0 % i1
+	}
+	v1, _ := r1.(float64)
+	vm := tagExpr.getVM()
+	i1 := vm.toInt(v1)
+	if i1 == 0 {
 		return math.NaN()
 	}
-	v0, _ := re.leftOperand.Run(currField, tagExpr).(float64)
-	return float64(int64(v0) % int64(v1))
+	v0, _ := r0.(float64)
+	return float64(vm.toInt(v0) % i1)
 }
 
 type equalExprNode struct{ exprBackground }
@@ -95,7 +165,27 @@ func newEqualExprNode() ExprNode { return &equalExprNode{} }
 func (ee *equalExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	v0 := ee.leftOperand.Run(currField, tagExpr)
 	v1 := ee.rightOperand.Run(currField, tagExpr)
+	v0 = tagExpr.enumOperand(currField, ee.rightOperand, v0)
+	v1 = tagExpr.enumOperand(currField, ee.leftOperand, v1)
+	v0 = tagExpr.exactOperand(currField, ee.leftOperand, v0)
+	v1 = tagExpr.exactOperand(currField, ee.rightOperand, v1)
+	tagExpr.getVM().checkNaN(v0, v1)
+	if d0, d1, ok := tagExpr.getVM().durationOperands(v0, v1); ok {
+		return d0 == d1
+	}
+	return isEqual(v0, v1)
+}
+
+func isEqual(v0, v1 interface{}) bool {
+	if c, ok := compareBig(v0, v1); ok {
+		return c == 0
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return isNumber(v1) && i0 == i1
+	}
 	switch r := v0.(type) {
+	case nil:
+		return isNil(v1)
 	case float64:
 		var r1 float64
 		r1, _ = v1.(float64)
@@ -108,8 +198,42 @@ func (ee *equalExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 		var r1 bool
 		r1, _ = v1.(bool)
 		return r == r1
+	case []interface{}:
+		// tuple, compared element-wise
+		r1, _ := v1.([]interface{})
+		if len(r) != len(r1) {
+			return false
+		}
+		for i := range r {
+			if !isEqual(r[i], r1[i]) {
+				return false
+			}
+		}
+		return true
 	default:
-		return false
+		return v1 == nil && isNil(v0)
+	}
+}
+
+// isNil reports whether the value is nil or the nil map, slice, pointer, chan or func.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch vv := reflect.ValueOf(v); vv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Chan, reflect.Func:
+		return vv.IsNil()
+	}
+	return false
+}
+
+// checkFuncOperands aborts the evaluation if any operand is a func value,
+// which only supports the comparisons with nil.
+func checkFuncOperands(op string, v0, v1 interface{}) {
+	for _, v := range [2]interface{}{v0, v1} {
+		if v != nil && reflect.TypeOf(v).Kind() == reflect.Func {
+			failEval("operator %s does not support the func value", op)
+		}
 	}
 }
 
@@ -121,6 +245,157 @@ func (ne *notEqualExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	return !ne.equalExprNode.Run(currField, tagExpr).(bool)
 }
 
+// inExprNode membership operator, such as $ in (1, 2, 3) or $ not in (S)$
+type inExprNode struct {
+	exprBackground
+	negate bool
+	// set, intSet the precomputed members of the literal set in the float64 and integer modes
+	set, intSet map[interface{}]struct{}
+}
+
+func newInExprNode(negate bool) ExprNode { return &inExprNode{negate: negate} }
+
+func (ie *inExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	return ie.in(currField, tagExpr) != ie.negate
+}
+
+func (ie *inExprNode) in(currField string, tagExpr *TagExpr) bool {
+	v0 := ie.leftOperand.Run(currField, tagExpr)
+	if ie.set != nil {
+		k, ok := setKey(v0)
+		if !ok {
+			return false
+		}
+		set := ie.set
+		if tagExpr.getVM().integerMode {
+			set = ie.intSet
+		}
+		_, ok = set[k]
+		return ok
+	}
+	if set := tagExpr.memberSet(ie); set != nil {
+		k, ok := setKey(v0)
+		if !ok {
+			return false
+		}
+		_, ok = set[k]
+		return ok
+	}
+	v1 := ie.rightOperand.Run(currField, tagExpr)
+	switch r := v1.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, v := range r {
+			if isEqual(v0, v) {
+				return true
+			}
+		}
+		return false
+	case float64, int64, string, bool:
+		return isEqual(v0, r)
+	}
+	vv := derefValue(reflect.ValueOf(v1))
+	switch vv.Kind() {
+	case reflect.Map:
+		if v0 == nil {
+			return false
+		}
+		k := safeConvert(reflect.ValueOf(v0), vv.Type().Key())
+		return k.IsValid() && vv.MapIndex(k).IsValid()
+	case reflect.Slice, reflect.Array:
+		if set := tagExpr.newMemberSet(ie, vv); set != nil {
+			k, ok := setKey(v0)
+			if !ok {
+				return false
+			}
+			_, ok = set[k]
+			return ok
+		}
+		vm := tagExpr.getVM()
+		for i := 0; i < vv.Len(); i++ {
+			if isEqual(v0, vm.elemInterface(vv.Index(i))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareLiteralSet precomputes the members if the right operand is a literal set.
+func (ie *inExprNode) prepareLiteralSet() {
+	var elems []ExprNode
+	switch r := unwrapGroup(ie.rightOperand).(type) {
+	case *tupleExprNode:
+		elems = r.args
+	default:
+		elems = []ExprNode{r}
+	}
+	set := make(map[interface{}]struct{}, len(elems))
+	intSet := make(map[interface{}]struct{}, len(elems))
+	for _, e := range elems {
+		e = unwrapGroup(e)
+		if e == nil || e.LeftOperand() != nil || e.RightOperand() != nil {
+			return
+		}
+		var v, iv interface{}
+		switch r := e.(type) {
+		case *stringExprNode:
+			v, iv = r.val, r.val
+		case *boolExprNode:
+			v, iv = r.val, r.val
+		case *digitalExprNode:
+			v, iv = r.val, r.ival
+		default:
+			return
+		}
+		k, ok := setKey(v)
+		if !ok {
+			return
+		}
+		set[k] = struct{}{}
+		if k, ok = setKey(iv); ok {
+			intSet[k] = struct{}{}
+		}
+	}
+	ie.set, ie.intSet = set, intSet
+}
+
+// isCrossFieldSet reports whether the right operand is another struct field without sub-selectors,
+// whose members can be computed once within the TagExpr.
+func (ie *inExprNode) isCrossFieldSet() bool {
+	se, ok := unwrapGroup(ie.rightOperand).(*selectorExprNode)
+	return ok && se.field != "" && !se.ref && len(se.subExprs) == 0 && se.boolPrefix == nil
+}
+
+func unwrapGroup(e ExprNode) ExprNode {
+	for {
+		grp, ok := e.(*groupExprNode)
+		if !ok || grp.boolPrefix != nil || grp.LeftOperand() != nil {
+			return e
+		}
+		e = grp.RightOperand()
+	}
+}
+
+// setKey returns the key of the value in the member sets,
+// the integral numbers share the same key whether they are float64 or int64.
+func setKey(v interface{}) (interface{}, bool) {
+	switch r := v.(type) {
+	case string, bool, int64:
+		return r, true
+	case float64:
+		if math.IsNaN(r) {
+			return nil, false
+		}
+		if r == math.Trunc(r) && math.Abs(r) < 1<<63 {
+			return int64(r), true
+		}
+		return r, true
+	}
+	return nil, false
+}
+
 type greaterExprNode struct{ exprBackground }
 
 func newGreaterExprNode() ExprNode { return &greaterExprNode{} }
@@ -128,6 +403,19 @@ func newGreaterExprNode() ExprNode { return &greaterExprNode{} }
 func (ge *greaterExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	v0 := ge.leftOperand.Run(currField, tagExpr)
 	v1 := ge.rightOperand.Run(currField, tagExpr)
+	v0 = tagExpr.exactOperand(currField, ge.leftOperand, v0)
+	v1 = tagExpr.exactOperand(currField, ge.rightOperand, v1)
+	checkFuncOperands(">", v0, v1)
+	tagExpr.getVM().checkNaN(v0, v1)
+	if c, ok := compareBig(v0, v1); ok {
+		return c > 0
+	}
+	if d0, d1, ok := tagExpr.getVM().durationOperands(v0, v1); ok {
+		return d0 > d1
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return i0 > i1
+	}
 	switch r := v0.(type) {
 	case float64:
 		var r1 float64
@@ -136,7 +424,7 @@ func (ge *greaterExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	case string:
 		var r1 string
 		r1, _ = v1.(string)
-		return r > r1
+		return tagExpr.getVM().compareStrings(r, r1) > 0
 	default:
 		return false
 	}
@@ -149,6 +437,19 @@ func newGreaterEqualExprNode() ExprNode { return &greaterEqualExprNode{} }
 func (ge *greaterEqualExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	v0 := ge.leftOperand.Run(currField, tagExpr)
 	v1 := ge.rightOperand.Run(currField, tagExpr)
+	v0 = tagExpr.exactOperand(currField, ge.leftOperand, v0)
+	v1 = tagExpr.exactOperand(currField, ge.rightOperand, v1)
+	checkFuncOperands(">=", v0, v1)
+	tagExpr.getVM().checkNaN(v0, v1)
+	if c, ok := compareBig(v0, v1); ok {
+		return c >= 0
+	}
+	if d0, d1, ok := tagExpr.getVM().durationOperands(v0, v1); ok {
+		return d0 >= d1
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return i0 >= i1
+	}
 	switch r := v0.(type) {
 	case float64:
 		var r1 float64
@@ -157,7 +458,7 @@ func (ge *greaterEqualExprNode) Run(currField string, tagExpr *TagExpr) interfac
 	case string:
 		var r1 string
 		r1, _ = v1.(string)
-		return r >= r1
+		return tagExpr.getVM().compareStrings(r, r1) >= 0
 	default:
 		return false
 	}
@@ -170,6 +471,19 @@ func newLessExprNode() ExprNode { return &lessExprNode{} }
 func (le *lessExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	v0 := le.leftOperand.Run(currField, tagExpr)
 	v1 := le.rightOperand.Run(currField, tagExpr)
+	v0 = tagExpr.exactOperand(currField, le.leftOperand, v0)
+	v1 = tagExpr.exactOperand(currField, le.rightOperand, v1)
+	checkFuncOperands("<", v0, v1)
+	tagExpr.getVM().checkNaN(v0, v1)
+	if c, ok := compareBig(v0, v1); ok {
+		return c < 0
+	}
+	if d0, d1, ok := tagExpr.getVM().durationOperands(v0, v1); ok {
+		return d0 < d1
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return i0 < i1
+	}
 	switch r := v0.(type) {
 	case float64:
 		var r1 float64
@@ -178,7 +492,7 @@ func (le *lessExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	case string:
 		var r1 string
 		r1, _ = v1.(string)
-		return r < r1
+		return tagExpr.getVM().compareStrings(r, r1) < 0
 	default:
 		return false
 	}
@@ -191,6 +505,19 @@ func newLessEqualExprNode() ExprNode { return &lessEqualExprNode{} }
 func (le *lessEqualExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	v0 := le.leftOperand.Run(currField, tagExpr)
 	v1 := le.rightOperand.Run(currField, tagExpr)
+	v0 = tagExpr.exactOperand(currField, le.leftOperand, v0)
+	v1 = tagExpr.exactOperand(currField, le.rightOperand, v1)
+	checkFuncOperands("<=", v0, v1)
+	tagExpr.getVM().checkNaN(v0, v1)
+	if c, ok := compareBig(v0, v1); ok {
+		return c <= 0
+	}
+	if d0, d1, ok := tagExpr.getVM().durationOperands(v0, v1); ok {
+		return d0 <= d1
+	}
+	if i0, i1, ok := intOperands(v0, v1); ok {
+		return i0 <= i1
+	}
 	switch r := v0.(type) {
 	case float64:
 		var r1 float64
@@ -199,10 +526,106 @@ func (le *lessEqualExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	case string:
 		var r1 string
 		r1, _ = v1.(string)
-		return r <= r1
+		return tagExpr.getVM().compareStrings(r, r1) <= 0
+	default:
+		return false
+	}
+}
+
+// numCompareExprNode the comparison between the current field of a plain numeric type and a number literal,
+// such as `$ > 10`, that is specialized at parse time by specializeComparisons.
+// It compares the float64 field value with the literal directly, and runs the generic node otherwise,
+// such as in the integer mode, with the field value hook, for NaN or the integers that float64 may have rounded.
+type numCompareExprNode struct {
+	exprBackground
+	op      byte // '>', 'g' (>=), '<', 'l' (<=)
+	lit     float64
+	generic ExprNode
+}
+
+func (ne *numCompareExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	if tagExpr != nil {
+		vm := tagExpr.s.vm
+		if !vm.integerMode && vm.fieldValueHook == nil && atomic.LoadInt32(&vm.numExtractors) == 0 {
+			if f, ok := tagExpr.s.fields[currField]; ok && f.valueGetter != nil {
+				if v, ok := f.valueGetter(tagExpr.ptr).(float64); ok && math.Abs(v) < maxExactInt {
+					switch ne.op {
+					case '>':
+						return v > ne.lit
+					case 'g':
+						return v >= ne.lit
+					case '<':
+						return v < ne.lit
+					default:
+						return v <= ne.lit
+					}
+				}
+			}
+		}
+	}
+	return ne.generic.Run(currField, tagExpr)
+}
+
+// specializeComparisons replaces the comparisons between the current field and a number literal
+// with numCompareExprNode, if the field is of a plain numeric type, or a pointer to it.
+func specializeComparisons(e ExprNode, fieldType reflect.Type) ExprNode {
+	if e == nil {
+		return nil
+	}
+	if l := e.LeftOperand(); l != nil {
+		if r := specializeComparisons(l, fieldType); r != l {
+			e.SetLeftOperand(r)
+		}
+	}
+	if l := e.RightOperand(); l != nil {
+		if r := specializeComparisons(l, fieldType); r != l {
+			e.SetRightOperand(r)
+		}
+	}
+	var op byte
+	switch e.(type) {
+	case *greaterExprNode:
+		op = '>'
+	case *greaterEqualExprNode:
+		op = 'g'
+	case *lessExprNode:
+		op = '<'
+	case *lessEqualExprNode:
+		op = 'l'
 	default:
+		return e
+	}
+	se, ok := e.LeftOperand().(*selectorExprNode)
+	if !ok || se.field != "" || len(se.subExprs) > 0 || se.boolPrefix != nil {
+		return e
+	}
+	de, ok := e.RightOperand().(*digitalExprNode)
+	if !ok || de.bigVal != nil || !isPlainNumberType(fieldType) {
+		return e
+	}
+	ne := &numCompareExprNode{op: op, lit: de.val, generic: e}
+	ne.SetParent(e.Parent())
+	ne.SetLeftOperand(se)
+	ne.SetRightOperand(de)
+	return ne
+}
+
+// isPlainNumberType reports whether the type, or the type it points to, is a predeclared numeric type,
+// the named types such as time.Duration and the enum types are excluded.
+func isPlainNumberType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.PkgPath() != "" || t.Name() == "" {
 		return false
 	}
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
 }
 
 type andExprNode struct{ exprBackground }
@@ -216,6 +639,10 @@ func (ae *andExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 			if r == 0 {
 				return false
 			}
+		case int64:
+			if r == 0 {
+				return false
+			}
 		case string:
 			if r == "" {
 				return false
@@ -244,6 +671,10 @@ func (oe *orExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 			if r != 0 {
 				return true
 			}
+		case int64:
+			if r != 0 {
+				return true
+			}
 		case string:
 			if r != "" {
 				return true
@@ -256,3 +687,322 @@ func (oe *orExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
 	}
 	return false
 }
+
+// condExprNode the conditional operator `cond ? a : b`, whose right operand
+// is the condBranchesExprNode, only the taken branch is evaluated
+type condExprNode struct{ exprBackground }
+
+// condBranchesExprNode the branches `a : b` of the conditional operator
+type condBranchesExprNode struct{ exprBackground }
+
+func newCondExprNode(cond, a, b ExprNode) ExprNode {
+	branches := &condBranchesExprNode{}
+	branches.SetLeftOperand(a)
+	a.SetParent(branches)
+	branches.SetRightOperand(b)
+	b.SetParent(branches)
+	e := &condExprNode{}
+	e.SetLeftOperand(cond)
+	cond.SetParent(e)
+	e.SetRightOperand(branches)
+	branches.SetParent(e)
+	return e
+}
+
+func (ce *condExprNode) Run(currField string, tagExpr *TagExpr) interface{} {
+	branches := ce.rightOperand
+	if isTruthy(ce.leftOperand.Run(currField, tagExpr)) {
+		return branches.LeftOperand().Run(currField, tagExpr)
+	}
+	return branches.RightOperand().Run(currField, tagExpr)
+}
+
+// Run is not called, the branches are evaluated by condExprNode.
+func (be *condBranchesExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return nil }
+
+// isTruthy converts the value to bool the same way as && and ||.
+func isTruthy(v interface{}) bool {
+	switch r := v.(type) {
+	case float64:
+		return r != 0
+	case int64:
+		return r != 0
+	case string:
+		return r != ""
+	case bool:
+		return r
+	}
+	return false
+}
+
+// intOperands returns the integer operands of the integer mode,
+// when the left operand is a number and any of the operands is int64.
+func intOperands(v0, v1 interface{}) (i0, i1 int64, ok bool) {
+	_, isInt0 := v0.(int64)
+	_, isInt1 := v1.(int64)
+	_, isFloat0 := v0.(float64)
+	if !isInt0 && !(isFloat0 && isInt1) {
+		return 0, 0, false
+	}
+	i0, _ = toInt64(v0)
+	i1, _ = toInt64(v1)
+	return i0, i1, true
+}
+
+// checkedInt calculates the integer arithmetic operation @op of the integer mode,
+// the overflowing result is handled by the policy set by vm.SetIntegerOverflow.
+func (vm *VM) checkedInt(op byte, i0, i1 int64) int64 {
+	var r int64
+	var overflow bool
+	switch op {
+	case '+':
+		r = i0 + i1
+		overflow = i0 > 0 && i1 > 0 && r < 0 || i0 < 0 && i1 < 0 && r >= 0
+	case '-':
+		r = i0 - i1
+		overflow = i0 >= 0 && i1 < 0 && r < 0 || i0 < 0 && i1 > 0 && r >= 0
+	case '*':
+		r = i0 * i1
+		overflow = i0 != 0 && (r/i0 != i1 || i0 == -1 && i1 == math.MinInt64)
+	case '/':
+		r = i0 / i1
+		overflow = i0 == math.MinInt64 && i1 == -1
+	}
+	if !overflow {
+		return r
+	}
+	if vm.intOverflow == OverflowError {
+		failEval("integer overflow: %d %c %d", i0, op, i1)
+	}
+	// saturates to the bound of the sign of the exact result
+	var negative bool
+	switch op {
+	case '+', '-':
+		negative = i0 < 0
+	case '*', '/':
+		negative = (i0 < 0) != (i1 < 0)
+	}
+	if negative {
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
+
+// toInt64 converts the number to int64,
+// the evaluation is aborted if it is fractional.
+func toInt64(v interface{}) (int64, bool) {
+	switch r := v.(type) {
+	case int64:
+		return r, true
+	case float64:
+		if r != math.Trunc(r) {
+			failEval("fractional number %v in integer mode", r)
+		}
+		return int64(r), true
+	}
+	return 0, false
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case float64, int64:
+		return true
+	}
+	return false
+}
+
+// naturalCompare compares the strings in the natural order,
+// the runs of digits are compared by their numeric values.
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		if isDigitByte(a[0]) && isDigitByte(b[0]) {
+			var da, db string
+			da, a = splitDigits(a)
+			db, b = splitDigits(b)
+			na := strings.TrimLeft(da, "0")
+			nb := strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				if len(na) < len(nb) {
+					return -1
+				}
+				return 1
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+		if a[0] != b[0] {
+			if a[0] < b[0] {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[1:], b[1:]
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigitByte(c byte) bool { return c >= '0' && c <= '9' }
+
+func splitDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigitByte(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// exactLiterals replaces the operand of the large integral literal with its exact value
+// if the other operand is *big.Int or *big.Float, so that the big arithmetic stays exact.
+func exactLiterals(e0, e1 ExprNode, v0, v1 interface{}) (interface{}, interface{}) {
+	if isBig(v0) {
+		v1 = exactLiteral(e1, v1)
+	} else if isBig(v1) {
+		v0 = exactLiteral(e0, v0)
+	}
+	return v0, v1
+}
+
+// exactLiteral returns the exact *big.Int value of the integral literal @e
+// that float64 can not represent, if @v is its float64 value.
+func exactLiteral(e ExprNode, v interface{}) interface{} {
+	if de, ok := unwrapGroup(e).(*digitalExprNode); ok && de.bigVal != nil && v == interface{}(de.val) {
+		return new(big.Int).Set(de.bigVal)
+	}
+	return v
+}
+
+// isBig reports whether the value is *big.Int or *big.Float.
+func isBig(v interface{}) bool {
+	switch r := v.(type) {
+	case *big.Int:
+		return r != nil
+	case *big.Float:
+		return r != nil
+	}
+	return false
+}
+
+// toBigFloat converts the number to *big.Float exactly.
+func toBigFloat(v interface{}) (*big.Float, bool) {
+	switch r := v.(type) {
+	case *big.Float:
+		return r, r != nil
+	case *big.Int:
+		if r == nil {
+			return nil, false
+		}
+		return new(big.Float).SetInt(r), true
+	case int64:
+		return new(big.Float).SetInt64(r), true
+	case float64:
+		if math.IsNaN(r) {
+			return nil, false
+		}
+		return new(big.Float).SetFloat64(r), true
+	}
+	return nil, false
+}
+
+// toBigInt converts the integral number to *big.Int.
+func toBigInt(v interface{}) (*big.Int, bool) {
+	switch r := v.(type) {
+	case *big.Int:
+		return r, r != nil
+	case int64:
+		return big.NewInt(r), true
+	case float64, *big.Float:
+		f, ok := toBigFloat(r)
+		if !ok || f.IsInf() || !f.IsInt() {
+			return nil, false
+		}
+		i, _ := f.Int(nil)
+		return i, true
+	}
+	return nil, false
+}
+
+// compareBig compares the numbers exactly if either is *big.Int or *big.Float.
+func compareBig(v0, v1 interface{}) (int, bool) {
+	if !isBig(v0) && !isBig(v1) {
+		return 0, false
+	}
+	f0, ok0 := toBigFloat(v0)
+	f1, ok1 := toBigFloat(v1)
+	if !ok0 || !ok1 {
+		return 0, false
+	}
+	return f0.Cmp(f1), true
+}
+
+// bigArith calculates the arithmetic operation @op if either operand is *big.Int or *big.Float,
+// the result is *big.Int if both operands are integral, except the inexact quotient,
+// otherwise it is *big.Float.
+func bigArith(op byte, v0, v1 interface{}) (interface{}, bool) {
+	if !isBig(v0) && !isBig(v1) {
+		return nil, false
+	}
+	i0, ok0 := toBigInt(v0)
+	i1, ok1 := toBigInt(v1)
+	if op == '%' {
+		if !ok0 || !ok1 {
+			f0, okf0 := toBigFloat(v0)
+			f1, okf1 := toBigFloat(v1)
+			if !okf0 || !okf1 || f0.IsInf() || f1.IsInf() {
+				return nil, false
+			}
+			i0, _ = f0.Int(nil)
+			i1, _ = f1.Int(nil)
+		}
+		if i1.Sign() == 0 {
+			failEval("integer division by zero")
+		}
+		return new(big.Int).Rem(i0, i1), true
+	}
+	if ok0 && ok1 {
+		switch op {
+		case '+':
+			return new(big.Int).Add(i0, i1), true
+		case '-':
+			return new(big.Int).Sub(i0, i1), true
+		case '*':
+			return new(big.Int).Mul(i0, i1), true
+		case '/':
+			if i1.Sign() == 0 {
+				failEval("integer division by zero")
+			}
+			q, m := new(big.Int).QuoRem(i0, i1, new(big.Int))
+			if m.Sign() == 0 {
+				return q, true
+			}
+		}
+	}
+	f0, ok0 := toBigFloat(v0)
+	f1, ok1 := toBigFloat(v1)
+	if !ok0 || !ok1 {
+		return nil, false
+	}
+	prec := f0.Prec()
+	if p := f1.Prec(); p > prec {
+		prec = p
+	}
+	if prec < 64 {
+		prec = 64
+	}
+	r := new(big.Float).SetPrec(prec)
+	switch op {
+	case '+':
+		r.Add(f0, f1)
+	case '-':
+		r.Sub(f0, f1)
+	case '*':
+		r.Mul(f0, f1)
+	case '/':
+		if f1.Sign() == 0 {
+			failEval("division by zero")
+		}
+		r.Quo(f0, f1)
+	}
+	return r, true
+}
@@ -22,8 +22,11 @@ import (
 type selectorExprNode struct {
 	exprBackground
 	field, name string
-	subExprs    []ExprNode
-	boolPrefix  *bool
+	alias       bool
+	// ref whether the field is a named output reference, such as (A@total)$
+	ref        bool
+	subExprs   []ExprNode
+	boolPrefix *bool
 }
 
 func (p *Expr) readSelectorExprNode(expr *string) ExprNode {
@@ -31,13 +34,32 @@ func (p *Expr) readSelectorExprNode(expr *string) ExprNode {
 	if !found {
 		return nil
 	}
+	if field != "" {
+		p.crossField = true
+	}
 	operand := &selectorExprNode{
 		field:      field,
 		name:       name,
 		boolPrefix: boolPrefix,
 	}
+	if strings.HasPrefix(field, "'") {
+		operand.field = field[1 : len(field)-1]
+		operand.alias = true
+	} else if strings.Contains(field, "@") {
+		operand.ref = true
+	}
 	operand.subExprs = make([]ExprNode, 0, len(subSelector))
 	for _, s := range subSelector {
+		// all navigation steps are nil-safe, the optional mark is syntactic.
+		s = strings.TrimPrefix(s, "?")
+		if s[0] == '.' {
+			if strings.HasSuffix(s, "()") {
+				operand.subExprs = append(operand.subExprs, &methodNameExprNode{name: methodName(s[1 : len(s)-2])})
+				continue
+			}
+			operand.subExprs = append(operand.subExprs, &fieldNameExprNode{name: fieldName(s[1:])})
+			continue
+		}
 		grp := newGroupExprNode()
 		_, err := p.parseExprNode(&s, grp)
 		if err != nil {
@@ -49,7 +71,9 @@ func (p *Expr) readSelectorExprNode(expr *string) ExprNode {
 	return operand
 }
 
-var selectorRegexp = regexp.MustCompile(`^(\!*)(\([ \t]*[A-Za-z_]+[A-Za-z0-9_\.]*[ \t]*\))?(\$)([\[\+\-\*\/%><\|&!=\^ \t\\]|$)`)
+var selectorRegexp = regexp.MustCompile(`^(\!*)(\([ \t]*(?:[\pL_]+[\pL\pN_\.]*(?:@[\pL\pN_]*)?|'[^']+')[ \t]*\))?(\$)([\[\?\.\+\-\*\/%><\|&!=\^,\) \t\\]|$)`)
+
+var fieldNameRegexp = regexp.MustCompile(`^[\pL_][\pL\pN_]*`)
 
 func findSelector(expr *string) (field string, name string, subSelector []string, boolPrefix *bool, found bool) {
 	raw := *expr
@@ -64,15 +88,40 @@ func findSelector(expr *string) (field string, name string, subSelector []string
 	name = r[3]
 	*expr = (*expr)[len(a[0][0])-len(r[4]):]
 	for {
-		sub := readPairedSymbol(expr, '[', ']')
+		s := *expr
+		var optional string
+		if strings.HasPrefix(s, "?") {
+			optional = "?"
+			s = s[1:]
+		}
+		if strings.HasPrefix(s, ".") {
+			name := fieldNameRegexp.FindString(s[1:])
+			if name == "" {
+				if optional != "" {
+					break
+				}
+				*expr = raw
+				return "", "", nil, nil, false
+			}
+			*expr = s[1+len(name):]
+			if strings.HasPrefix(*expr, "()") {
+				*expr = (*expr)[2:]
+				name += "()"
+			}
+			subSelector = append(subSelector, optional+"."+name)
+			continue
+		}
+		sub := readPairedSymbol(&s, '[', ']')
 		if sub == nil {
 			break
 		}
-		if *sub == "" || (*sub)[0] == '[' {
+		step := strings.TrimSpace(*sub)
+		if step == "" || step[0] == '[' {
 			*expr = raw
 			return "", "", nil, nil, false
 		}
-		subSelector = append(subSelector, strings.TrimSpace(*sub))
+		*expr = s
+		subSelector = append(subSelector, optional+step)
 	}
 	if boolNum := len(r[1]); boolNum > 0 {
 		bol := true
@@ -96,8 +145,18 @@ func (ve *selectorExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	field := ve.field
 	if field == "" {
 		field = currField
+	} else if ve.alias {
+		field = tagExpr.s.aliases[field]
+	}
+	var v interface{}
+	switch {
+	case ve.ref:
+		v = tagExpr.navigate(tagExpr.evalRef(field), subFields)
+	case ve.field != "":
+		v = tagExpr.getCrossFieldValue(field, subFields)
+	default:
+		v = tagExpr.getValue(field, subFields)
 	}
-	v := tagExpr.getValue(field, subFields)
 	if ve.boolPrefix == nil {
 		return v
 	}
@@ -106,3 +165,24 @@ func (ve *selectorExprNode) Run(currField string, tagExpr *TagExpr) interface{}
 	}
 	return nil
 }
+
+// fieldName the struct field name of a navigation step, such as .Name
+type fieldName string
+
+type fieldNameExprNode struct {
+	exprBackground
+	name fieldName
+}
+
+func (fe *fieldNameExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return fe.name }
+
+// methodName the method name of a navigation step that calls the method without arguments, such as .Name(),
+// the methods promoted from the embedded fields are included
+type methodName string
+
+type methodNameExprNode struct {
+	exprBackground
+	name methodName
+}
+
+func (me *methodNameExprNode) Run(currField string, tagExpr *TagExpr) interface{} { return me.name }
@@ -124,6 +124,18 @@ func TestFindSelector(t *testing.T) {
 		{expr: "$[[[]]]", field: "", name: "", subSelector: nil, last: "$[[[]]]"},
 		{expr: "$[(A)$[1]]", field: "", name: "$", subSelector: []string{"(A)$[1]"}, found: true, last: ""},
 		{expr: "$>0&&$<10", field: "", name: "$", subSelector: nil, found: true, last: ">0&&$<10"},
+		{expr: "$.A", field: "", name: "$", subSelector: []string{".A"}, found: true, last: ""},
+		{expr: "(A)$?[0]?.B.C", field: "A", name: "$", subSelector: []string{"?0", "?.B", ".C"}, found: true, last: ""},
+		{expr: "$[0].B==1", field: "", name: "$", subSelector: []string{"0", ".B"}, found: true, last: "==1"},
+		{expr: "$.0", field: "", name: "", subSelector: nil, last: "$.0"},
+		{expr: "$?1", field: "", name: "$", subSelector: nil, found: true, last: "?1"},
+		{expr: "(名前)$", field: "名前", name: "$", subSelector: nil, found: true, last: ""},
+		{expr: "( '名 前' )$", field: "'名 前'", name: "$", subSelector: nil, found: true, last: ""},
+		{expr: "('')$", field: "", name: "", subSelector: nil, last: "('')$"},
+		{expr: "$.名前", field: "", name: "$", subSelector: []string{".名前"}, found: true, last: ""},
+		{expr: "(A@total)$", field: "A@total", name: "$", subSelector: nil, found: true, last: ""},
+		{expr: "(A.B@)$[0]", field: "A.B@", name: "$", subSelector: []string{"0"}, found: true, last: ""},
+		{expr: "(@total)$", field: "", name: "", subSelector: nil, last: "(@total)$"},
 	}
 	for _, c := range cases {
 		last := c.expr
@@ -16,28 +16,84 @@
 package tagexpr
 
 import (
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
 	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 // VM struct tag expression interpreter
 type VM struct {
-	tagName   string
-	structJar map[string]*Struct
-	rw        sync.RWMutex
+	tagName          string
+	tagKeyFunc       func(reflect.StructField) string
+	structJar        map[string]*Struct
+	structCache      sync.Map // the registered structs by reflect.Type, read without locking in vm.Run
+	rw               sync.RWMutex
+	decimalSeparator string
+	resultCache      bool
+	trueString       string
+	falseString      string
+	numberLocale     *numberLocale
+	aliasTag         string
+	stringFuncMaxLen int
+	integerMode      bool
+	numericStrings   bool
+	nanComparison    NaNComparison
+	exprTransform    func(raw string) string
+	transformed      map[string]string
+	tables           atomic.Value // map[string]reflect.Value, copied on write
+	durationUnit     time.Duration
+	labelTag         string
+	zeroIsNil        bool
+	emptyStringIsNil bool
+	unwrapValuer     bool
+	caseInsensitive  bool
+	maxFuncCalls     int
+	roundingMode     RoundingMode
+	strictFuncArgs   bool
+	unknownField     interface{}
+	batchWorkers     int
+	maxConcurrency   int
+	rand             *rand.Rand
+	randMu           sync.Mutex
+	fieldValueHook   func(path string, v interface{}) interface{}
+	enums            atomic.Value // map[reflect.Type]map[string]int64, copied on write
+	intOverflow      IntegerOverflow
+	exprAliases      map[string]string
+	operatorAliases  map[string]string
+	evalObserver     func(ev EvalEvent)
+	resultConverter  func(selector string, result interface{}) interface{}
+	failureFactory   func(field, selector, raw string) error
+	recursionGuard   RecursionGuard
+	extractors       sync.Map // func(reflect.Value) interface{} by reflect.Type
+	numExtractors    int32
+	planDisabled     bool
 }
 
 // Struct tag expression set of struct
 type Struct struct {
 	vm           *VM
 	name         string
+	typ          reflect.Type
 	fields       map[string]*Field
+	aliases      map[string]string
 	exprs        map[string]*Expr
 	selectorList []string
+	// plans the compiled plans of the expressions by selector, see compilePlans
+	plans        map[string]*plan
+	foldedFields sync.Map // the fields matched case-insensitively, see vm.SetSelectorCaseInsensitive
 }
 
 // Field tag expression set of struct field
@@ -50,11 +106,445 @@ type Field struct {
 // New creates a tag expression interpreter that uses @tagName as the tag name.
 func New(tagName string) *VM {
 	return &VM{
-		tagName:   tagName,
-		structJar: make(map[string]*Struct, 256),
+		tagName:          tagName,
+		structJar:        make(map[string]*Struct, 256),
+		decimalSeparator: ".",
+		trueString:       "true",
+		falseString:      "false",
 	}
 }
 
+// SetTagKeyFunc sets the function that computes the tag name of each struct field,
+// the tag name passed to New is used if it returns "".
+// NOTE:
+//  It should be called before the struct types are warmed up or run.
+func (vm *VM) SetTagKeyFunc(fn func(reflect.StructField) string) *VM {
+	vm.tagKeyFunc = fn
+	return vm
+}
+
+func (vm *VM) tagKey(structField reflect.StructField) string {
+	if vm.tagKeyFunc != nil {
+		if key := vm.tagKeyFunc(structField); key != "" {
+			return key
+		}
+	}
+	return vm.tagName
+}
+
+// defaultVM provides the default options when evaluating without a struct.
+var defaultVM = New("")
+
+// SetDecimalSeparator sets the decimal separator used by the built-in
+// function number to parse string values, the default is '.'.
+// NOTE:
+//  The number literals in expressions are always '.'-based.
+func (vm *VM) SetDecimalSeparator(sep rune) *VM {
+	vm.decimalSeparator = string(sep)
+	return vm
+}
+
+// SetResultCache sets whether to memoize the results of expressions that only
+// reference the current field, keyed by the field value and reused across vm.Run.
+// NOTE:
+//  Only the float64, string, bool and nil field values are cached;
+//  The expressions calling rand, lookup or the functions registered by RegisterFunc are not cached.
+func (vm *VM) SetResultCache(enable bool) *VM {
+	vm.resultCache = enable
+	return vm
+}
+
+// SetBoolStrings sets the strings of bool values used in string contexts,
+// such as string splicing and the %s or %v verb of sprintf, the default is "true" and "false".
+func (vm *VM) SetBoolStrings(trueString, falseString string) *VM {
+	vm.trueString = trueString
+	vm.falseString = falseString
+	return vm
+}
+
+// numberLocale the separators of the localized numbers of sprintf, see vm.SetNumberFormatLocale
+type numberLocale struct {
+	group   string // the thousands separator
+	decimal string
+}
+
+// numberLocales the number separators by the base language of the locale tag
+var numberLocales = map[string]*numberLocale{
+	"en": {group: ",", decimal: "."},
+	"zh": {group: ",", decimal: "."},
+	"ja": {group: ",", decimal: "."},
+	"de": {group: ".", decimal: ","},
+	"es": {group: ".", decimal: ","},
+	"it": {group: ".", decimal: ","},
+	"nl": {group: ".", decimal: ","},
+	"pt": {group: ".", decimal: ","},
+	"fr": {group: "\u202f", decimal: ","},
+	"ru": {group: "\u00a0", decimal: ","},
+}
+
+// SetNumberFormatLocale sets the locale of the numeric arguments of sprintf by the BCP 47 tag,
+// such as "en-US" renders 1234567.5 as 1,234,567.5 and "de-DE" as 1.234.567,5.
+// NOTE:
+//  The locale is matched by the base language, one of en, de, es, fr, it, ja, nl, pt, ru and zh;
+//  "" or an unknown one uses the standard formatting of Go, which is the default.
+//  The %v verb renders the floats without exponent up to 1e21, the verbs other than
+//  %v, %d, %f, %F, %g, %G, %e and %E are formatted as usual.
+func (vm *VM) SetNumberFormatLocale(tag string) *VM {
+	lang := strings.ToLower(tag)
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	vm.numberLocale = numberLocales[lang]
+	return vm
+}
+
+// SetAliasTag sets the tag whose value is used as the field alias,
+// such as "json", then the field can be selected by ('alias')$.
+// NOTE:
+//  It should be called before the struct types are warmed up or run.
+func (vm *VM) SetAliasTag(tagName string) *VM {
+	vm.aliasTag = tagName
+	return vm
+}
+
+// SetLabelTag sets the tag whose value is returned by the built-in function label,
+// such as `label:"User Name"`, the field name is used if it has no label.
+func (vm *VM) SetLabelTag(tagName string) *VM {
+	vm.labelTag = tagName
+	return vm
+}
+
+// SetZeroIsNil sets whether the nil maps, slices, pointers and interfaces reached by
+// the selectors are evaluated as nil, instead of the typed empty values, e.g. len((M)$)
+// is nil rather than 0 if the map field M is nil.
+// NOTE:
+//  The navigation through them always yields nil, without the optional steps such as ?.Y
+func (vm *VM) SetZeroIsNil(enable bool) *VM {
+	vm.zeroIsNil = enable
+	return vm
+}
+
+// SetSelectorCaseInsensitive sets whether the field names of the selectors match case-insensitively,
+// such as (username)$ for the field Username, when there is no field of the exact name.
+// NOTE:
+//  The evaluation is aborted with an error if more than one field matches
+func (vm *VM) SetSelectorCaseInsensitive(enable bool) *VM {
+	vm.caseInsensitive = enable
+	return vm
+}
+
+// SetUnwrapValuer sets whether the fields of the types implementing driver.Valuer are evaluated as
+// the results of their Value methods, such as the database model types, the result is nil if it fails.
+// NOTE:
+//  The Value method of the nil pointer field is not called, the field is nil
+func (vm *VM) SetUnwrapValuer(enable bool) *VM {
+	vm.unwrapValuer = enable
+	return vm
+}
+
+// SetEmptyStringIsNil sets whether the empty strings reached by the selectors are evaluated as nil,
+// e.g. both `$ == nil` and `nil == $` are true if the string field is empty.
+// NOTE:
+//  It applies to the comparisons, the functions and the defaults uniformly,
+//  such as len($) is nil and coalesceAll($, 'x') is 'x'
+func (vm *VM) SetEmptyStringIsNil(enable bool) *VM {
+	vm.emptyStringIsNil = enable
+	return vm
+}
+
+// zeroToNil converts the nil value to untyped nil if vm.SetZeroIsNil is enabled,
+// and the empty string if vm.SetEmptyStringIsNil is enabled.
+func (vm *VM) zeroToNil(v interface{}) interface{} {
+	if vm.emptyStringIsNil && v == "" {
+		return nil
+	}
+	if !vm.zeroIsNil || v == nil {
+		return v
+	}
+	switch vv := reflect.ValueOf(v); vv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface, reflect.Chan, reflect.Func:
+		if vv.IsNil() {
+			return nil
+		}
+	}
+	return v
+}
+
+// SetMaxFuncCalls sets the maximum count of the built-in function calls within
+// the evaluation of an expression, including the expressions referenced by it,
+// the evaluation is aborted with an error if it is exceeded. It is off when n <= 0, which is the default.
+func (vm *VM) SetMaxFuncCalls(n int) *VM {
+	vm.maxFuncCalls = n
+	return vm
+}
+
+// RoundingMode the rounding of the conversions from float64 to integer
+type RoundingMode int
+
+const (
+	// RoundTruncate rounds toward zero
+	RoundTruncate RoundingMode = iota
+	// RoundHalfUp rounds to the nearest integer, rounding half away from zero
+	RoundHalfUp
+	// RoundHalfEven rounds to the nearest integer, rounding half to even
+	RoundHalfEven
+)
+
+// SetRoundingMode sets the rounding of the conversions from float64 to integer,
+// such as the indexes, the operands of % and TagExpr.EvalInt, the default is RoundTruncate.
+func (vm *VM) SetRoundingMode(mode RoundingMode) *VM {
+	vm.roundingMode = mode
+	return vm
+}
+
+func (vm *VM) toInt(f float64) int64 {
+	switch vm.roundingMode {
+	case RoundHalfUp:
+		f = math.Round(f)
+	case RoundHalfEven:
+		f = math.RoundToEven(f)
+	}
+	return int64(f)
+}
+
+// SetStrictFunctionArgs sets whether to abort the evaluation with an error when
+// a built-in function argument is of the mismatched type, such as isDigit(1),
+// the default is false, which evaluates the function call as nil.
+// NOTE:
+//  The nil arguments are not mismatched, such as the nil pointer fields
+func (vm *VM) SetStrictFunctionArgs(enable bool) *VM {
+	vm.strictFuncArgs = enable
+	return vm
+}
+
+// mismatchFuncArg aborts the evaluation if vm.SetStrictFunctionArgs is enabled,
+// @pos is the 1-based position of the argument @v of the function @fnName.
+func (vm *VM) mismatchFuncArg(fnName string, pos int, expected string, v interface{}) {
+	if !vm.strictFuncArgs || v == nil {
+		return
+	}
+	var actual string
+	switch v.(type) {
+	case float64, int64:
+		actual = "number"
+	case string:
+		actual = "string"
+	case bool:
+		actual = "bool"
+	default:
+		actual = fmt.Sprintf("%T", v)
+	}
+	failEval("%s: argument %d expects %s, got %s", fnName, pos, expected, actual)
+}
+
+// SetUnknownFieldValue sets the value of the selectors of the unknown struct fields,
+// such as (Missing)$, the default is nil.
+// NOTE:
+//  The numbers are converted to float64, or int64 in the integer mode
+func (vm *VM) SetUnknownFieldValue(v interface{}) *VM {
+	vm.unknownField = v
+	return vm
+}
+
+// SetRandSource sets the source of rand() and randInt(n),
+// the default is the top-level source of math/rand.
+// NOTE:
+//  The calls of the source are serialized
+func (vm *VM) SetRandSource(src rand.Source) *VM {
+	vm.randMu.Lock()
+	if src == nil {
+		vm.rand = nil
+	} else {
+		vm.rand = rand.New(src)
+	}
+	vm.randMu.Unlock()
+	return vm
+}
+
+func (vm *VM) randFloat64() float64 {
+	vm.randMu.Lock()
+	defer vm.randMu.Unlock()
+	if vm.rand == nil {
+		return rand.Float64()
+	}
+	return vm.rand.Float64()
+}
+
+func (vm *VM) randIntn(n int) int {
+	vm.randMu.Lock()
+	defer vm.randMu.Unlock()
+	if vm.rand == nil {
+		return rand.Intn(n)
+	}
+	return vm.rand.Intn(n)
+}
+
+// SetFieldValueHook sets the hook that transforms each struct field value when it is read,
+// @path is the field selector such as "A.B", e.g. trims the strings before the evaluation.
+// NOTE:
+//  The hook should return the values of the expression types, such as float64, string, bool or nil
+func (vm *VM) SetFieldValueHook(hook func(path string, v interface{}) interface{}) *VM {
+	vm.fieldValueHook = hook
+	return vm
+}
+
+// SetStringFuncMaxLen sets the maximum length of the string inputs of the heavy
+// built-in functions such as regexp, the evaluation is aborted with an error
+// if an input exceeds it. It is off when n <= 0, which is the default.
+func (vm *VM) SetStringFuncMaxLen(n int) *VM {
+	vm.stringFuncMaxLen = n
+	return vm
+}
+
+// SetIntegerMode sets whether to treat all the numbers as int64,
+// so that the arithmetic and comparisons are exact for large integers.
+// In the integer mode, the number values of expressions are int64 instead of float64,
+// the fractional number literals are syntax errors,
+// and the evaluation is aborted with an error on fractional field values.
+// NOTE:
+//  It should be called before the struct types are warmed up or run.
+func (vm *VM) SetIntegerMode(enable bool) *VM {
+	vm.integerMode = enable
+	return vm
+}
+
+func (vm *VM) getNumber(kind reflect.Kind, ptr uintptr) interface{} {
+	if vm.integerMode {
+		return getInt64(kind, ptr)
+	}
+	return getFloat64(kind, ptr)
+}
+
+// SetComparableStringsNumeric sets whether the ordered comparisons of strings
+// compare the runs of digits by their numeric values, such as "1.10" > "1.9"
+// and "file10" > "file9", the default is the lexical order.
+func (vm *VM) SetComparableStringsNumeric(enable bool) *VM {
+	vm.numericStrings = enable
+	return vm
+}
+
+func (vm *VM) compareStrings(a, b string) int {
+	if vm.numericStrings {
+		return naturalCompare(a, b)
+	}
+	return strings.Compare(a, b)
+}
+
+// NaNComparison the policy of the comparisons involving NaN
+type NaNComparison int
+
+const (
+	// NaNIEEE compares NaN as IEEE 754, NaN is neither equal to, less than nor greater than any number
+	NaNIEEE NaNComparison = iota
+	// NaNError aborts the evaluation with an error when comparing NaN
+	NaNError
+)
+
+// SetNaNComparison sets the policy of the comparisons ==, !=, <, <=, > and >= involving NaN,
+// the default is NaNIEEE.
+func (vm *VM) SetNaNComparison(policy NaNComparison) *VM {
+	vm.nanComparison = policy
+	return vm
+}
+
+func (vm *VM) checkNaN(v0, v1 interface{}) {
+	if vm.nanComparison != NaNError {
+		return
+	}
+	for _, v := range [2]interface{}{v0, v1} {
+		if f, ok := v.(float64); ok && math.IsNaN(f) {
+			failEval("comparison involving NaN")
+		}
+	}
+}
+
+// IntegerOverflow the policy of the overflowing integer arithmetic of the integer mode
+type IntegerOverflow int
+
+const (
+	// OverflowSaturate saturates the overflowing result to math.MaxInt64 or math.MinInt64
+	OverflowSaturate IntegerOverflow = iota
+	// OverflowError aborts the evaluation with an error when the result overflows
+	OverflowError
+)
+
+// SetIntegerOverflow sets the policy of the overflowing results of +, -, * and /
+// in the integer mode, the default is OverflowSaturate.
+func (vm *VM) SetIntegerOverflow(policy IntegerOverflow) *VM {
+	vm.intOverflow = policy
+	return vm
+}
+
+// SetDurationUnit sets the unit of the numbers compared with the duration strings,
+// e.g. when the unit is time.Second, `$ <= '1m'` is true if the field value is at most 60.
+// The duration strings are parsed by time.ParseDuration. It is off when unit <= 0, which is the default.
+// NOTE:
+//  It also applies to the time.Duration fields, whose values are nanoseconds.
+func (vm *VM) SetDurationUnit(unit time.Duration) *VM {
+	vm.durationUnit = unit
+	return vm
+}
+
+// durationOperands converts the number and the duration string compared to nanoseconds.
+func (vm *VM) durationOperands(v0, v1 interface{}) (float64, float64, bool) {
+	if vm.durationUnit <= 0 {
+		return 0, 0, false
+	}
+	s0, ok0 := v0.(string)
+	s1, ok1 := v1.(string)
+	if ok0 == ok1 {
+		// the comparison is not between a number and a string
+		return 0, 0, false
+	}
+	if ok0 {
+		d1, d0, ok := vm.durationOperands(v1, s0)
+		return d0, d1, ok
+	}
+	s := s1
+	var n float64
+	switch r := v0.(type) {
+	case float64:
+		n = r
+	case int64:
+		n = float64(r)
+	default:
+		return 0, 0, false
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, 0, false
+	}
+	return n * float64(vm.durationUnit), float64(d), true
+}
+
+func (vm *VM) checkStringFuncLen(fnName, s string) {
+	if vm.stringFuncMaxLen > 0 && len(s) > vm.stringFuncMaxLen {
+		failEval("%s: input length %d exceeds the limit %d", fnName, len(s), vm.stringFuncMaxLen)
+	}
+}
+
+func (vm *VM) formatBool(b bool) string {
+	if b {
+		return vm.trueString
+	}
+	return vm.falseString
+}
+
+func (vm *VM) parseNumber(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if vm.decimalSeparator != "." {
+		if strings.Contains(s, ".") {
+			return nil
+		}
+		s = strings.Replace(s, vm.decimalSeparator, ".", 1)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
 // WarmUp preheating some interpreters of the struct type in batches,
 // to improve the performance of the vm.Run.
 func (vm *VM) WarmUp(structOrStructPtr ...interface{}) error {
@@ -84,31 +574,385 @@ func (vm *VM) Run(structPtr interface{}) (*TagExpr, error) {
 	if v.Kind() != reflect.Ptr {
 		return nil, fmt.Errorf("not structure pointer: %s", v.Type().String())
 	}
+	if v.IsNil() {
+		return nil, fmt.Errorf("cannot run nil pointer: %s, the struct must be allocated, such as new(%s)", v.Type().String(), v.Type().Elem().String())
+	}
 	elem := v.Elem()
 	if elem.Kind() != reflect.Struct {
 		return nil, fmt.Errorf("not structure pointer: %s", v.Type().String())
 	}
 	t := elem.Type()
-	tname := t.String()
-	var err error
-	vm.rw.RLock()
-	s, ok := vm.structJar[tname]
-	vm.rw.RUnlock()
-	if !ok {
-		vm.rw.Lock()
-		s, ok = vm.structJar[tname]
-		if !ok {
-			s, err = vm.registerStructLocked(t)
-			if err != nil {
-				vm.rw.Unlock()
-				return nil, err
+	if s, ok := vm.structCache.Load(t); ok {
+		return s.(*Struct).newTagExpr(v.Pointer()), nil
+	}
+	vm.rw.Lock()
+	s, err := vm.registerStructLocked(t)
+	vm.rw.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// the nested structs are complete once the outermost registration returns
+	vm.structCache.Store(t, s)
+	return s.newTagExpr(v.Pointer()), nil
+}
+
+// SetCompiledPlans sets whether to evaluate the expressions with their compiled plans, the default is true.
+// The plan of an expression is the flat instructions lowered from the expression tree when the struct type
+// is registered, with the fields read at their offsets, so that its evaluation does not allocate.
+// NOTE:
+//  Only the expressions of the literals, the plain numeric, string and bool fields without sub-selectors,
+//  the arithmetic and the comparisons, && and || of them are compiled;
+//  The expression tree is evaluated instead with the integer mode, the field value hook, the extractors,
+//  vm.SetEmptyStringIsNil or NaNError, and for the integers that float64 can not represent exactly.
+func (vm *VM) SetCompiledPlans(enable bool) *VM {
+	vm.planDisabled = !enable
+	return vm
+}
+
+// AllValid reports whether all the bool expressions of the struct value are true,
+// it stops at the first false, the expressions of the other result types are ignored.
+// NOTE:
+//  The error is not nil if the value can not be run or an evaluation is aborted
+func (vm *VM) AllValid(v interface{}) (bool, error) {
+	tagExpr, err := vm.Run(v)
+	if err != nil {
+		return false, err
+	}
+	tagExpr = tagExpr.beginPass()
+	defer tagExpr.endPass()
+	for _, selector := range tagExpr.s.selectorList {
+		switch r := tagExpr.eval(selector).(type) {
+		case bool:
+			if !r {
+				return false, nil
 			}
+		case error:
+			return false, fmt.Errorf("%s: %s", selector, r)
 		}
-		vm.rw.Unlock()
 	}
-	return s.newTagExpr(v.Pointer()), nil
+	return true, nil
+}
+
+// SetBatchWorkers sets the worker count of vm.BatchRun,
+// the default is runtime.GOMAXPROCS(0), which is also used when n <= 0.
+func (vm *VM) SetBatchWorkers(n int) *VM {
+	vm.batchWorkers = n
+	return vm
+}
+
+// EvalEvent the evaluation of an expression, reported to the observer set by vm.SetEvalObserver
+type EvalEvent struct {
+	Field    string // the field selector, such as A.B
+	Selector string // the expression selector, such as A.B@name
+	Duration time.Duration
+	Result   interface{} // nil if the evaluation is aborted
+	Err      error       // the error that aborts the evaluation
+}
+
+// SetEvalObserver sets the callback invoked after each expression evaluation of
+// TagExpr.Eval, TagExpr.Range and the like, such as for the metrics of the counts, latencies and errors.
+// NOTE:
+//  The callback is called synchronously, so it should be fast and safe for concurrent use;
+//  nothing is measured when it is nil, which is the default.
+func (vm *VM) SetEvalObserver(fn func(ev EvalEvent)) *VM {
+	vm.evalObserver = fn
+	return vm
+}
+
+// SetResultConverter sets the function that post-processes each expression result
+// returned by TagExpr.Eval and TagExpr.Range, such as for wrapping it in a framework type.
+// NOTE:
+//  The converter is called with the nil results too, and not with the results used internally,
+//  such as by TagExpr.EvalFloat, vm.AllValid or the default values; nil means no conversion, which is the default.
+func (vm *VM) SetResultConverter(fn func(selector string, result interface{}) interface{}) *VM {
+	vm.resultConverter = fn
+	return vm
+}
+
+// SetFailureFactory sets the function that makes the error of a failed bool expression, see TagExpr.Failure,
+// such as for returning the application-specific error types from the validators.
+// NOTE:
+//  field is the field selector, selector is the failed expression selector,
+//  raw is the raw text of the failed expression.
+func (vm *VM) SetFailureFactory(fn func(field, selector, raw string) error) *VM {
+	vm.failureFactory = fn
+	return vm
+}
+
+// SetMaxConcurrency sets the upper limit of the goroutines that a batch operation such as vm.BatchRun runs,
+// it caps the worker count set by vm.SetBatchWorkers, zero or negative means no limit.
+// NOTE:
+//  vm.Run itself does not block, the registered structs are read without locking,
+//  so the limit is only the guidance for sizing the worker pools.
+func (vm *VM) SetMaxConcurrency(n int) *VM {
+	vm.maxConcurrency = n
+	return vm
+}
+
+// BatchRun prepares the interpreters of the struct values concurrently by a worker pool,
+// the results and the errors are in the order of the values.
+// NOTE:
+//  The values can be of different struct types, see vm.Run
+func (vm *VM) BatchRun(values []interface{}) ([]*TagExpr, []error) {
+	tagExprs := make([]*TagExpr, len(values))
+	errs := make([]error, len(values))
+	workers := vm.batchWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if max := vm.maxConcurrency; max > 0 && workers > max {
+		workers = max
+	}
+	if workers > len(values) {
+		workers = len(values)
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(values) {
+					return
+				}
+				tagExprs[i], errs[i] = vm.Run(values[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return tagExprs, errs
+}
+
+// RunSlice prepares the interpreters of the struct elements of the slice,
+// the built-in functions index() and count() return the element index and the element count,
+// and parentIndex() returns the element index too, or nil outside vm.RunSlice.
+// NOTE:
+//  The elements can be structs or struct pointers,
+//  and an array must be passed by pointer.
+func (vm *VM) RunSlice(slice interface{}) ([]*TagExpr, error) {
+	if slice == nil {
+		return nil, errors.New("cannot run nil interface")
+	}
+	v := reflect.ValueOf(slice)
+	if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Array {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("not slice: %s", v.Type().String())
+	}
+	n := v.Len()
+	tagExprs := make([]*TagExpr, n)
+	for i := 0; i < n; i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr {
+			if !elem.CanAddr() {
+				return nil, fmt.Errorf("not addressable element: %s", elem.Type().String())
+			}
+			elem = elem.Addr()
+		}
+		tagExpr, err := vm.Run(elem.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err)
+		}
+		tagExpr.index, tagExpr.count = i, n
+		tagExprs[i] = tagExpr
+	}
+	return tagExprs, nil
+}
+
+// RecursionGuard the policy of vm.RunRecursive on the struct pointers that are reached again
+type RecursionGuard int
+
+const (
+	// RecursionSkip skips the struct pointers that have been visited
+	RecursionSkip RecursionGuard = iota
+	// RecursionError aborts vm.RunRecursive with an error when a struct pointer refers back
+	// to one of its ancestors, the struct pointers shared without a cycle are still visited once
+	RecursionError
+)
+
+// SetRecursionGuard sets the policy of vm.RunRecursive on the visited struct pointers,
+// such as the cyclic references of the tree nodes, the default is RecursionSkip.
+func (vm *VM) SetRecursionGuard(guard RecursionGuard) *VM {
+	vm.recursionGuard = guard
+	return vm
+}
+
+// RunRecursive prepares the interpreters of the struct and all the structs reachable from it
+// through the struct pointer fields, and the struct or struct pointer elements
+// of the slice, array and map fields, in depth-first order with the root first.
+// NOTE:
+//  The struct pointers are identified by their addresses, and each one is run only once,
+//  see vm.SetRecursionGuard for the cycles; the unexported fields are not walked;
+//  The structs reached as the slice or array elements have their index(), count() and parentIndex().
+func (vm *VM) RunRecursive(structPtr interface{}) ([]*TagExpr, error) {
+	w := recursiveRun{vm: vm, visited: make(map[visitedStruct]bool)}
+	v := reflect.ValueOf(structPtr)
+	if v.Kind() != reflect.Ptr {
+		_, err := vm.Run(structPtr)
+		return nil, err
+	}
+	if err := w.visit("", v, 0, 0); err != nil {
+		return nil, err
+	}
+	return w.tagExprs, nil
+}
+
+// visitedStruct the identity of a struct pointer, the type tells apart a struct and its first field
+type visitedStruct struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// recursiveRun the state of vm.RunRecursive
+type recursiveRun struct {
+	vm       *VM
+	tagExprs []*TagExpr
+	// visited the visited struct pointers, true while walking their fields
+	visited map[visitedStruct]bool
+}
+
+// visit runs the struct pointer v and walks its fields, @path is the field path from the root,
+// @index and @count are the element index and the element count if v is a slice or array element.
+func (w *recursiveRun) visit(path string, v reflect.Value, index, count int) error {
+	if v.IsNil() {
+		if path == "" {
+			_, err := w.vm.Run(v.Interface())
+			return err
+		}
+		return nil
+	}
+	key := visitedStruct{ptr: v.Pointer(), typ: v.Type()}
+	if walking, ok := w.visited[key]; ok {
+		if walking && w.vm.recursionGuard == RecursionError {
+			return fmt.Errorf("cycle detected at %s: %s", path, v.Type().String())
+		}
+		return nil
+	}
+	tagExpr, err := w.vm.Run(v.Interface())
+	if err != nil {
+		if path != "" {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return err
+	}
+	tagExpr.index, tagExpr.count = index, count
+	w.tagExprs = append(w.tagExprs, tagExpr)
+	w.visited[key] = true
+	defer func() { w.visited[key] = false }()
+	return w.walkFields(path, v.Elem())
+}
+
+// walkFields visits the struct pointers reachable from the exported fields of the struct v.
+func (w *recursiveRun) walkFields(path string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		fieldPath := t.Field(i).Name
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		if err := w.walkValue(fieldPath, v.Field(i), 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *recursiveRun) walkValue(path string, v reflect.Value, index, count int) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return w.walkValue(path, v.Elem(), index, count)
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return w.visit(path, v, index, count)
+		}
+	case reflect.Struct:
+		// the fields of the nested struct are run with its host
+		return w.walkFields(path, v)
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Ptr, reflect.Struct, reflect.Interface:
+		default:
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() == reflect.Struct && elem.CanAddr() {
+				elem = elem.Addr()
+			}
+			if err := w.walkValue(path+"["+strconv.Itoa(i)+"]", elem, i, v.Len()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		switch v.Type().Elem().Kind() {
+		case reflect.Ptr, reflect.Interface:
+		default:
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			if err := w.walkValue(path+"["+fmt.Sprint(k)+"]", v.MapIndex(k), 0, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
+// ApplyDefaults fills the zero-valued fields of the @structPtr
+// with the results of their expressions named default.
+// NOTE:
+//  e.g. `tagexpr:"{default:(A)$+1}"`
+func (vm *VM) ApplyDefaults(structPtr interface{}) error {
+	tagExpr, err := vm.Run(structPtr)
+	if err != nil {
+		return err
+	}
+	tagExpr = tagExpr.beginPass()
+	defer tagExpr.endPass()
+	for _, selector := range tagExpr.s.selectorList {
+		fieldSelector := getFieldSelector(selector)
+		if selector != fieldSelector+"@"+defaultExprName {
+			continue
+		}
+		v, err := tagExpr.addressableField(fieldSelector)
+		if err != nil {
+			return err
+		}
+		if !v.IsZero() {
+			continue
+		}
+		typ := v.Type()
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		r := tagExpr.eval(selector)
+		rv := reflect.ValueOf(r)
+		if r == nil || !rv.Type().ConvertibleTo(typ) {
+			return fmt.Errorf("default value of %s: cannot convert %T to %s", fieldSelector, r, typ.String())
+		}
+		if v.Kind() == reflect.Ptr {
+			v.Set(reflect.New(typ))
+			v = v.Elem()
+		}
+		v.Set(rv.Convert(typ))
+		tagExpr.resetValues()
+	}
+	return nil
+}
+
+const defaultExprName = "default"
+
 func (vm *VM) registerStructLocked(structType reflect.Type) (*Struct, error) {
 	structType, err := vm.getStructType(structType)
 	if err != nil {
@@ -120,6 +964,7 @@ func (vm *VM) registerStructLocked(structType reflect.Type) (*Struct, error) {
 		return s, nil
 	}
 	s = vm.newStruct()
+	s.typ = structType
 	vm.structJar[structTypeName] = s
 	var numField = structType.NumField()
 	var structField reflect.StructField
@@ -136,6 +981,27 @@ func (vm *VM) registerStructLocked(structType reflect.Type) (*Struct, error) {
 			t = t.Elem()
 			ptrDeep++
 		}
+		if fn, ok := vm.extractors.Load(t); ok {
+			field.setExtractorGetter(ptrDeep, fn.(func(reflect.Value) interface{}))
+			continue
+		}
+		if t == reflectValueType {
+			field.setDynamicGetter(ptrDeep)
+			continue
+		}
+		if t == bigIntType || t == bigFloatType {
+			field.setAddrGetter(ptrDeep)
+			continue
+		}
+		if isWrapperType(t) {
+			sub, err = vm.registerStructLocked(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			s.copySubFields(field, sub, ptrDeep)
+			field.setWrapperGetter(ptrDeep)
+			continue
+		}
 		switch t.Kind() {
 		default:
 			field.valueGetter = func(ptr uintptr) interface{} { return nil }
@@ -145,6 +1011,11 @@ func (vm *VM) registerStructLocked(structType reflect.Type) (*Struct, error) {
 				return nil, err
 			}
 			s.copySubFields(field, sub, ptrDeep)
+			if reflect.PtrTo(t).Implements(mapperType) {
+				field.setAddrGetter(ptrDeep)
+			} else {
+				field.setInterfaceGetter(ptrDeep)
+			}
 		case reflect.Float32, reflect.Float64,
 			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
@@ -154,9 +1025,17 @@ func (vm *VM) registerStructLocked(structType reflect.Type) (*Struct, error) {
 		case reflect.Bool:
 			field.setBoolGetter(ptrDeep)
 		case reflect.Map, reflect.Array, reflect.Slice:
-			field.setLengthGetter(ptrDeep)
+			field.setInterfaceGetter(ptrDeep)
+		case reflect.Interface:
+			field.setDynamicGetter(ptrDeep)
+		case reflect.Chan, reflect.Func:
+			field.setNillableGetter(ptrDeep)
+		}
+		if reflect.PtrTo(t).Implements(valuerType) {
+			field.wrapValuerGetter(ptrDeep)
 		}
 	}
+	s.compilePlans()
 	return s, nil
 }
 
@@ -164,6 +1043,7 @@ func (vm *VM) newStruct() *Struct {
 	return &Struct{
 		vm:           vm,
 		fields:       make(map[string]*Field, 16),
+		aliases:      make(map[string]string, 16),
 		exprs:        make(map[string]*Expr, 64),
 		selectorList: make([]string, 0, 64),
 	}
@@ -174,30 +1054,52 @@ func (s *Struct) newField(structField reflect.StructField) (*Field, error) {
 		StructField: structField,
 		host:        s,
 	}
-	err := f.parseExprs(structField.Tag.Get(s.vm.tagName))
+	err := f.parseExprs(structField.Tag.Get(s.vm.tagKey(structField)))
 	if err != nil {
 		return nil, err
 	}
 	s.fields[f.Name] = f
+	// the alias in the tag takes precedence over the field name
+	if alias := f.alias(); alias != "" {
+		s.aliases[alias] = f.Name
+	} else if _, ok := s.aliases[f.Name]; !ok {
+		s.aliases[f.Name] = f.Name
+	}
 	return f, nil
 }
 
+// alias returns the alias of the field in the alias tag.
+func (f *Field) alias() string {
+	if tag := f.host.vm.aliasTag; tag != "" {
+		alias := strings.TrimSpace(strings.SplitN(f.Tag.Get(tag), ",", 2)[0])
+		if alias != "-" {
+			return alias
+		}
+	}
+	return ""
+}
+
 func (f *Field) newFrom(ptr uintptr, ptrDeep int) reflect.Value {
 	v := reflect.NewAt(f.Type, unsafe.Pointer(ptr+f.Offset)).Elem()
-	for i := 0; i < ptrDeep; i++ {
+	for i := 0; i < ptrDeep && v.IsValid(); i++ {
 		v = v.Elem()
 	}
 	return v
 }
 
 func (f *Field) setFloatGetter(kind reflect.Kind, ptrDeep int) {
+	vm := f.host.vm
 	if ptrDeep == 0 {
 		f.valueGetter = func(ptr uintptr) interface{} {
-			return getFloat64(kind, ptr+f.Offset)
+			return vm.getNumber(kind, ptr+f.Offset)
 		}
 	} else {
 		f.valueGetter = func(ptr uintptr) interface{} {
-			return getFloat64(kind, f.newFrom(ptr, ptrDeep).UnsafeAddr())
+			v := f.newFrom(ptr, ptrDeep)
+			if !v.IsValid() {
+				return nil
+			}
+			return vm.getNumber(kind, v.UnsafeAddr())
 		}
 	}
 }
@@ -209,7 +1111,11 @@ func (f *Field) setBoolGetter(ptrDeep int) {
 		}
 	} else {
 		f.valueGetter = func(ptr uintptr) interface{} {
-			return f.newFrom(ptr, ptrDeep).Bool()
+			v := f.newFrom(ptr, ptrDeep)
+			if !v.IsValid() {
+				return nil
+			}
+			return v.Bool()
 		}
 	}
 }
@@ -221,14 +1127,128 @@ func (f *Field) setStringGetter(ptrDeep int) {
 		}
 	} else {
 		f.valueGetter = func(ptr uintptr) interface{} {
-			return f.newFrom(ptr, ptrDeep).String()
+			v := f.newFrom(ptr, ptrDeep)
+			if !v.IsValid() {
+				return nil
+			}
+			return v.String()
+		}
+	}
+}
+
+func (f *Field) setInterfaceGetter(ptrDeep int) {
+	f.valueGetter = func(ptr uintptr) interface{} {
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
+		}
+		return v.Interface()
+	}
+}
+
+// setNillableGetter sets the getter of the chan or func field,
+// that returns nil for the nil value.
+func (f *Field) setNillableGetter(ptrDeep int) {
+	f.valueGetter = func(ptr uintptr) interface{} {
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() || v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	}
+}
+
+// setAddrGetter sets the getter that returns the pointer to the field,
+// such as for the Mapper implemented by the pointer receiver.
+func (f *Field) setAddrGetter(ptrDeep int) {
+	f.valueGetter = func(ptr uintptr) interface{} {
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
 		}
+		return v.Addr().Interface()
 	}
 }
 
-func (f *Field) setLengthGetter(ptrDeep int) {
+// setExtractorGetter sets the getter of the field whose type has the extractor registered by vm.RegisterExtractor.
+func (f *Field) setExtractorGetter(ptrDeep int, fn func(reflect.Value) interface{}) {
 	f.valueGetter = func(ptr uintptr) interface{} {
-		return f.newFrom(ptr, ptrDeep).Interface()
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
+		}
+		return f.host.vm.extractedInterface(fn, v)
+	}
+}
+
+// isWrapperType reports whether the struct type is a protobuf well-known wrapper type,
+// such as wrapperspb.StringValue, which has the Value field and the GetValue method of the pointer.
+// NOTE:
+//  The other structs of the same shape match too, so their sub-fields are still registered.
+func isWrapperType(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName("Value")
+	if !ok || len(f.Index) != 1 {
+		return false
+	}
+	switch f.Type.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+	case reflect.Slice:
+		if f.Type.Elem().Kind() != reflect.Uint8 {
+			return false
+		}
+	default:
+		return false
+	}
+	m, ok := reflect.PtrTo(t).MethodByName("GetValue")
+	return ok && m.Type.NumIn() == 1 && m.Type.NumOut() == 1 && m.Type.Out(0) == f.Type
+}
+
+// setWrapperGetter sets the getter of the protobuf wrapper field,
+// that unwraps the Value, the nil wrapper is nil.
+func (f *Field) setWrapperGetter(ptrDeep int) {
+	f.valueGetter = func(ptr uintptr) interface{} {
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
+		}
+		return f.host.vm.elemInterface(v.FieldByName("Value"))
+	}
+}
+
+// wrapValuerGetter wraps the getter of the driver.Valuer field,
+// that returns the result of its Value method if vm.SetUnwrapValuer is enabled, nil if it fails.
+func (f *Field) wrapValuerGetter(ptrDeep int) {
+	getter := f.valueGetter
+	vm := f.host.vm
+	f.valueGetter = func(ptr uintptr) interface{} {
+		if !vm.unwrapValuer {
+			return getter(ptr)
+		}
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
+		}
+		r, err := v.Addr().Interface().(driver.Valuer).Value()
+		if err != nil {
+			return nil
+		}
+		return vm.elemInterface(reflect.ValueOf(r))
+	}
+}
+
+// setDynamicGetter sets the getter of the interface or reflect.Value field,
+// that converts the dynamic value as the expression value.
+func (f *Field) setDynamicGetter(ptrDeep int) {
+	f.valueGetter = func(ptr uintptr) interface{} {
+		v := f.newFrom(ptr, ptrDeep)
+		if !v.IsValid() {
+			return nil
+		}
+		return f.host.vm.elemInterface(v)
 	}
 }
 
@@ -239,10 +1259,11 @@ func (f *Field) parseExprs(tag string) error {
 		return nil
 	}
 	if tag[0] != '{' {
-		expr, err := parseExpr(tag)
+		expr, err := f.host.vm.parseExpr(f.host.vm.transformExpr(tag))
 		if err != nil {
 			return err
 		}
+		expr.specialize(f.Type)
 		selector := f.Name + "@"
 		f.host.exprs[selector] = expr
 		f.host.selectorList = append(f.host.selectorList, selector)
@@ -270,7 +1291,8 @@ func (f *Field) parseExprs(tag string) error {
 				}
 				exprStr = strings.TrimSpace((*subtag)[idx+1:])
 				if exprStr != "" {
-					if expr, err := parseExpr(exprStr); err == nil {
+					if expr, err := f.host.vm.parseExpr(f.host.vm.transformExpr(exprStr)); err == nil {
+						expr.specialize(f.Type)
 						f.host.exprs[selector] = expr
 						f.host.selectorList = append(f.host.selectorList, selector)
 					} else {
@@ -288,6 +1310,293 @@ func (f *Field) parseExprs(tag string) error {
 	}
 }
 
+// SetExprTransform sets the function that rewrites each raw tag expression before parsing,
+// such as expanding the macros or migrating the legacy syntax.
+// NOTE:
+//  It is called once per unique expression;
+//  It should be called before the struct types are warmed up or run.
+func (vm *VM) SetExprTransform(fn func(raw string) string) *VM {
+	vm.exprTransform = fn
+	vm.transformed = nil
+	return vm
+}
+
+// transformExpr should be called with the vm locked.
+func (vm *VM) transformExpr(raw string) string {
+	if vm.exprTransform == nil {
+		return raw
+	}
+	expr, ok := vm.transformed[raw]
+	if !ok {
+		expr = vm.exprTransform(raw)
+		if vm.transformed == nil {
+			vm.transformed = make(map[string]string)
+		}
+		vm.transformed[raw] = expr
+	}
+	return expr
+}
+
+// SetExpressionAliases sets the expression snippets referenced by #name in the expressions,
+// e.g. SetExpressionAliases(map[string]string{"positive": "$ > 0"}) for `#positive && $ < 100`.
+// NOTE:
+//  It should be called before the struct types are warmed up or run;
+//  The aliases are expanded in parentheses, they can reference other aliases,
+//  and the cyclic references are syntax errors; #k and #v are the element bindings, not aliases.
+func (vm *VM) SetExpressionAliases(aliases map[string]string) *VM {
+	vm.exprAliases = make(map[string]string, len(aliases))
+	for k, v := range aliases {
+		vm.exprAliases[k] = v
+	}
+	return vm
+}
+
+var aliasRefRegexp = regexp.MustCompile(`^#[A-Za-z_][A-Za-z0-9_]*`)
+
+// expandAliases expands the #name references of the expression aliases,
+// @stack is the aliases being expanded.
+func (vm *VM) expandAliases(expr string, stack []string) (string, error) {
+	if !strings.Contains(expr, "#") {
+		return expr, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; c {
+		case '\'':
+			j := skipQuoted(expr, i)
+			b.WriteString(expr[i:j])
+			i = j - 1
+		case '#':
+			ref := aliasRefRegexp.FindString(expr[i:])
+			alias, ok := vm.exprAliases[strings.TrimPrefix(ref, "#")]
+			if !ok || elemBindingRegexp.MatchString(expr[i:]) {
+				b.WriteByte(c)
+				continue
+			}
+			name := ref[1:]
+			for _, s := range stack {
+				if s == name {
+					return "", fmt.Errorf("cyclic expression alias: %s -> %s", strings.Join(stack, " -> "), name)
+				}
+			}
+			sub, err := vm.expandAliases(alias, append(stack, name))
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("(" + sub + ")")
+			i += len(ref) - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// SetOperatorAliases sets the words used as the operators, such as
+// map[string]string{"AND": "&&", "OR": "||", "NOT": "!", "gt": ">", "lt": "<"},
+// then `$ gt 0 AND $ lt 10` is parsed as `$ > 0 && $ < 10`.
+// NOTE:
+//  It should be called before the struct types are warmed up or run;
+//  A word is replaced only in the operator position, i.e. after an operand for the binary operators
+//  and before an operand for !, and never in the string literals, field selectors or function names.
+func (vm *VM) SetOperatorAliases(aliases map[string]string) *VM {
+	vm.operatorAliases = make(map[string]string, len(aliases))
+	for k, v := range aliases {
+		vm.operatorAliases[k] = v
+	}
+	return vm
+}
+
+// replaceOperatorAliases replaces the operator words set by vm.SetOperatorAliases.
+func (vm *VM) replaceOperatorAliases(expr string) string {
+	var b strings.Builder
+	afterOperand := false
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == '\'':
+			j := skipQuoted(expr, i)
+			b.WriteString(expr[i:j])
+			i, afterOperand = j, true
+			continue
+		case isWordStart(c):
+			j := wordEnd(expr, i)
+			if op, ok := vm.operatorAlias(expr, i, j, afterOperand); ok {
+				if op == "!" {
+					// the ! prefix is followed by its operand directly
+					b.WriteString(" !")
+					j += len(expr[j:]) - len(strings.TrimLeft(expr[j:], " \t"))
+				} else {
+					b.WriteString(" " + op + " ")
+				}
+				afterOperand = false
+			} else {
+				b.WriteString(expr[i:j])
+				afterOperand = true
+			}
+			i = j
+			continue
+		}
+		b.WriteByte(c)
+		switch {
+		case c == ' ' || c == '\t':
+		case isDigitByte(c), c == '$', c == ')', c == ']', c == '.':
+			afterOperand = true
+		default:
+			afterOperand = false
+		}
+		i++
+	}
+	return b.String()
+}
+
+// operatorAlias returns the operator of the word expr[i:j] if it is an operator alias in the operator position.
+func (vm *VM) operatorAlias(expr string, i, j int, afterOperand bool) (string, bool) {
+	op, ok := vm.operatorAliases[expr[i:j]]
+	if !ok {
+		return "", false
+	}
+	if i > 0 && (expr[i-1] == '.' || expr[i-1] == '#') {
+		return "", false // a sub-selector or an expression alias
+	}
+	rest := expr[j:]
+	if strings.HasPrefix(rest, "(") || strings.HasPrefix(rest, ".") {
+		return "", false // a function name or a field selector
+	}
+	if i > 0 && expr[i-1] == '(' && strings.HasPrefix(strings.TrimLeft(rest, " \t"), ")$") {
+		return "", false // the field selector (AND)$
+	}
+	return op, afterOperand == (op != "!")
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// wordEnd returns the end of the word starting at expr[i].
+func wordEnd(expr string, i int) int {
+	for i < len(expr) && (isWordStart(expr[i]) || isDigitByte(expr[i])) {
+		i++
+	}
+	return i
+}
+
+// RegisterTable registers the lookup table used by the built-in function lookup,
+// e.g. vm.RegisterTable("httpStatusText", map[float64]string{404: "Not Found"}),
+// then lookup('httpStatusText', $) translates the field value.
+// NOTE:
+//  The @table should be a map, and it replaces the registered table of the same name;
+//  it is read without locking, so it must not be changed after the registration.
+func (vm *VM) RegisterTable(name string, table interface{}) error {
+	v := reflect.ValueOf(table)
+	if v.Kind() != reflect.Map {
+		return fmt.Errorf("lookup table %q is not a map: %T", name, table)
+	}
+	vm.rw.Lock()
+	defer vm.rw.Unlock()
+	old, _ := vm.tables.Load().(map[string]reflect.Value)
+	tables := make(map[string]reflect.Value, len(old)+1)
+	for k, t := range old {
+		tables[k] = t
+	}
+	tables[name] = v
+	vm.tables.Store(tables)
+	return nil
+}
+
+// lookupTable returns the table registered by vm.RegisterTable without locking.
+func (vm *VM) lookupTable(name string) (reflect.Value, bool) {
+	tables, _ := vm.tables.Load().(map[string]reflect.Value)
+	v, ok := tables[name]
+	return v, ok
+}
+
+// RegisterExtractor registers the function that reads the value of the type for the expressions,
+// e.g. vm.RegisterExtractor(reflect.TypeOf(Money{}), func(v reflect.Value) interface{} { return v.Interface().(Money).Cents }),
+// then `$ > 100` compares the cents of the Money field.
+// NOTE:
+//  The extractors take precedence over the built-in handling of the type, such as big numbers, wrappers and driver.Valuer,
+//  they should be registered before the struct types using them are run, and they replace the extractor of the same type;
+//  the function receives the dereferenced value, it is not called for the nil pointer, which is nil
+func (vm *VM) RegisterExtractor(t reflect.Type, fn func(reflect.Value) interface{}) error {
+	if t == nil || fn == nil {
+		return errors.New("extractor type and function must not be nil")
+	}
+	if t.Kind() == reflect.Ptr {
+		return fmt.Errorf("extractor type %s is a pointer type, register the element type", t)
+	}
+	vm.rw.Lock()
+	defer vm.rw.Unlock()
+	if _, had := vm.extractors.Load(t); !had {
+		atomic.AddInt32(&vm.numExtractors, 1)
+	}
+	vm.extractors.Store(t, fn)
+	return nil
+}
+
+// RegisterEnumType registers the constant names of the integer enum type,
+// e.g. vm.RegisterEnumType(reflect.TypeOf(Status(0)), map[string]int64{"Active": 1}),
+// then `$ == 'Active'` is true if the Status field value is 1.
+// NOTE:
+//  The names apply to == and != between the field selectors and the strings,
+//  and they replace the registered names of the same type.
+func (vm *VM) RegisterEnumType(t reflect.Type, names map[string]int64) error {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		return fmt.Errorf("enum type %s is not an integer type", t)
+	}
+	m := make(map[string]int64, len(names))
+	for k, v := range names {
+		m[k] = v
+	}
+	vm.rw.Lock()
+	defer vm.rw.Unlock()
+	old, _ := vm.enums.Load().(map[reflect.Type]map[string]int64)
+	enums := make(map[reflect.Type]map[string]int64, len(old)+1)
+	for k, names := range old {
+		enums[k] = names
+	}
+	enums[t] = m
+	vm.enums.Store(enums)
+	return nil
+}
+
+// lookupEnum returns the value of the name registered by vm.RegisterEnumType without locking.
+func (vm *VM) lookupEnum(t reflect.Type, name string) (int64, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	enums, _ := vm.enums.Load().(map[reflect.Type]map[string]int64)
+	n, ok := enums[t][name]
+	return n, ok
+}
+
+// parseExpr parses the expression with the options of the vm.
+func (vm *VM) parseExpr(expr string) (*Expr, error) {
+	raw := expr
+	if len(vm.exprAliases) > 0 {
+		var err error
+		expr, err = vm.expandAliases(expr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%q (syntax incorrect): %s", raw, err.Error())
+		}
+	}
+	if len(vm.operatorAliases) > 0 {
+		expr = vm.replaceOperatorAliases(expr)
+	}
+	p, err := parseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p.raw = raw
+	if vm.integerMode && p.fractional {
+		return nil, fmt.Errorf("%q (syntax incorrect): fractional number literal in integer mode", expr)
+	}
+	return p, nil
+}
+
 func (s *Struct) copySubFields(field *Field, sub *Struct, ptrDeep int) {
 	nameSpace := field.Name
 	for k, v := range sub.fields {
@@ -304,15 +1613,25 @@ func (s *Struct) copySubFields(field *Field, sub *Struct, ptrDeep int) {
 			} else {
 				f.valueGetter = func(ptr uintptr) interface{} {
 					newField := reflect.NewAt(field.Type, unsafe.Pointer(ptr+field.Offset))
-					for i := 0; i < ptrDeep; i++ {
+					for i := 0; i < ptrDeep && !newField.IsNil(); i++ {
 						newField = newField.Elem()
 					}
+					if newField.IsNil() {
+						return nil
+					}
 					return valueGetter(uintptr(newField.Pointer()))
 				}
 			}
 		}
 		s.fields[nameSpace+"."+k] = f
 	}
+	aliasSpace := field.alias()
+	if aliasSpace == "" {
+		aliasSpace = nameSpace
+	}
+	for k, v := range sub.aliases {
+		s.aliases[aliasSpace+"."+k] = nameSpace + "." + v
+	}
 	var selector string
 	for k, v := range sub.exprs {
 		selector = nameSpace + "." + k
@@ -332,33 +1651,164 @@ func (vm *VM) getStructType(t reflect.Type) (reflect.Type, error) {
 	return structType, nil
 }
 
-func (s *Struct) newTagExpr(ptr uintptr) *TagExpr {
-	te := &TagExpr{
-		s:   s,
-		ptr: ptr,
+func (s *Struct) newTagExpr(ptr uintptr) *TagExpr {
+	te := &TagExpr{
+		s:   s,
+		ptr: ptr,
+	}
+	return te
+}
+
+// TagExpr struct tag expression evaluator
+// NOTE:
+//  The evaluations run on a copy of the TagExpr with its own state, see beginPass,
+//  so the same TagExpr can be evaluated concurrently while the struct value is not changed
+type TagExpr struct {
+	s   *Struct
+	ptr uintptr
+	// refs the selectors being evaluated by the named output references
+	refs map[string]bool
+	// values the resolved values of the fields referenced by other fields within the current pass
+	values map[string]interface{}
+	// passes the depth of the passes over the expressions being evaluated, see beginPass,
+	// it is 0 on the TagExpr returned by vm.Run, whose state fields are never set
+	passes int
+	// sets the members of the cross-field sets of the in operators
+	sets map[*inExprNode]map[interface{}]struct{}
+	// funcCalls the count of the built-in function calls of the expression being evaluated
+	funcCalls int
+	// index, count the element index and the element count of vm.RunSlice,
+	// or of the slice or array that vm.RunRecursive reaches the struct through,
+	// count is 0 otherwise
+	index, count int
+	// elems the stack of the elements #v of the nested predicates being evaluated
+	elems []elemBinding
+}
+
+// elemBinding the element #v and its key #k, which is the index of a slice or array element
+type elemBinding struct {
+	key, val interface{}
+}
+
+// evalElem evaluates the predicate with the element #v and its key #k.
+func (t *TagExpr) evalElem(currField string, key, elem interface{}, pred ExprNode) interface{} {
+	t.elems = append(t.elems, elemBinding{key: key, val: elem})
+	defer func() { t.elems = t.elems[:len(t.elems)-1] }()
+	return pred.Run(currField, t)
+}
+
+// evalRef evaluates the expression referenced by another expression,
+// the evaluation is aborted if the references are cyclic.
+func (t *TagExpr) evalRef(selector string) interface{} {
+	expr, ok := t.s.exprs[selector]
+	if !ok {
+		return nil
+	}
+	if t.refs[selector] {
+		failEval("cyclic reference of the expression: %s", selector)
+	}
+	if t.refs == nil {
+		t.refs = make(map[string]bool)
+	}
+	t.refs[selector] = true
+	defer delete(t.refs, selector)
+	return expr.expr.Run(getFieldSelector(selector), t)
+}
+
+// label returns the label of the field set by vm.SetLabelTag, or the field name.
+func (t *TagExpr) label(fieldSelector string) interface{} {
+	f, ok := t.s.fields[fieldSelector]
+	if !ok {
+		return nil
+	}
+	if tag := t.s.vm.labelTag; tag != "" {
+		if label, ok := f.Tag.Lookup(tag); ok && label != "" {
+			return label
+		}
+	}
+	return f.Name
+}
+
+// selfTag returns the value of the tag key of the field, nil if the key is absent.
+func (t *TagExpr) selfTag(fieldSelector string, key string) interface{} {
+	f, ok := t.s.fields[fieldSelector]
+	if !ok {
+		return nil
+	}
+	if v, ok := f.Tag.Lookup(key); ok {
+		return v
+	}
+	return nil
+}
+
+// FieldAddr returns the addressable and settable value of the field by the selector expression.
+// NOTE:
+//  format: fieldName, fieldName.exprName, fieldName1.fieldName2.exprName1
+//  The resolved field values cached by the evaluator are discarded, since the field may be set.
+func (t *TagExpr) FieldAddr(selector string) (reflect.Value, error) {
+	t.resetValues()
+	return t.addressableField(getFieldSelector(selector))
+}
+
+// addressableField returns the settable value of the field,
+// @fieldSelector format: fieldName, fieldName1.fieldName2
+func (t *TagExpr) addressableField(fieldSelector string) (reflect.Value, error) {
+	v := reflect.NewAt(t.s.typ, unsafe.Pointer(t.ptr)).Elem()
+	for i, name := range strings.Split(fieldSelector, ".") {
+		if i > 0 {
+			for v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return reflect.Value{}, fmt.Errorf("nil pointer in field path: %s", fieldSelector)
+				}
+				v = v.Elem()
+			}
+		}
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("not struct field path: %s", fieldSelector)
+		}
+		v = v.FieldByName(name)
+		if !v.IsValid() {
+			return reflect.Value{}, fmt.Errorf("field not found: %s", fieldSelector)
+		}
+		v = reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
 	}
-	return te
+	return v, nil
 }
 
-// TagExpr struct tag expression evaluator
-type TagExpr struct {
-	s   *Struct
-	ptr uintptr
+func (t *TagExpr) getVM() *VM {
+	if t == nil {
+		return defaultVM
+	}
+	return t.s.vm
 }
 
 // EvalFloat evaluate the value of the struct tag expression by the selector expression.
 // NOTE:
 //  If the expression value type is not float64, return 0.
 func (t *TagExpr) EvalFloat(selector string) float64 {
-	r, _ := t.Eval(selector).(float64)
+	r, _ := t.eval(selector).(float64)
 	return r
 }
 
+// EvalInt evaluate the value of the struct tag expression by the selector expression,
+// and converts it to int64 with the rounding set by vm.SetRoundingMode.
+// NOTE:
+//  If the expression value type is neither float64 nor int64, return 0.
+func (t *TagExpr) EvalInt(selector string) int64 {
+	switch r := t.eval(selector).(type) {
+	case float64:
+		return t.getVM().toInt(r)
+	case int64:
+		return r
+	}
+	return 0
+}
+
 // EvalString evaluate the value of the struct tag expression by the selector expression.
 // NOTE:
 //  If the expression value type is not string, return "".
 func (t *TagExpr) EvalString(selector string) string {
-	r, _ := t.Eval(selector).(string)
+	r, _ := t.eval(selector).(string)
 	return r
 }
 
@@ -366,64 +1816,495 @@ func (t *TagExpr) EvalString(selector string) string {
 // NOTE:
 //  If the expression value type is not bool, return false.
 func (t *TagExpr) EvalBool(selector string) bool {
-	r, _ := t.Eval(selector).(bool)
+	r, _ := t.eval(selector).(bool)
 	return r
 }
 
+// EvalValid reports whether all the bool expressions of the field are true,
+// such as the independent constraints `tagexpr:"{min:$>=1}{max:$<=10}{pattern:regexp('^\\d+$')}"`.
+// NOTE:
+//  format: fieldName, fieldName1.fieldName2
+//  The expressions of the other result types are ignored like vm.AllValid,
+//  it is false if an evaluation is aborted, and true if the field has no expressions.
+func (t *TagExpr) EvalValid(fieldSelector string) bool {
+	t = t.beginPass()
+	defer t.endPass()
+	exprs := t.s.exprs
+	for _, selector := range t.s.selectorList {
+		if getFieldSelector(selector) != fieldSelector {
+			continue
+		}
+		switch r := t.runExpr(selector, exprs[selector]).(type) {
+		case bool:
+			if !r {
+				return false
+			}
+		case error:
+			return false
+		}
+	}
+	return true
+}
+
 // Eval evaluate the value of the struct tag expression by the selector expression.
 // NOTE:
 //  format: fieldName, fieldName.exprName, fieldName1.fieldName2.exprName1
-//  result types: float64, string, bool, nil
+//  result types: float64, string, bool, nil, error(the evaluation is aborted)
 func (t *TagExpr) Eval(selector string) interface{} {
+	return t.convertResult(selector, t.eval(selector))
+}
+
+func (t *TagExpr) eval(selector string) interface{} {
 	expr, ok := t.s.exprs[selector]
 	if !ok {
 		return nil
 	}
-	return expr.run(getFieldSelector(selector), t)
+	return t.runExpr(selector, expr)
+}
+
+// convertResult applies the converter set by vm.SetResultConverter.
+func (t *TagExpr) convertResult(selector string, r interface{}) interface{} {
+	if fn := t.s.vm.resultConverter; fn != nil {
+		return fn(selector, r)
+	}
+	return r
+}
+
+// runExpr evaluates the expression of the selector and reports it to the observer set by vm.SetEvalObserver.
+func (t *TagExpr) runExpr(selector string, expr *Expr) interface{} {
+	t = t.beginPass()
+	defer t.endPass()
+	field := getFieldSelector(selector)
+	observer := t.s.vm.evalObserver
+	if observer == nil {
+		return t.run(selector, field, expr)
+	}
+	start := time.Now()
+	r := t.run(selector, field, expr)
+	ev := EvalEvent{Field: field, Selector: selector, Duration: time.Since(start), Result: r}
+	if err, ok := r.(error); ok {
+		ev.Result, ev.Err = nil, err
+	}
+	observer(ev)
+	return r
+}
+
+// run evaluates the expression with the compiled plan of the selector if it applies, see vm.SetCompiledPlans.
+func (t *TagExpr) run(selector, field string, expr *Expr) interface{} {
+	if pl := t.s.plans[selector]; pl != nil && t.s.vm.plansApply() {
+		if r, ok := pl.run(t); ok {
+			return r
+		}
+	}
+	return expr.run(field, t)
+}
+
+// Failure returns the error of the failed expression of the selector made by the factory
+// set by vm.SetFailureFactory, nil if it is not set.
+func (t *TagExpr) Failure(selector string) error {
+	fn := t.s.vm.failureFactory
+	if fn == nil {
+		return nil
+	}
+	return fn(getFieldSelector(selector), selector, t.RawExpr(selector))
+}
+
+// RawExpr returns the raw expression text of the selector.
+// NOTE:
+//  If the selector does not exist, return "".
+func (t *TagExpr) RawExpr(selector string) string {
+	expr, ok := t.s.exprs[selector]
+	if !ok {
+		return ""
+	}
+	return expr.raw
 }
 
 // Range loop through each tag expression
 // NOTE:
-//  eval result types: float64, string, bool, nil
+//  eval result types: float64, string, bool, nil, error(the evaluation is aborted)
+//  The fields referenced by other fields, such as (A)$, are resolved once within the Range,
+//  changing them in @fn does not affect the later evaluations of the Range;
+//  The eval func must not be called after the Range returns
 func (t *TagExpr) Range(fn func(selector string, eval func() interface{}) bool) {
+	t = t.beginPass()
+	defer t.endPass()
 	exprs := t.s.exprs
 	for _, selector := range t.s.selectorList {
 		if !fn(selector, func() interface{} {
-			return exprs[selector].run(getFieldSelector(selector), t)
+			return t.convertResult(selector, t.runExpr(selector, exprs[selector]))
 		}) {
 			return
 		}
 	}
 }
 
+// formatResult formats the evaluation result for the debugging reports.
+func formatResult(r interface{}) string {
+	switch v := r.(type) {
+	case error:
+		return "error: " + v.Error()
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Summary returns the report of all the tag expressions for debugging,
+// one line per expression: selector: raw expression => result
+// NOTE:
+//  The string results are quoted, and the aborted evaluations are reported as error: message
+func (t *TagExpr) Summary() string {
+	var b strings.Builder
+	t.Range(func(selector string, eval func() interface{}) bool {
+		fmt.Fprintf(&b, "%s: %s => %s\n", selector, t.RawExpr(selector), formatResult(eval()))
+		return true
+	})
+	return b.String()
+}
+
+// Diff the mismatch between the expected and the actual result of an expression, see TagExpr.Diff
+type Diff struct {
+	Expected interface{}
+	Actual   interface{}
+}
+
+// Diff evaluates the expressions of the selectors in @expected, and returns the mismatches by selector,
+// such as for the golden-file tests of the validation rules.
+// NOTE:
+//  The expected Go numbers match the numeric results of the same value, an expected error matches
+//  the aborted evaluation of the same message, and a selector without expression has the nil result
+func (t *TagExpr) Diff(expected map[string]interface{}) map[string]Diff {
+	diffs := make(map[string]Diff)
+	for selector, want := range expected {
+		r := t.Eval(selector)
+		if !resultMatches(r, want) {
+			diffs[selector] = Diff{Expected: want, Actual: r}
+		}
+	}
+	return diffs
+}
+
+func resultMatches(r, want interface{}) bool {
+	switch x := r.(type) {
+	case error:
+		e, ok := want.(error)
+		return ok && e.Error() == x.Error()
+	case float64:
+		wv := reflect.ValueOf(want)
+		switch wv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return x == float64(wv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return x == float64(wv.Uint())
+		case reflect.Float32, reflect.Float64:
+			return x == wv.Float()
+		}
+	case int64:
+		wv := reflect.ValueOf(want)
+		switch wv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return x == wv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return x >= 0 && uint64(x) == wv.Uint()
+		case reflect.Float32, reflect.Float64:
+			return float64(x) == wv.Float()
+		}
+	}
+	return reflect.DeepEqual(r, want)
+}
+
 func (t *TagExpr) getValue(field string, subFields []interface{}) (v interface{}) {
 	f, ok := t.s.fields[field]
+	if !ok && t.getVM().caseInsensitive {
+		f, ok = t.s.foldField(field)
+	}
 	if !ok {
-		return nil
+		vm := t.getVM()
+		return vm.elemInterface(reflect.ValueOf(vm.unknownField))
 	}
 	if f.valueGetter == nil {
 		return nil
 	}
 	v = f.valueGetter(t.ptr)
-	if len(subFields) == 0 {
+	if hook := t.getVM().fieldValueHook; hook != nil {
+		v = hook(field, v)
+	}
+	return t.navigate(v, subFields)
+}
+
+// foldField returns the field whose selector matches case-insensitively,
+// the evaluation is aborted if more than one field matches.
+func (s *Struct) foldField(field string) (*Field, bool) {
+	if f, ok := s.foldedFields.Load(field); ok {
+		return f.(*Field), f.(*Field) != nil
+	}
+	var matched []string
+	for name := range s.fields {
+		if strings.EqualFold(name, field) {
+			matched = append(matched, name)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		s.foldedFields.Store(field, (*Field)(nil))
+		return nil, false
+	case 1:
+		f := s.fields[matched[0]]
+		s.foldedFields.Store(field, f)
+		return f, true
+	}
+	sort.Strings(matched)
+	failEval("ambiguous field selector %q: %s", field, strings.Join(matched, ", "))
+	return nil, false
+}
+
+// foldFieldByName returns the struct field whose name matches case-insensitively,
+// the exact name is preferred, and the evaluation is aborted if more than one field matches.
+func foldFieldByName(vv reflect.Value, name string) reflect.Value {
+	if f := vv.FieldByName(name); f.IsValid() {
+		return f
+	}
+	var matched []string
+	vv.FieldByNameFunc(func(s string) bool {
+		if strings.EqualFold(s, name) {
+			matched = append(matched, s)
+		}
+		return false
+	})
+	switch len(matched) {
+	case 0:
+		return reflect.Value{}
+	case 1:
+		return vv.FieldByName(matched[0])
+	}
+	sort.Strings(matched)
+	failEval("ambiguous field selector %q: %s", name, strings.Join(matched, ", "))
+	return reflect.Value{}
+}
+
+// enumOperand converts the string @v compared with the field selected by @e to
+// the enum value, if the field is of the enum type registered by vm.RegisterEnumType.
+func (t *TagExpr) enumOperand(currField string, e ExprNode, v interface{}) interface{} {
+	name, ok := v.(string)
+	if !ok || t == nil {
+		return v
+	}
+	se, ok := unwrapGroup(e).(*selectorExprNode)
+	if !ok || se.ref || se.boolPrefix != nil || len(se.subExprs) > 0 {
+		return v
+	}
+	field := se.field
+	if field == "" {
+		field = currField
+	} else if se.alias {
+		field = t.s.aliases[field]
+	}
+	f, ok := t.s.fields[field]
+	if !ok {
+		return v
+	}
+	vm := t.getVM()
+	n, ok := vm.lookupEnum(f.Type, name)
+	if !ok {
+		return v
+	}
+	if vm.integerMode {
+		return n
+	}
+	return float64(n)
+}
+
+// exactOperand returns the exact *big.Int value of the integer field or the integral literal selected by @e,
+// if float64 may have rounded its value @v, so that the comparisons of the large integers are exact.
+// The field values and the literals themselves stay float64.
+func (t *TagExpr) exactOperand(currField string, e ExprNode, v interface{}) interface{} {
+	f, ok := v.(float64)
+	if !ok || math.Abs(f) < maxExactInt || math.IsInf(f, 0) || math.IsNaN(f) {
+		return v
+	}
+	if _, ok := unwrapGroup(e).(*digitalExprNode); ok {
+		return exactLiteral(e, v)
+	}
+	if t == nil {
+		return v
+	}
+	vm := t.getVM()
+	if vm.integerMode || vm.fieldValueHook != nil || atomic.LoadInt32(&vm.numExtractors) > 0 {
+		return v
+	}
+	se, ok := unwrapGroup(e).(*selectorExprNode)
+	if !ok || se.ref || se.boolPrefix != nil || len(se.subExprs) > 0 {
 		return v
 	}
+	field := se.field
+	if field == "" {
+		field = currField
+	} else if se.alias {
+		field = t.s.aliases[field]
+	}
+	if sf, ok := t.s.fields[field]; !ok || !isPlainNumberType(sf.Type) {
+		return v
+	}
+	fv, err := t.addressableField(field)
+	if err != nil {
+		return v
+	}
+	for fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return v
+		}
+		fv = fv.Elem()
+	}
+	var n *big.Int
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int64:
+		n = big.NewInt(fv.Int())
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		n = new(big.Int).SetUint64(fv.Uint())
+	default:
+		return v
+	}
+	// the value resolved earlier is kept if the field has been changed since
+	if r, _ := new(big.Float).SetInt(n).Float64(); r != f {
+		return v
+	}
+	return n
+}
+
+// getCrossFieldValue is getValue of the field referenced by other fields,
+// the field value is resolved once within the current pass, see beginPass.
+func (t *TagExpr) getCrossFieldValue(field string, subFields []interface{}) interface{} {
+	v, ok := t.values[field]
+	if !ok {
+		v = t.getValue(field, nil)
+		if t.values == nil {
+			t.values = make(map[string]interface{})
+		}
+		t.values[field] = v
+	}
+	return t.navigate(v, subFields)
+}
+
+// passPool the copies of the TagExprs evaluated by the outermost passes, see beginPass
+var passPool = sync.Pool{New: func() interface{} { return new(TagExpr) }}
+
+// beginPass starts a pass over the expressions, such as an Eval or a Range,
+// within which the cross-field values are resolved once,
+// and returns the TagExpr to evaluate them with, which is a pooled copy of t for the outermost pass.
+func (t *TagExpr) beginPass() *TagExpr {
+	if t.passes == 0 {
+		c := passPool.Get().(*TagExpr)
+		c.s, c.ptr, c.index, c.count = t.s, t.ptr, t.index, t.count
+		t = c
+	}
+	t.passes++
+	return t
+}
+
+// endPass ends the pass started by beginPass, the resolved values are discarded
+// at the end of the outermost pass, so the later evaluations read the current field values.
+func (t *TagExpr) endPass() {
+	if t.passes--; t.passes == 0 {
+		t.resetValues()
+		passPool.Put(t)
+	}
+}
+
+// resetValues discards the resolved values of the current pass,
+// the TagExpr outside the passes has none and is not written.
+func (t *TagExpr) resetValues() {
+	if t.values == nil && t.sets == nil {
+		return
+	}
+	t.values = nil
+	t.sets = nil
+}
+
+// memberSet returns the members of the cross-field set computed by newMemberSet.
+func (t *TagExpr) memberSet(ie *inExprNode) map[interface{}]struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.sets[ie]
+}
+
+// newMemberSet computes the members of the cross-field set once within the TagExpr,
+// return nil if the set is not a struct field or it has unhashable elements.
+func (t *TagExpr) newMemberSet(ie *inExprNode, vv reflect.Value) map[interface{}]struct{} {
+	if t == nil || !ie.isCrossFieldSet() {
+		return nil
+	}
+	if _, had := t.sets[ie]; had {
+		return nil
+	}
+	set := make(map[interface{}]struct{}, vv.Len())
+	vm := t.getVM()
+	for i := 0; i < vv.Len(); i++ {
+		k, ok := setKey(vm.elemInterface(vv.Index(i)))
+		if !ok {
+			set = nil
+			break
+		}
+		set[k] = struct{}{}
+	}
+	if t.sets == nil {
+		t.sets = make(map[*inExprNode]map[interface{}]struct{})
+	}
+	t.sets[ie] = set
+	return set
+}
+
+// navigate returns the value reached by the sub-selectors from @v.
+func (t *TagExpr) navigate(v interface{}, subFields []interface{}) interface{} {
+	if len(subFields) == 0 {
+		return t.getVM().zeroToNil(v)
+	}
 	vv := reflect.ValueOf(v)
 	for _, k := range subFields {
-		for vv.Kind() == reflect.Ptr {
-			vv = vv.Elem()
+		if name, ok := k.(methodName); ok {
+			vv = callMethod(vv, string(name))
+			continue
 		}
-		switch vv.Kind() {
-		case reflect.Slice, reflect.Array, reflect.String:
-			if float, ok := k.(float64); ok {
-				idx := int(float)
-				if idx >= vv.Len() {
+		if _, ok := k.(fieldName); !ok {
+			if m, ok := mapperOf(vv); ok {
+				r, ok := m.Get(k)
+				if !ok {
 					return nil
 				}
-				vv = vv.Index(idx)
-			} else {
+				vv = reflect.ValueOf(r)
+				continue
+			}
+		}
+		vv = derefValue(vv)
+		if !vv.IsValid() {
+			return nil
+		}
+		if name, ok := k.(fieldName); ok {
+			if vv.Kind() != reflect.Struct {
+				return nil
+			}
+			if t.getVM().caseInsensitive {
+				vv = foldFieldByName(vv, string(name))
+				if !vv.IsValid() {
+					return nil
+				}
+				continue
+			}
+			vv = vv.FieldByName(string(name))
+			if !vv.IsValid() {
+				return nil
+			}
+			continue
+		}
+		switch vv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.String:
+			idx, ok := t.getVM().toIndex(k)
+			if !ok || idx < 0 || idx >= vv.Len() {
 				return nil
 			}
+			vv = vv.Index(idx)
 		case reflect.Map:
 			k := safeConvert(reflect.ValueOf(k), vv.Type().Key())
 			if !k.IsValid() {
@@ -434,10 +2315,141 @@ func (t *TagExpr) getValue(field string, subFields []interface{}) (v interface{}
 			return nil
 		}
 	}
-	for vv.Kind() == reflect.Ptr {
-		vv = vv.Elem()
+	return t.getVM().zeroToNil(t.getVM().elemInterface(vv))
+}
+
+// callMethod calls the method without arguments of the value or the value it points to,
+// the method returns a value and an optional error, the evaluation is aborted if the error is not nil.
+// The result is invalid if the method is absent, and the evaluation is aborted if the value is of an unexported field.
+func callMethod(vv reflect.Value, name string) reflect.Value {
+	for vv.IsValid() {
+		if !vv.CanInterface() {
+			// reflect panics on the methods of the values obtained through the unexported fields
+			failEval("method %s of the unexported field is not accessible", name)
+		}
+		if vv.Kind() == reflect.Interface || vv.Kind() == reflect.Ptr {
+			if vv.IsNil() {
+				return reflect.Value{}
+			}
+		}
+		if vv.Kind() == reflect.Struct && promotedFromNil(vv, name) {
+			return reflect.Value{}
+		}
+		if m := vv.MethodByName(name); m.IsValid() {
+			return callNoArgs(m, name)
+		}
+		switch vv.Kind() {
+		case reflect.Interface, reflect.Ptr:
+			vv = vv.Elem()
+			continue
+		}
+		// the pointer receiver
+		if !vv.CanAddr() {
+			p := reflect.New(vv.Type())
+			p.Elem().Set(vv)
+			vv = p.Elem()
+		}
+		if m := vv.Addr().MethodByName(name); m.IsValid() {
+			return callNoArgs(m, name)
+		}
+		break
+	}
+	return reflect.Value{}
+}
+
+// promotedFromNil reports whether the method is promoted from a nil embedded pointer of the struct,
+// which panics if called.
+func promotedFromNil(vv reflect.Value, name string) bool {
+	for i := vv.NumField() - 1; i >= 0; i-- {
+		if !vv.Type().Field(i).Anonymous {
+			continue
+		}
+		fv := vv.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if _, ok := fv.Type().MethodByName(name); !ok {
+				continue
+			}
+			if fv.IsNil() {
+				return true
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && promotedFromNil(fv, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func callNoArgs(m reflect.Value, name string) reflect.Value {
+	t := m.Type()
+	if t.NumIn() != 0 || t.NumOut() == 0 || t.NumOut() > 2 ||
+		t.NumOut() == 2 && t.Out(1) != errorType {
+		return reflect.Value{}
+	}
+	r := m.Call(nil)
+	if len(r) == 2 && !r[1].IsNil() {
+		failEval("%s(): %s", name, r[1].Interface())
+	}
+	return r[0]
+}
+
+// Mapper is the custom container that can be indexed by the sub-selectors such as $['key'],
+// e.g. a wrapper of sync.Map.
+// NOTE:
+//  The key is the sub-selector value, whose type is string, float64 (int64 in the integer mode) or bool.
+type Mapper interface {
+	Get(key interface{}) (interface{}, bool)
+}
+
+// mapperOf returns the Mapper implemented by the value or the values it points to.
+func mapperOf(v reflect.Value) (Mapper, bool) {
+	for v.IsValid() {
+		if v.CanInterface() {
+			if m, ok := v.Interface().(Mapper); ok {
+				return m, true
+			}
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface || v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	return nil, false
+}
+
+// toIndex converts the number to the index of slice, array or string.
+func (vm *VM) toIndex(k interface{}) (int, bool) {
+	switch r := k.(type) {
+	case float64:
+		return int(vm.toInt(r)), true
+	case int64:
+		return int(r), true
+	}
+	return 0, false
+}
+
+// elemInterface returns the value of the element in the form used by expressions.
+func (vm *VM) elemInterface(vv reflect.Value) interface{} {
+	vv = derefValue(vv)
+	if vv.IsValid() && atomic.LoadInt32(&vm.numExtractors) > 0 {
+		if fn, ok := vm.extractors.Load(vv.Type()); ok {
+			return vm.extractedInterface(fn.(func(reflect.Value) interface{}), vv)
+		}
 	}
+	return vm.plainElemInterface(vv)
+}
+
+// extractedInterface returns the value extracted by the function registered by vm.RegisterExtractor,
+// the extracted value is not extracted again.
+func (vm *VM) extractedInterface(fn func(reflect.Value) interface{}, vv reflect.Value) interface{} {
+	return vm.plainElemInterface(derefValue(reflect.ValueOf(fn(vv))))
+}
+
+func (vm *VM) plainElemInterface(vv reflect.Value) interface{} {
 	switch vv.Kind() {
+	case reflect.Invalid:
+		return nil
 	default:
 		if vv.CanInterface() {
 			return vv.Interface()
@@ -451,9 +2463,37 @@ func (t *TagExpr) getValue(field string, subFields []interface{}) (v interface{}
 		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		if vv.CanAddr() {
-			return getFloat64(vv.Kind(), vv.UnsafeAddr())
+			return vm.getNumber(vv.Kind(), vv.UnsafeAddr())
+		}
+		// the values of the unexported fields can not be Set, but can be read
+		p := reflect.New(vv.Type())
+		switch {
+		case vv.CanInt():
+			p.Elem().SetInt(vv.Int())
+		case vv.CanUint():
+			p.Elem().SetUint(vv.Uint())
+		default:
+			p.Elem().SetFloat(vv.Float())
+		}
+		return vm.getNumber(vv.Kind(), p.Pointer())
+	}
+}
+
+// derefValue dereferences pointers and interfaces, and unwraps the boxed reflect.Value,
+// return the zero Value if it is nil.
+func derefValue(v reflect.Value) reflect.Value {
+	for {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			v = v.Elem()
+		case reflect.Struct:
+			if v.Type() != reflectValueType || !v.CanInterface() {
+				return v
+			}
+			v = v.Interface().(reflect.Value)
+		default:
+			return v
 		}
-		return vv.Convert(float64Type).Float()
 	}
 }
 
@@ -462,7 +2502,15 @@ func safeConvert(v reflect.Value, t reflect.Type) reflect.Value {
 	return v.Convert(t)
 }
 
-var float64Type = reflect.TypeOf(float64(0))
+var (
+	float64Type      = reflect.TypeOf(float64(0))
+	reflectValueType = reflect.TypeOf(reflect.Value{})
+	mapperType       = reflect.TypeOf((*Mapper)(nil)).Elem()
+	valuerType       = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+	bigIntType       = reflect.TypeOf(big.Int{})
+	bigFloatType     = reflect.TypeOf(big.Float{})
+)
 
 func getFieldSelector(selector string) string {
 	idx := strings.Index(selector, "@")
@@ -504,3 +2552,52 @@ func getFloat64(kind reflect.Kind, ptr uintptr) interface{} {
 	}
 	return nil
 }
+
+// maxExactInt the magnitude limit of the integers that float64 represents exactly,
+// the integer fields beyond it are compared exactly by exactOperand
+const maxExactInt = 1 << 53
+
+func getInt64(kind reflect.Kind, ptr uintptr) interface{} {
+	p := unsafe.Pointer(ptr)
+	switch kind {
+	case reflect.Float32, reflect.Float64:
+		f := float64(*(*float32)(p))
+		if kind == reflect.Float64 {
+			f = *(*float64)(p)
+		}
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			failEval("fractional or overflowing number %v in integer mode", f)
+		}
+		return int64(f)
+	case reflect.Int:
+		return int64(*(*int)(p))
+	case reflect.Int8:
+		return int64(*(*int8)(p))
+	case reflect.Int16:
+		return int64(*(*int16)(p))
+	case reflect.Int32:
+		return int64(*(*int32)(p))
+	case reflect.Int64:
+		return *(*int64)(p)
+	case reflect.Uint:
+		return uintToInt64(uint64(*(*uint)(p)))
+	case reflect.Uint8:
+		return int64(*(*uint8)(p))
+	case reflect.Uint16:
+		return int64(*(*uint16)(p))
+	case reflect.Uint32:
+		return int64(*(*uint32)(p))
+	case reflect.Uint64:
+		return uintToInt64(*(*uint64)(p))
+	case reflect.Uintptr:
+		return uintToInt64(uint64(*(*uintptr)(p)))
+	}
+	return nil
+}
+
+func uintToInt64(u uint64) int64 {
+	if u > math.MaxInt64 {
+		failEval("overflowing number %d in integer mode", u)
+	}
+	return int64(u)
+}
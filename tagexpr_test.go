@@ -15,9 +15,18 @@
 package tagexpr
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
 	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkTagExpr(b *testing.B) {
@@ -44,6 +53,206 @@ func BenchmarkTagExpr(b *testing.B) {
 	}
 }
 
+type crossFieldBench struct {
+	Items []int `bench:"len($)>0"`
+	A0    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A1    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A2    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A3    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A4    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A5    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A6    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A7    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A8    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+	A9    int   `bench:"$<len((Items)$) && (Items)$[$]>=0"`
+}
+
+func BenchmarkCrossField(b *testing.B) {
+	b.StopTimer()
+	vm := New("bench")
+	err := vm.WarmUp(new(crossFieldBench))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var t = &crossFieldBench{Items: make([]int, 1000), A9: 9}
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tagExpr, err := vm.Run(t)
+		if err != nil {
+			b.FailNow()
+		}
+		tagExpr.Range(func(selector string, eval func() interface{}) bool {
+			if eval() != true {
+				b.FailNow()
+			}
+			return true
+		})
+	}
+}
+
+func BenchmarkIn(b *testing.B) {
+	var members, eqs []string
+	for i := 0; i < 500; i++ {
+		members = append(members, strconv.Itoa(i))
+		eqs = append(eqs, "$=="+strconv.Itoa(i))
+	}
+	var cases = []struct {
+		name, expr string
+	}{
+		{"literal-map", "$ in (" + strings.Join(members, ",") + ")"},
+		{"field-map", "$ in (S)$"},
+		{"linear", strings.Join(eqs, " || ")},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			expr, err := parseExpr(c.expr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			type T struct {
+				A int
+				S []int
+			}
+			var v = &T{A: 499, S: make([]int, 500)}
+			for i := range v.S {
+				v.S[i] = i
+			}
+			tagExpr, err := New("bench").Run(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if expr.run("A", tagExpr) != true {
+					b.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBatchRun(b *testing.B) {
+	values := batchRunValues()
+	vm := New("bench")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.BatchRun(values)
+	}
+}
+
+func BenchmarkBatchRunSequential(b *testing.B) {
+	values := batchRunValues()
+	vm := New("bench")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, v := range values {
+			vm.Run(v)
+		}
+	}
+}
+
+func BenchmarkRunParallel(b *testing.B) {
+	type T struct {
+		A int    `bench:"$%3"`
+		S string `bench:"len($)>1"`
+	}
+	vm := New("bench").SetResultCache(true)
+	err := vm.WarmUp(new(T))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var t = &T{A: 10, S: "abc"}
+		for pb.Next() {
+			tagExpr, err := vm.Run(t)
+			if err != nil {
+				b.FailNow()
+			}
+			if tagExpr.EvalFloat("A@") != 1 || tagExpr.EvalBool("S@") != true {
+				b.FailNow()
+			}
+		}
+	})
+}
+
+type benchInt int
+
+func BenchmarkNumCompare(b *testing.B) {
+	type T struct {
+		A int      `bench:"$>5"`
+		B benchInt `bench:"$>5"`
+	}
+	for _, selector := range []string{"A@", "B@"} {
+		name := "specialized"
+		if selector == "B@" {
+			name = "generic"
+		}
+		b.Run(name, func(b *testing.B) {
+			v := &T{A: 10, B: 10}
+			tagExpr, err := New("bench").Run(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tagExpr.Eval(selector) != true || v.A != 10 {
+					b.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompiledPlan(b *testing.B) {
+	type T struct {
+		A int     `bench:"$>0 && $<100 && $%2==0"`
+		B string  `bench:"$!='' && $<='m'"`
+		C float64 `bench:"($+(A)$)*2>=10"`
+	}
+	for _, compiled := range []bool{false, true} {
+		name := "tree"
+		if compiled {
+			name = "plan"
+		}
+		b.Run(name, func(b *testing.B) {
+			v := &T{A: 10, B: "go", C: 1.5}
+			tagExpr, err := New("bench").SetCompiledPlans(compiled).Run(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tagExpr.Eval("A@") != true || tagExpr.Eval("B@") != true || tagExpr.Eval("C@") != true || v.A != 10 {
+					b.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func batchRunValues() []interface{} {
+	type A struct {
+		X int `bench:"$>0"`
+	}
+	type B struct {
+		S string `bench:"len($)>1"`
+	}
+	values := make([]interface{}, 0, 1024)
+	for i := 0; i < 512; i++ {
+		values = append(values, &A{X: i}, &B{S: strconv.Itoa(i)})
+	}
+	return values
+}
+
 func BenchmarkReflect(b *testing.B) {
 	b.StopTimer()
 	type T struct {
@@ -204,3 +413,3208 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+func TestOptionalChaining(t *testing.T) {
+	type Item struct {
+		Name string
+	}
+	type T struct {
+		Items []*Item `tagexpr:"{name:$?[0]?.Name}{second:$?[1]?.Name}{neg:$?[-1]?.Name}"`
+		Sub   *struct {
+			Items []Item
+		} `tagexpr:"$?.Items?[0].Name"`
+	}
+	var cases = []struct {
+		structure *T
+		tests     map[string]interface{}
+	}{
+		{
+			structure: &T{},
+			tests: map[string]interface{}{
+				"Items@name":   nil,
+				"Items@second": nil,
+				"Items@neg":    nil,
+				"Sub@":         nil,
+			},
+		},
+		{
+			structure: &T{
+				Items: []*Item{{Name: "a"}, nil},
+				Sub: &struct {
+					Items []Item
+				}{Items: []Item{{Name: "b"}}},
+			},
+			tests: map[string]interface{}{
+				"Items@name":   "a",
+				"Items@second": nil,
+				"Items@neg":    nil,
+				"Sub@":         "b",
+			},
+		},
+	}
+	vm := New("tagexpr")
+	for i, c := range cases {
+		tagExpr, err := vm.Run(c.structure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			val := tagExpr.Eval(selector)
+			if !reflect.DeepEqual(val, value) {
+				t.Fatalf("Eval NO: %d, selector: %q, got: %v, want: %v", i, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"number($)"`
+		B string `tagexpr:"number()==1.5"`
+	}
+	vm := New("tagexpr")
+	tagExpr, err := vm.Run(&T{A: "3.14", B: "1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := tagExpr.Eval("A@"); v != 3.14 {
+		t.Fatalf("got: %v, want: 3.14", v)
+	}
+	if !tagExpr.EvalBool("B@") {
+		t.Fatal("want true")
+	}
+	vm.SetDecimalSeparator(',')
+	tagExpr, err = vm.Run(&T{A: "3,14", B: "1,5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := tagExpr.Eval("A@"); v != 3.14 {
+		t.Fatalf("got: %v, want: 3.14", v)
+	}
+	if !tagExpr.EvalBool("B@") {
+		t.Fatal("want true")
+	}
+	tagExpr, err = vm.Run(&T{A: "3.14"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := tagExpr.Eval("A@"); v != nil {
+		t.Fatalf("got: %v, want: nil", v)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"len($)>1"`
+		B string `tagexpr:"(A)$==$"`
+		C []int  `tagexpr:"len($)"`
+	}
+	vm := New("tagexpr").SetResultCache(true)
+	tagExpr, err := vm.Run(&T{A: "ab", B: "ab", C: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tagExpr.EvalBool("A@") || !tagExpr.EvalBool("B@") || tagExpr.EvalFloat("C@") != 1 {
+		t.Fatal("unexpected result")
+	}
+	a := tagExpr.s.exprs["A@"]
+	if r, ok := a.cache.get("ab"); !ok || r != true {
+		t.Fatalf("want cached result, got: %v, %v", r, ok)
+	}
+	if tagExpr.s.exprs["B@"].cache != nil {
+		t.Fatal("cross-field expression should not be cached")
+	}
+	if n := tagExpr.s.exprs["C@"].cache.len(); n != 0 {
+		t.Fatalf("non-hashable value should not be cached, got %d entries", n)
+	}
+	// a cached result is reused for the identical value
+	a.cache.set("ab", "cached")
+	tagExpr, err = vm.Run(&T{A: "ab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@"); r != "cached" {
+		t.Fatalf("got: %v, want: cached", r)
+	}
+	// and recomputed for the changed value
+	tagExpr, err = vm.Run(&T{A: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@"); r != false {
+		t.Fatalf("got: %v, want: false", r)
+	}
+	if a.cache.len() != 2 {
+		t.Fatalf("got %d cache entries, want: 2", a.cache.len())
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	type T struct {
+		A int     `tagexpr:"$>0"`
+		B int     `tagexpr:"{default:(A)$+1}"`
+		C float32 `tagexpr:"{default:(B)$*1.5}"`
+		d string  `tagexpr:"{default:'d'+sprintf('%v',(A)$)}"`
+		E *int    `tagexpr:"{default:10}"`
+		f struct {
+			g bool `tagexpr:"{default:true}"`
+		}
+	}
+	vm := New("tagexpr")
+	v := &T{A: 1}
+	if err := vm.ApplyDefaults(v); err != nil {
+		t.Fatal(err)
+	}
+	if v.B != 2 || v.C != 3 || v.d != "d1" || v.E == nil || *v.E != 10 || !v.f.g {
+		t.Fatalf("got: %+v", v)
+	}
+	e := 7
+	v = &T{A: 1, B: 5, C: 1, d: "x", E: &e}
+	if err := vm.ApplyDefaults(v); err != nil {
+		t.Fatal(err)
+	}
+	if v.B != 5 || v.C != 1 || v.d != "x" || *v.E != 7 || !v.f.g {
+		t.Fatalf("non-zero fields should be untouched, got: %+v", v)
+	}
+
+	type U struct {
+		A int `tagexpr:"{default:'x'}"`
+	}
+	if err := vm.ApplyDefaults(&U{}); err == nil {
+		t.Fatal("want type mismatch error")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestAt(t *testing.T) {
+	type T struct {
+		Items []string `tagexpr:"{in:at($,1,'n/a')}{out:at($,2,'n/a')}{neg:at($,-1,'n/a')}"`
+		Ints  [2]*int  `tagexpr:"{in:at($,0,-1)}{nil:at($,1,-1)}"`
+	}
+	one := 1
+	tagExpr, err := New("tagexpr").Run(&T{Items: []string{"a", "b"}, Ints: [2]*int{&one}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = map[string]interface{}{
+		"Items@in":  "b",
+		"Items@out": "n/a",
+		"Items@neg": "n/a",
+		"Ints@in":   1.0,
+		"Ints@nil":  nil,
+	}
+	for selector, value := range tests {
+		val := tagExpr.Eval(selector)
+		if !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestMapOfStruct(t *testing.T) {
+	type Config struct {
+		Timeout int `tagexpr:"$>0"`
+		Name    string
+	}
+	type T struct {
+		Configs map[string]Config   `tagexpr:"{prod:$['prod'].Timeout}{dev:$['dev'].Timeout}{name:$['prod']?.Name}"`
+		Ptrs    map[string]*Config  `tagexpr:"{prod:$['prod'].Timeout}{nil:$['nil'].Timeout}"`
+		Nested  map[string][]Config `tagexpr:"$['prod'][0].Name"`
+	}
+	var cases = []struct {
+		structure *T
+		tests     map[string]interface{}
+	}{
+		{
+			structure: &T{},
+			tests: map[string]interface{}{
+				"Configs@prod": nil,
+				"Configs@dev":  nil,
+				"Configs@name": nil,
+				"Ptrs@prod":    nil,
+				"Ptrs@nil":     nil,
+				"Nested@":      nil,
+			},
+		},
+		{
+			structure: &T{
+				Configs: map[string]Config{"prod": {Timeout: 3, Name: "p"}},
+				Ptrs:    map[string]*Config{"prod": {Timeout: 5}, "nil": nil},
+				Nested:  map[string][]Config{"prod": {{Name: "n"}}},
+			},
+			tests: map[string]interface{}{
+				"Configs@prod": 3.0,
+				"Configs@dev":  nil,
+				"Configs@name": "p",
+				"Ptrs@prod":    5.0,
+				"Ptrs@nil":     nil,
+				"Nested@":      "n",
+			},
+		},
+	}
+	vm := New("tagexpr")
+	for i, c := range cases {
+		tagExpr, err := vm.Run(c.structure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			val := tagExpr.Eval(selector)
+			if !reflect.DeepEqual(val, value) {
+				t.Fatalf("Eval NO: %d, selector: %q, got: %v, want: %v", i, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestBoolStrings(t *testing.T) {
+	type T struct {
+		A bool `tagexpr:"{add:'active: '+$}{sprintf:sprintf('%s/%v/%t',$,!$,$)}"`
+	}
+	vm := New("tagexpr")
+	tagExpr, err := vm.Run(&T{A: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.EvalString("A@add"); r != "active: true" {
+		t.Fatalf("got: %q", r)
+	}
+	vm.SetBoolStrings("yes", "no")
+	if r := tagExpr.EvalString("A@add"); r != "active: yes" {
+		t.Fatalf("got: %q", r)
+	}
+	if r := tagExpr.EvalString("A@sprintf"); r != "yes/no/true" {
+		t.Fatalf("got: %q", r)
+	}
+}
+
+func TestAliasSelector(t *testing.T) {
+	type Sub struct {
+		City string `json:"ville"`
+	}
+	type T struct {
+		Name  string `json:"名前,omitempty"`
+		Age   int    `json:"-" tagexpr:"{alias:('名前')$=='太郎'}{name:(Name)$}{sub:('住所.ville')$}{none:('Name')$}"`
+		名前    string `tagexpr:"(名前)$+$.x"`
+		Addr  Sub    `json:"住所"`
+		Items []Sub  `tagexpr:"$[0].City"`
+	}
+	vm := New("tagexpr").SetAliasTag("json")
+	tagExpr, err := vm.Run(&T{Name: "太郎", 名前: "n", Addr: Sub{City: "Paris"}, Items: []Sub{{City: "Rome"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = map[string]interface{}{
+		"Age@alias": true,
+		"Age@name":  "太郎",
+		"Age@sub":   "Paris",
+		"Age@none":  nil,
+		"名前@":       "n",
+		"Items@":    "Rome",
+	}
+	for selector, value := range tests {
+		val := tagExpr.Eval(selector)
+		if !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestFieldAddr(t *testing.T) {
+	type Sub struct {
+		b string `tagexpr:"$==''"`
+	}
+	type T struct {
+		A int `tagexpr:"$>0"`
+		S Sub
+		P *Sub
+	}
+	v := &T{}
+	vm := New("tagexpr")
+	tagExpr, err := vm.Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := tagExpr.FieldAddr("A@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.CanSet() {
+		t.Fatal("want settable value")
+	}
+	if !tagExpr.EvalBool("A@") {
+		a.SetInt(1)
+	}
+	b, err := tagExpr.FieldAddr("S.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetString("x")
+	if v.A != 1 || v.S.b != "x" || tagExpr.EvalBool("S.b@") {
+		t.Fatalf("got: %+v", v)
+	}
+	if _, err = tagExpr.FieldAddr("P.b"); err == nil {
+		t.Fatal("want nil pointer error")
+	}
+	if _, err = tagExpr.FieldAddr("X"); err == nil {
+		t.Fatal("want field not found error")
+	}
+	if _, err = vm.Run(T{}); err == nil {
+		t.Fatal("want non-addressable root error")
+	}
+}
+
+func TestNilRoot(t *testing.T) {
+	type T struct {
+		S *string `tagexpr:"{nil:$==nil}{len:len($)}"`
+		B *bool   `tagexpr:"{nil:$==nil}{not:!$}"`
+	}
+	vm := New("tagexpr")
+	if _, err := vm.Run(nil); err == nil || !strings.Contains(err.Error(), "nil interface") {
+		t.Fatalf("got: %v", err)
+	}
+	_, err := vm.Run((*T)(nil))
+	if err == nil || !strings.Contains(err.Error(), "nil pointer: *tagexpr.T") || !strings.Contains(err.Error(), "new(tagexpr.T)") {
+		t.Fatalf("got: %v", err)
+	}
+	if _, err = vm.RunSlice([]*T{new(T), nil}); err == nil || !strings.Contains(err.Error(), "element 1: cannot run nil pointer") {
+		t.Fatalf("got: %v", err)
+	}
+	// the nil pointer fields are nil
+	tagExpr, err := vm.Run(new(T))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string]interface{}{"S@nil": true, "S@len": nil, "B@nil": true, "B@not": nil} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("%s: got: %v, want: %v", selector, r, want)
+		}
+	}
+}
+
+func TestSelectorCaseInsensitive(t *testing.T) {
+	type U struct {
+		City string
+		Zip  string
+		ZIP  string
+	}
+	type T struct {
+		Username string
+		Check    string `tagexpr:"{user:(username)$=='bob'}{exact:(Username)$=='bob'}{city:(addr)$.city}{nested:(addr.city)$}"`
+		Bad      string `tagexpr:"{zip:(Addr)$.zip}{nested:(addr.zip)$}"`
+		Addr     U
+	}
+	v := &T{Username: "bob", Addr: U{City: "x", Zip: "1", ZIP: "2"}}
+	var cases = []struct {
+		caseInsensitive bool
+		tests           map[string]interface{}
+	}{
+		{false, map[string]interface{}{"Check@user": false, "Check@exact": true, "Check@city": nil, "Check@nested": nil}},
+		{true, map[string]interface{}{"Check@user": true, "Check@exact": true, "Check@city": "x", "Check@nested": "x"}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetSelectorCaseInsensitive(c.caseInsensitive).Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("caseInsensitive: %v, selector: %q, got: %v, want: %v", c.caseInsensitive, selector, val, value)
+			}
+		}
+	}
+	tagExpr, err := New("tagexpr").SetSelectorCaseInsensitive(true).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"Bad@zip", "Bad@nested"} {
+		if err, ok := tagExpr.Eval(selector).(error); !ok || !strings.Contains(err.Error(), "ambiguous") {
+			t.Fatalf("%s: want ambiguous error, got: %v", selector, tagExpr.Eval(selector))
+		}
+	}
+}
+
+func TestStringFuncMaxLen(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"regexp('^a+$')"`
+		B string `tagexpr:"editDistance($, 'abc')"`
+	}
+	vm := New("tagexpr").SetStringFuncMaxLen(4)
+	tagExpr, err := vm.Run(&T{A: "aaaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@"); r != true {
+		t.Fatalf("got: %v, want: true", r)
+	}
+	tagExpr, err = vm.Run(&T{A: "aaaaa", B: "abcde"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := tagExpr.Eval("A@").(error); !ok {
+		t.Fatalf("want error, got: %v", tagExpr.Eval("A@"))
+	} else {
+		t.Log(err)
+	}
+	if _, ok := tagExpr.Eval("B@").(error); !ok {
+		t.Fatalf("want error, got: %v", tagExpr.Eval("B@"))
+	}
+	vm.SetStringFuncMaxLen(0)
+	if r := tagExpr.Eval("A@"); r != true {
+		t.Fatalf("got: %v, want: true", r)
+	}
+
+	// editDistance is bounded even if the limit is off
+	for n, want := range map[int]bool{editDistanceMaxRunes: false, editDistanceMaxRunes + 1: true} {
+		tagExpr, err = vm.Run(&T{B: strings.Repeat("é", n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tagExpr.Eval("B@").(error); ok != want {
+			t.Fatalf("%d runes: got: %v", n, tagExpr.Eval("B@"))
+		}
+	}
+}
+
+type isOneofMsg_Contact interface{ isOneofMsg_Contact() }
+
+type OneofMsg_Email struct {
+	Email string `protobuf:"bytes,1,opt,name=email,proto3,oneof"`
+}
+
+type OneofMsg_Phone struct {
+	Phone int64 `protobuf:"varint,2,opt,name=phone,proto3,oneof"`
+}
+
+func (*OneofMsg_Email) isOneofMsg_Contact() {}
+func (*OneofMsg_Phone) isOneofMsg_Contact() {}
+
+type OneofMsg struct {
+	Contact isOneofMsg_Contact `protobuf_oneof:"contact" tagexpr:"{val:oneof($)}{email:regexp('@',oneof($))}{phone:oneof($)==10}"`
+}
+
+func TestOneof(t *testing.T) {
+	var cases = []struct {
+		msg   *OneofMsg
+		tests map[string]interface{}
+	}{
+		{&OneofMsg{Contact: &OneofMsg_Email{Email: "a@b.c"}}, map[string]interface{}{"Contact@val": "a@b.c", "Contact@email": true, "Contact@phone": false}},
+		{&OneofMsg{Contact: &OneofMsg_Phone{Phone: 10}}, map[string]interface{}{"Contact@val": 10.0, "Contact@email": nil, "Contact@phone": true}},
+		{&OneofMsg{}, map[string]interface{}{"Contact@val": nil, "Contact@email": nil, "Contact@phone": false}},
+	}
+	vm := New("tagexpr")
+	for _, c := range cases {
+		tagExpr, err := vm.Run(c.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("msg: %+v, selector: %q, got: %v, want: %v", c.msg, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestCrossFieldValues(t *testing.T) {
+	var reads int
+	vm := New("bench").SetFieldValueHook(func(path string, v interface{}) interface{} {
+		if path == "Items" {
+			reads++
+		}
+		return v
+	})
+	tagExpr, err := vm.Run(&crossFieldBench{Items: []int{1, 2}, A1: 1, A2: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got = map[string]interface{}{}
+	tagExpr.Range(func(selector string, eval func() interface{}) bool {
+		got[selector] = eval()
+		return true
+	})
+	if got["A1@"] != true || got["A2@"] != false {
+		t.Fatalf("got: %v", got)
+	}
+	// once by the expression of Items itself, once by all the references
+	if reads != 2 {
+		t.Fatalf("the referenced field is resolved more than once: %d", reads)
+	}
+	vm.SetFieldValueHook(nil)
+	if tagExpr.values != nil {
+		t.Fatalf("the resolved values outlive the Range: %v", tagExpr.values)
+	}
+
+	// the evaluations after the changes of the struct read the current field values
+	v0 := &crossFieldBench{Items: []int{1, 2}, A1: 1}
+	tagExpr, err = vm.Run(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A1@"); r != true {
+		t.Fatalf("got: %v", r)
+	}
+	v0.Items = []int{1}
+	if r := tagExpr.Eval("A1@"); r != false {
+		t.Fatalf("after the change: got: %v", r)
+	}
+	if !tagExpr.EvalValid("A0") {
+		t.Fatal("want valid")
+	}
+	v0.Items = nil
+	if tagExpr.EvalValid("A0") {
+		t.Fatal("after the change: want invalid")
+	}
+
+	type T struct {
+		A int `tagexpr:"{default:(B)$+1}"`
+		B int `tagexpr:"{default:1}"`
+		C int `tagexpr:"{default:(B)$*10}"`
+	}
+	v := new(T)
+	if err := New("tagexpr").ApplyDefaults(v); err != nil {
+		t.Fatal(err)
+	}
+	if *v != (T{A: 1, B: 1, C: 10}) {
+		t.Fatalf("got: %+v", *v)
+	}
+}
+
+func TestArrayField(t *testing.T) {
+	type E struct{ N int }
+	type T struct {
+		A [3]int  `tagexpr:"{len:len($)}{idx:$[1]+$[2]}{out:$[3]}{at:at($,2)}{empty:coalesceAll($,'x')}"`
+		S []int   `tagexpr:"{len:len($)}{idx:$[1]+$[2]}{out:$[3]}{at:at($,2)}{empty:coalesceAll($,'x')}"`
+		P *[3]int `tagexpr:"{len:len($)}{idx:$[1]+$[2]}{out:$[3]}{at:at($,2)}"`
+		E [2]E    `tagexpr:"{idx:$[1].N}{cross:(A)$[0]+(S)$[0]}"`
+		Z [0]int  `tagexpr:"{len:len($)}{empty:coalesceAll($,'x')}"`
+	}
+	a := [3]int{1, 2, 3}
+	v := &T{A: a, S: a[:], P: &a, E: [2]E{{1}, {2}}}
+	var tests = map[string]interface{}{
+		"A@len": 3.0, "A@idx": 5.0, "A@out": nil, "A@at": 3.0, "A@empty": v.A,
+		"S@len": 3.0, "S@idx": 5.0, "S@out": nil, "S@at": 3.0, "S@empty": v.S,
+		"P@len": 3.0, "P@idx": 5.0, "P@out": nil, "P@at": 3.0,
+		"E@idx": 2.0, "E@cross": 2.0,
+		"Z@len": 0.0, "Z@empty": "x",
+	}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range tests {
+		if val := tagExpr.Eval(selector); !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestNaNComparison(t *testing.T) {
+	type T struct {
+		A float64 `tagexpr:"{lt:$<1}{eq:$==(A)$}{ne:$!=(A)$}{ok:(B)$>=1}"`
+		B float64
+	}
+	v := &T{A: math.NaN(), B: 1}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range map[string]interface{}{"A@lt": false, "A@eq": false, "A@ne": true, "A@ok": true} {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+	tagExpr, err = New("tagexpr").SetNaNComparison(NaNError).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"A@lt", "A@eq", "A@ne"} {
+		if _, ok := tagExpr.Eval(selector).(error); !ok {
+			t.Fatalf("selector: %q, want error, got: %v", selector, tagExpr.Eval(selector))
+		}
+	}
+	if val := tagExpr.Eval("A@ok"); val != true {
+		t.Fatalf("got: %v, want: true", val)
+	}
+}
+
+func TestRunSlice(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"{idx:index()}{cnt:count()}{notLast:index() < count() - 1}"`
+	}
+	items := []T{{}, {}, {}}
+	for _, slice := range []interface{}{items, []*T{{}, {}, {}}, &[3]T{}} {
+		tagExprs, err := New("tagexpr").RunSlice(slice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tagExprs) != 3 {
+			t.Fatalf("got %d elements, want 3", len(tagExprs))
+		}
+		for i, tagExpr := range tagExprs {
+			if r := tagExpr.Eval("A@idx"); r != float64(i) {
+				t.Fatalf("index: got: %v, want: %d", r, i)
+			}
+			if r := tagExpr.Eval("A@cnt"); r != 3.0 {
+				t.Fatalf("count: got: %v, want: 3", r)
+			}
+			if r := tagExpr.Eval("A@notLast"); r != (i < 2) {
+				t.Fatalf("notLast: got: %v, want: %v", r, i < 2)
+			}
+		}
+	}
+	// the elements of the same value do not share the cached results
+	tagExprs, err := New("tagexpr").SetResultCache(true).RunSlice([]T{{A: 1}, {A: 1}, {A: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tagExpr := range tagExprs {
+		if r := tagExpr.Eval("A@idx"); r != float64(i) {
+			t.Fatalf("cached index: got: %v, want: %d", r, i)
+		}
+		if r := tagExpr.Eval("A@notLast"); r != (i < 2) {
+			t.Fatalf("cached notLast: got: %v, want: %v", r, i < 2)
+		}
+	}
+	tagExpr, err := New("tagexpr").Run(&items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"A@idx", "A@cnt"} {
+		if _, ok := tagExpr.Eval(selector).(error); !ok {
+			t.Fatalf("selector: %q, want error, got: %v", selector, tagExpr.Eval(selector))
+		}
+	}
+	if _, err := New("tagexpr").RunSlice(items[0]); err == nil {
+		t.Fatal("want error for non-slice")
+	}
+	if _, err := New("tagexpr").RunSlice([3]T{}); err == nil {
+		t.Fatal("want error for array passed by value")
+	}
+}
+
+func TestParentIndex(t *testing.T) {
+	type Item struct {
+		Kind string `tagexpr:"{idx:parentIndex()}{head:parentIndex()!=0 || $=='header'}"`
+	}
+	type T struct {
+		Item
+		Sub struct {
+			N int `tagexpr:"parentIndex()"`
+		}
+	}
+	items := []T{{Item: Item{Kind: "header"}}, {Item: Item{Kind: "row"}}, {Item: Item{Kind: "header"}}}
+	tagExprs, err := New("tagexpr").RunSlice(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tagExpr := range tagExprs {
+		if r := tagExpr.Eval("Item.Kind@idx"); r != float64(i) {
+			t.Fatalf("element %d: got: %v", i, r)
+		}
+		if r := tagExpr.Eval("Sub.N@"); r != float64(i) {
+			t.Fatalf("element %d: nested: got: %v", i, r)
+		}
+		if r := tagExpr.Eval("Item.Kind@head"); r != true {
+			t.Fatalf("element %d: head: got: %v", i, r)
+		}
+	}
+	items[0].Kind = "row"
+	tagExprs, err = New("tagexpr").RunSlice(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExprs[0].Eval("Item.Kind@head"); r != false {
+		t.Fatalf("head: got: %v", r)
+	}
+	tagExpr, err := New("tagexpr").Run(&items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("Item.Kind@idx"); r != nil {
+		t.Fatalf("outside RunSlice: got: %v", r)
+	}
+}
+
+func TestExprTransform(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"@gt0"`
+		B int `tagexpr:"{pos:@gt0}{small:@gt0 && $<10}"`
+		C int `tagexpr:"@gt0"`
+	}
+	var calls = map[string]int{}
+	vm := New("tagexpr").SetExprTransform(func(raw string) string {
+		calls[raw]++
+		return strings.Replace(raw, "@gt0", "$ > 0", -1)
+	})
+	tagExpr, err := vm.Run(&T{A: 1, B: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = map[string]interface{}{"A@": true, "B@pos": true, "B@small": false, "C@": false}
+	for selector, value := range tests {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+	if calls["@gt0"] != 1 || calls["@gt0 && $<10"] != 1 {
+		t.Fatalf("want each unique expression transformed once, got: %v", calls)
+	}
+}
+
+func TestLookupTable(t *testing.T) {
+	type T struct {
+		Code   int    `tagexpr:"{text:lookup('httpStatusText', $)}{known:lookup('httpStatusText', $)!=''}"`
+		Color  string `tagexpr:"lookup('colors', $)"`
+		Status int    `tagexpr:"lookup('undefined', $)"`
+	}
+	vm := New("tagexpr").SetResultCache(true)
+	if err := vm.RegisterTable("httpStatusText", map[float64]string{200: "OK", 404: "Not Found"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterTable("colors", map[string]int{"red": 0xff0000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterTable("invalid", []string{}); err == nil {
+		t.Fatal("want error for non-map table")
+	}
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{Code: 404, Color: "red"}, map[string]interface{}{"Code@text": "Not Found", "Color@": float64(0xff0000)}},
+		{&T{Code: 500, Color: "blue"}, map[string]interface{}{"Code@text": nil, "Color@": nil}},
+	}
+	for _, c := range cases {
+		tagExpr, err := vm.Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+			}
+		}
+		if _, ok := tagExpr.Eval("Status@").(error); !ok {
+			t.Fatalf("want error for unregistered table, got: %v", tagExpr.Eval("Status@"))
+		}
+	}
+
+	// the replaced table applies to the later evaluations
+	if err := vm.RegisterTable("httpStatusText", map[float64]string{404: "Gone"}); err != nil {
+		t.Fatal(err)
+	}
+	tagExpr, err := vm.Run(&T{Code: 404})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := tagExpr.Eval("Code@text"); val != "Gone" {
+		t.Fatalf("after RegisterTable: got: %v, want: Gone", val)
+	}
+}
+
+func TestInOperator(t *testing.T) {
+	type T struct {
+		A int               `tagexpr:"{slice:$ in (S)$}{array:$ in (R)$}{map:$ not in (M)$}{idx:$ in (P)$[0]}"`
+		B string            `tagexpr:"{map:$ in (M)$}{literal:$ in ('x', (A)$)}"`
+		S []int64           `tagexpr:"$ not in ( 0, 9007199254740993 )"`
+		R [2]float32        `tagexpr:"len($) in (2)"`
+		M map[string]bool   `tagexpr:"'k' in $"`
+		P [][]int           `tagexpr:"$ in ($)"`
+		E []struct{ N int } `tagexpr:"(A)$ in $"`
+	}
+	v := &T{A: 2, B: "k", S: []int64{1, 2}, R: [2]float32{2, 3}, M: map[string]bool{"k": false}, P: [][]int{{3, 2}}, E: make([]struct{ N int }, 1)}
+	var tests = map[string]interface{}{
+		"A@slice": true, "A@array": true, "A@map": true, "A@idx": true,
+		"B@map": true, "B@literal": false,
+		"S@": true, "R@": true, "M@": true, "P@": false, "E@": false,
+	}
+	for _, vm := range []*VM{New("tagexpr"), New("tagexpr").SetIntegerMode(true)} {
+		tagExpr, err := vm.Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("integer mode: %v, selector: %q, got: %v, want: %v", vm.integerMode, selector, val, value)
+			}
+		}
+	}
+	tagExpr, err := New("tagexpr").SetIntegerMode(true).Run(&T{S: []int64{9007199254740992}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := tagExpr.Eval("S@"); val != true {
+		t.Fatalf("got: %v, want: true", val)
+	}
+	v.S = nil
+	addr, err := tagExpr.FieldAddr("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr.SetInt(3)
+	if val := tagExpr.Eval("A@slice"); val != false {
+		t.Fatalf("got: %v, want: false", val)
+	}
+}
+
+func TestBoxedReflectValue(t *testing.T) {
+	type U struct {
+		Name  string
+		Items []int
+	}
+	type T struct {
+		A interface{}   `tagexpr:"{name:$.Name}{item:$.Items[1]}{len:len($.Items)}"`
+		B reflect.Value `tagexpr:"{name:$.Name}{ptr:(A)$.Name==$.Name}"`
+		C interface{}   `tagexpr:"$+1"`
+		D interface{}   `tagexpr:"$"`
+	}
+	u := &U{Name: "x", Items: []int{1, 2}}
+	v := &T{A: reflect.ValueOf(*u), B: reflect.ValueOf(u), C: reflect.ValueOf(1), D: reflect.Value{}}
+	var tests = map[string]interface{}{
+		"A@name": "x", "A@item": 2.0, "A@len": 2.0,
+		"B@name": "x", "B@ptr": true,
+		"C@": 2.0, "D@": nil,
+	}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range tests {
+		if val := tagExpr.Eval(selector); !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestDurationUnit(t *testing.T) {
+	type T struct {
+		A int     `tagexpr:"{le1m:$ <= '1m'}{gt90s:$ > '90s'}{eq:'1m30s' == $}{str:$ < 'x'}"`
+		B float64 `tagexpr:"$ >= '1.5s'"`
+	}
+	var cases = []struct {
+		unit  time.Duration
+		v     *T
+		tests map[string]interface{}
+	}{
+		{time.Second, &T{A: 60, B: 1.5}, map[string]interface{}{"A@le1m": true, "A@gt90s": false, "A@eq": false, "A@str": false, "B@": true}},
+		{time.Second, &T{A: 90}, map[string]interface{}{"A@le1m": false, "A@gt90s": false, "A@eq": true, "B@": false}},
+		{time.Minute, &T{A: 2, B: 1}, map[string]interface{}{"A@le1m": false, "A@gt90s": true, "A@eq": false, "B@": true}},
+		{0, &T{A: 60}, map[string]interface{}{"A@le1m": false, "A@gt90s": true, "A@eq": false}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetDurationUnit(c.unit).Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("unit: %v, value: %+v, selector: %q, got: %v, want: %v", c.unit, *c.v, selector, val, value)
+			}
+		}
+	}
+	// the strings are compared as strings
+	type S struct {
+		A interface{} `tagexpr:"{eq:$ == 'b'}{lt:$ < '2m'}"`
+	}
+	tagExpr, err := New("tagexpr").SetDurationUnit(time.Second).Run(&S{A: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@eq"); r != true {
+		t.Fatalf("eq: got: %v", r)
+	}
+	if r := tagExpr.Eval("A@lt"); r != false {
+		t.Fatalf("lt: got: %v", r)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	type U struct {
+		City string `label:"City Name" tagexpr:"label()"`
+	}
+	type T struct {
+		Name  string `label:"User Name" tagexpr:"{label:label()}{msg:sprintf('%s is required', label())}"`
+		Email string `tagexpr:"label()"`
+		Note  string `label:"" tagexpr:"label()"`
+		Addr  U
+	}
+	var cases = []struct {
+		labelTag string
+		tests    map[string]interface{}
+	}{
+		{"label", map[string]interface{}{"Name@label": "User Name", "Name@msg": "User Name is required", "Email@": "Email", "Note@": "Note", "Addr.City@": "City Name"}},
+		{"", map[string]interface{}{"Name@label": "Name", "Email@": "Email", "Addr.City@": "City"}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetLabelTag(c.labelTag).Run(new(T))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("label tag: %q, selector: %q, got: %v, want: %v", c.labelTag, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestSelfTag(t *testing.T) {
+	type U struct {
+		Zip string `json:"zip" tagexpr:"selfTag('json')"`
+	}
+	type T struct {
+		UserName string `json:"user_name" tagexpr:"{snake:regexp('^[a-z]+(_[a-z]+)*$', selfTag('json'))}{name:selfTag('json')}"`
+		Email    string `json:"eMail" tagexpr:"regexp('^[a-z]+(_[a-z]+)*$', selfTag('json'))"`
+		Note     string `json:"" tagexpr:"{empty:selfTag('json')==''}{absent:selfTag('xml')==nil}"`
+		Addr     U
+	}
+	tagExpr, err := New("tagexpr").Run(new(T))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range map[string]interface{}{
+		"UserName@snake": true, "UserName@name": "user_name", "Email@": false,
+		"Note@empty": true, "Note@absent": true, "Addr.Zip@": "zip",
+	} {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	type T struct {
+		A int    `tagexpr:"$>0"`
+		B string `tagexpr:"{name:$+'!'}{len:len($)}"`
+		C int    `tagexpr:"(C@)$"`
+	}
+	tagExpr, err := New("tagexpr").Run(&T{A: 1, B: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A@: $>0 => true\n" +
+		"B@name: $+'!' => \"b!\"\n" +
+		"B@len: len($) => 1\n" +
+		"C@: (C@)$ => error: cyclic reference of the expression: C@\n"
+	if got := tagExpr.Summary(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestZeroIsNil(t *testing.T) {
+	type U struct {
+		Name string
+		Tags map[string]int
+	}
+	type T struct {
+		M map[string]*U `tagexpr:"{len:len($)}{name:$['a'].Name}{fmt:sprintf('%v', $)}"`
+		P *U            `tagexpr:"{name:$.Name}{tags:len($.Tags)}"`
+		U U             `tagexpr:"{tags:len($.Tags)}{tag:$.Tags['a']}"`
+	}
+	var cases = []struct {
+		zeroIsNil bool
+		tests     map[string]interface{}
+	}{
+		{false, map[string]interface{}{"M@len": 0.0, "M@name": nil, "M@fmt": "map[]", "P@name": nil, "P@tags": nil, "U@tags": 0.0, "U@tag": nil}},
+		{true, map[string]interface{}{"M@len": nil, "M@name": nil, "M@fmt": "<nil>", "P@name": nil, "P@tags": nil, "U@tags": nil, "U@tag": nil}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetZeroIsNil(c.zeroIsNil).Run(new(T))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("zeroIsNil: %v, selector: %q, got: %v, want: %v", c.zeroIsNil, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestEmptyStringIsNil(t *testing.T) {
+	type T struct {
+		S string            `tagexpr:"{eq:$==nil}{req:nil==$}{ne:$!=nil}{or:coalesceAll($, 'x')}{len:len($)}{fmt:sprintf('%v', $)}"`
+		M map[string]string `tagexpr:"{eq:nil==$['a']}{one:exactlyOne($['a'], $['b'])}"`
+		B string            `tagexpr:"nil==$"`
+	}
+	var cases = []struct {
+		emptyStringIsNil bool
+		tests            map[string]interface{}
+	}{
+		{false, map[string]interface{}{"S@eq": true, "S@req": false, "S@ne": false, "S@or": "x", "S@len": 0.0, "S@fmt": "", "M@eq": false, "M@one": true, "B@": false}},
+		{true, map[string]interface{}{"S@eq": true, "S@req": true, "S@ne": false, "S@or": "x", "S@len": nil, "S@fmt": "<nil>", "M@eq": true, "M@one": true, "B@": false}},
+	}
+	for _, c := range cases {
+		v := &T{M: map[string]string{"a": "", "b": "b"}, B: "b"}
+		tagExpr, err := New("tagexpr").SetEmptyStringIsNil(c.emptyStringIsNil).Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("emptyStringIsNil: %v, selector: %q, got: %v, want: %v", c.emptyStringIsNil, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	type T struct {
+		A int    `tagexpr:"{pos:$>0}{double:$*2}{div:$/(Z)$}{msg:sprintf('a=%v', $)}"`
+		S string `tagexpr:"len($)"`
+		Z int
+	}
+	tagExpr, err := New("tagexpr").SetIntegerMode(true).Run(&T{A: 3, S: "ab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	divErr, _ := tagExpr.Eval("A@div").(error)
+	diffs := tagExpr.Diff(map[string]interface{}{
+		"A@pos":    true,
+		"A@double": 6,
+		"A@msg":    "a=4",
+		"A@div":    divErr,
+		"S@":       3.0,
+		"Z@":       nil,
+		"X@":       false,
+	})
+	want := map[string]Diff{
+		"A@msg": {Expected: "a=4", Actual: "a=3"},
+		"S@":    {Expected: 3.0, Actual: 2.0},
+		"X@":    {Expected: false, Actual: nil},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("got: %v, want: %v", diffs, want)
+	}
+	if diffs = tagExpr.Diff(map[string]interface{}{"A@double": uint8(6), "A@div": fmt.Errorf("other")}); len(diffs) != 1 || !resultMatches(diffs["A@div"].Actual, divErr) {
+		t.Fatalf("got: %v", diffs)
+	}
+}
+
+func TestMaxFuncCalls(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"{three:$ |> regexpReplace('a', 'b') |> regexpReplace('b', 'c') |> len}{four:len($)+len($)+len($)+len($)}{short:len($)>9 && len($)+len($)+len($)>0}"`
+		B string `tagexpr:"(A@three)$+len($)"`
+	}
+	v := &T{A: "aa"}
+	var want = map[string]interface{}{"A@three": 2.0, "A@four": 8.0, "A@short": false, "B@": 2.0}
+	tagExpr, err := New("tagexpr").SetMaxFuncCalls(3).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"A@three", "A@short"} {
+		if val := tagExpr.Eval(selector); val != want[selector] {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, want[selector])
+		}
+	}
+	for _, selector := range []string{"A@four", "B@"} {
+		if _, ok := tagExpr.Eval(selector).(error); !ok {
+			t.Fatalf("selector: %q, want error, got: %v", selector, tagExpr.Eval(selector))
+		}
+	}
+	tagExpr, err = New("tagexpr").SetMaxFuncCalls(5).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range want {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+type syncMapper struct{ m sync.Map }
+
+func (s *syncMapper) Get(key interface{}) (interface{}, bool) { return s.m.Load(key) }
+
+type upperMapper map[string]string
+
+func (u upperMapper) Get(key interface{}) (interface{}, bool) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, false
+	}
+	v, ok := u[strings.ToUpper(k)]
+	return v, ok
+}
+
+func TestMapper(t *testing.T) {
+	type U struct{ Name string }
+	type T struct {
+		S *syncMapper `tagexpr:"{str:$['a']}{num:$['n']+1}{elem:$['u'].Name}{miss:$['x']}{idx:$[1]}"`
+		U upperMapper `tagexpr:"{hit:$['k']}{miss:$['x']}"`
+		I interface{} `tagexpr:"$['k']"`
+		N *syncMapper `tagexpr:"$['a']"`
+		V syncMapper  `tagexpr:"$['a']"`
+	}
+	sm := new(syncMapper)
+	sm.m.Store("a", "x")
+	sm.m.Store("n", 2)
+	sm.m.Store("u", &U{Name: "y"})
+	sm.m.Store(1.0, true)
+	v := &T{S: sm, U: upperMapper{"K": "v"}, I: upperMapper{"K": "w"}}
+	v.V.m.Store("a", "z")
+	var tests = map[string]interface{}{
+		"S@str": "x", "S@num": 3.0, "S@elem": "y", "S@miss": nil, "S@idx": true,
+		"U@hit": "v", "U@miss": nil,
+		"I@": "w", "N@": nil, "V@": "z",
+	}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range tests {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestRoundingMode(t *testing.T) {
+	type T struct {
+		A float64 `tagexpr:"{int:$}{neg:0-$}{idx:(S)$[$]}{at:at((S)$,$)}{rem:7.5%$}"`
+		S []string
+	}
+	var cases = []struct {
+		mode  RoundingMode
+		a     float64
+		ints  map[string]int64
+		tests map[string]interface{}
+	}{
+		{RoundTruncate, 2.5, map[string]int64{"A@int": 2, "A@neg": -2}, map[string]interface{}{"A@idx": "c", "A@at": "c", "A@rem": 1.0}},
+		{RoundHalfUp, 2.5, map[string]int64{"A@int": 3, "A@neg": -3}, map[string]interface{}{"A@idx": "d", "A@at": "d", "A@rem": 2.0}},
+		{RoundHalfEven, 2.5, map[string]int64{"A@int": 2, "A@neg": -2}, map[string]interface{}{"A@idx": "c", "A@at": "c", "A@rem": 0.0}},
+		{RoundHalfEven, 1.5, map[string]int64{"A@int": 2, "A@neg": -2}, map[string]interface{}{"A@idx": "c", "A@at": "c", "A@rem": 0.0}},
+		{RoundTruncate, 0.5, map[string]int64{"A@int": 0}, map[string]interface{}{"A@idx": "a", "A@rem": math.NaN()}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetRoundingMode(c.mode).Run(&T{A: c.a, S: []string{"a", "b", "c", "d"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.ints {
+			if val := tagExpr.EvalInt(selector); val != value {
+				t.Fatalf("mode: %d, a: %v, selector: %q, got: %v, want: %v", c.mode, c.a, selector, val, value)
+			}
+		}
+		for selector, value := range c.tests {
+			val := tagExpr.Eval(selector)
+			if f, ok := value.(float64); ok && math.IsNaN(f) {
+				if f, ok := val.(float64); ok && math.IsNaN(f) {
+					continue
+				}
+			}
+			if val != value {
+				t.Fatalf("mode: %d, a: %v, selector: %q, got: %v, want: %v", c.mode, c.a, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	type T struct {
+		A int    `tagexpr:"$ > 0 && $ < 10"`
+		B string `tagexpr:"!(len((S)$[0]) in (1, 2)) || regexp('^b', $)"`
+		S []string
+	}
+	v := &T{A: 5, B: "b", S: []string{"xy"}}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A@: $ > 0 && $ < 10 => true\n" +
+		"  && => true\n" +
+		"    > => true\n" +
+		"      $ => 5\n" +
+		"      0 => 0\n" +
+		"    < => true\n" +
+		"      $ => 5\n" +
+		"      10 => 10\n"
+	if got := tagExpr.Explain("A@"); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	want = "B@: !(len((S)$[0]) in (1, 2)) || regexp('^b', $) => true\n" +
+		"  || => true\n" +
+		"    !() => false\n" +
+		"      in => true\n" +
+		"        len() => 2\n" +
+		"          (S)$[0] => \"xy\"\n" +
+		"        (,) => [1 2]\n" +
+		"          1 => 1\n" +
+		"          2 => 2\n" +
+		"    regexp() => true\n" +
+		"      $ => \"b\"\n"
+	if got := tagExpr.Explain("B@"); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := tagExpr.Explain("X@"); got != "" {
+		t.Fatalf("got: %q, want empty", got)
+	}
+
+	// the evaluations after Explain read the current field values
+	if tagExpr.values != nil || tagExpr.sets != nil {
+		t.Fatalf("the resolved values outlive Explain: %v, %v", tagExpr.values, tagExpr.sets)
+	}
+	v.B, v.S = "a", []string{"x"}
+	if r := tagExpr.Eval("B@"); r != false {
+		t.Fatalf("after the change: got: %v", r)
+	}
+}
+
+func TestMutuallyExclusive(t *testing.T) {
+	type U struct{ N int }
+	type T struct {
+		A string `tagexpr:"{me:mutuallyExclusive($, (B)$, (C)$, (D)$)}{one:exactlyOne($, (B)$, (C)$, (D)$)}"`
+		B *int
+		C []int
+		D U
+	}
+	one := 1
+	var cases = []struct {
+		v       *T
+		me, one bool
+	}{
+		{&T{}, true, false},
+		{&T{A: "a"}, true, true},
+		{&T{B: &one}, true, true},
+		{&T{C: []int{}}, true, false},
+		{&T{D: U{1}}, true, true},
+		{&T{A: "a", C: []int{1}}, false, false},
+		{&T{A: "a", B: &one, D: U{1}}, false, false},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := tagExpr.Eval("A@me"); r != c.me {
+			t.Fatalf("mutuallyExclusive %+v: got: %v, want: %v", *c.v, r, c.me)
+		}
+		if r := tagExpr.Eval("A@one"); r != c.one {
+			t.Fatalf("exactlyOne %+v: got: %v, want: %v", *c.v, r, c.one)
+		}
+	}
+}
+
+func TestChanFuncField(t *testing.T) {
+	type T struct {
+		C chan int    `tagexpr:"{len:len($)}{nil:$==nil}{set:$!=nil}"`
+		F func()      `tagexpr:"{nil:$==nil}{set:$!=nil}{gt:$>1}{add:$+1}"`
+		M map[int]int `tagexpr:"{nil:nil==$}"`
+	}
+	c := make(chan int, 3)
+	c <- 1
+	c <- 2
+	tagExpr, err := New("tagexpr").Run(&T{C: c, F: func() {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"C@len": 2.0, "C@nil": false, "C@set": true,
+		"F@nil": false, "F@set": true,
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	for _, k := range []string{"F@gt", "F@add"} {
+		if _, ok := tagExpr.Eval(k).(error); !ok {
+			t.Fatalf("%s: expect an error, got: %v", k, tagExpr.Eval(k))
+		}
+	}
+	tagExpr, err = New("tagexpr").Run(&T{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"C@nil": true, "C@set": false,
+		"F@nil": true, "F@set": false,
+		"M@nil": true,
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+}
+
+func TestStrictFunctionArgs(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"{at:at($, 'x', 'n/a')}{digit:isDigit(len($))}"`
+		B *int   `tagexpr:"{digit:isDigit()}"`
+	}
+	for _, strict := range []bool{false, true} {
+		tagExpr, err := New("tagexpr").SetStrictFunctionArgs(strict).Run(&T{A: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range map[string]string{
+			"A@at":    "at: argument 2 expects number, got string",
+			"A@digit": "isDigit: argument 1 expects string, got number",
+		} {
+			r := tagExpr.Eval(k)
+			if !strict {
+				if _, ok := r.(error); ok {
+					t.Fatalf("%s: unexpected error: %v", k, r)
+				}
+				continue
+			}
+			if err, ok := r.(error); !ok || err.Error() != want {
+				t.Fatalf("%s: got: %v, want: %s", k, r, want)
+			}
+		}
+		if r := tagExpr.Eval("B@digit"); r != nil {
+			t.Fatalf("B@digit: got: %v, want: nil", r)
+		}
+	}
+}
+
+func TestFindFirst(t *testing.T) {
+	type T struct {
+		A []int `tagexpr:"{first:findFirst($, '# > 10')}{le:findFirst($, '#<=(B)$')}"`
+		B int
+		D [2]string `tagexpr:"findFirst($, 'len(#) > 1')"`
+	}
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{A: []int{3, 12, 20}, B: 3, D: [2]string{"a", "bc"}},
+			map[string]interface{}{"A@first": 12.0, "A@le": 3.0, "D@": "bc"}},
+		{&T{A: []int{3, 5}, B: 2, D: [2]string{"a", "b"}},
+			map[string]interface{}{"A@first": nil, "A@le": nil, "D@": nil}},
+		{&T{A: []int{}}, map[string]interface{}{"A@first": nil, "A@le": nil}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%s: got: %v, want: %v", k, r, want)
+			}
+		}
+	}
+}
+
+func TestUniqueBy(t *testing.T) {
+	type Item struct {
+		ID    int
+		Name  string
+		Owner *struct{ ID string }
+	}
+	type T struct {
+		A []Item  `tagexpr:"{id:uniqueBy($, '#.ID')}{name:uniqueBy($, '# .Name')}{owner:uniqueBy($, '#.Owner.ID')}{bad:uniqueBy($, '#.X')}"`
+		B []int   `tagexpr:"uniqueBy($, '# % 10')"`
+		C []*Item `tagexpr:"uniqueBy($, '#.ID')"`
+		D string  `tagexpr:"uniqueBy($, '#')"`
+	}
+	owner := &struct{ ID string }{ID: "x"}
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{A: []Item{{ID: 1, Name: "a"}, {ID: 2, Name: "b", Owner: owner}}, B: []int{1, 2}, C: []*Item{{ID: 1}, {ID: 2}}},
+			map[string]interface{}{"A@id": true, "A@name": true, "A@owner": true, "B@": true, "C@": true, "D@": nil}},
+		{&T{A: []Item{{ID: 1, Name: "a", Owner: owner}, {ID: 1, Name: "a", Owner: owner}}, B: []int{1, 11}, C: []*Item{{ID: 1}, {ID: 1}}},
+			map[string]interface{}{"A@id": false, "A@name": false, "A@owner": false, "B@": false, "C@": false}},
+		{&T{}, map[string]interface{}{"A@id": true, "B@": true, "C@": true}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%s: got: %v, want: %v", k, r, want)
+			}
+		}
+	}
+	tagExpr, err := New("tagexpr").Run(&T{A: []Item{{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tagExpr.Eval("A@bad").(error); !ok {
+		t.Fatalf("A@bad: want error, got: %v", tagExpr.Eval("A@bad"))
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	type Item struct {
+		ID    int
+		Price float64
+	}
+	type T struct {
+		A   []int           `tagexpr:"{any:any($, #v>0)}{all:all($, #v>0)}{sum:sum()}{filter:len(filter($, #v>1))}{key:sum(filter($, #k>=1))}{quoted:any($, '# > 2')}"`
+		B   []string        `tagexpr:"all($, regexp('^\\w+@\\w+$', #v))"`
+		C   map[string]int  `tagexpr:"{keys:all($, len(#k)==1)}{sum:sum($)}{filter:len(filter($, #v>1))}"`
+		D   []Item          `tagexpr:"{total:sum($, #v.Price)}{valid:all($, #v.ID>0 && #v.Price<(Max)$)}"`
+		E   [2][]int        `tagexpr:"any($, any(#v, #v==0))"`
+		F   string          `tagexpr:"{all:all($, #v)}{sum:sum($)}"`
+		G   map[int]float64 `tagexpr:"sum(filter($, #k%2==0))"`
+		Max float64
+	}
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{
+			A: []int{1, 2, 3}, B: []string{"a@b", "c@d"}, C: map[string]int{"a": 1, "b": 2},
+			D: []Item{{1, 1.5}, {2, 2.25}}, E: [2][]int{{1}, {2, 0}}, G: map[int]float64{1: 1, 2: 2, 4: 4}, Max: 3,
+		}, map[string]interface{}{
+			"A@any": true, "A@all": true, "A@sum": 6.0, "A@filter": 2.0, "A@key": 5.0, "A@quoted": true,
+			"B@": true, "C@keys": true, "C@sum": 3.0, "C@filter": 1.0,
+			"D@total": 3.75, "D@valid": true, "E@": true, "F@all": nil, "F@sum": nil, "G@": 6.0,
+		}},
+		{&T{
+			A: []int{-1, 0}, B: []string{"a@b", "c"}, C: map[string]int{"ab": 1},
+			D: []Item{{0, 1}}, E: [2][]int{{1}, {2}}, Max: 3,
+		}, map[string]interface{}{
+			"A@any": false, "A@all": false, "A@sum": -1.0, "A@filter": 0.0, "A@key": 0.0, "A@quoted": false,
+			"B@": false, "C@keys": false, "C@sum": 1.0, "D@total": 1.0, "D@valid": false, "E@": false,
+		}},
+		{&T{}, map[string]interface{}{
+			"A@any": false, "A@all": true, "A@sum": 0.0, "A@filter": 0.0, "C@keys": true, "C@sum": 0.0, "D@total": 0.0,
+		}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%s: got: %v, want: %v", k, r, want)
+			}
+		}
+	}
+	tagExpr, err := New("tagexpr").SetIntegerMode(true).Run(&struct {
+		A []int64 `tagexpr:"{sum:sum($)}{filter:filter($, #v>1)}"`
+	}{A: []int64{1 << 62, 1 << 62, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@sum"); r != int64(math.MaxInt64) {
+		t.Fatalf("saturated sum: got: %v", r)
+	}
+	if r, _ := tagExpr.Eval("A@filter").([]int64); !reflect.DeepEqual(r, []int64{1 << 62, 1 << 62}) {
+		t.Fatalf("filter: got: %v", tagExpr.Eval("A@filter"))
+	}
+}
+
+func TestTake(t *testing.T) {
+	type T struct {
+		A []int    `tagexpr:"{first:at(take($, (N)$), 0)}{last:at(takeLast($, (N)$), 0)}{len:len(take($, (N)$))}{lastLen:len(takeLast($, (N)$))}"`
+		B [3]int   `tagexpr:"{last:at(takeLast($, 2), 1)}{big:findFirst(take($, 2), '# > 2')}"`
+		C []string `tagexpr:"{zero:len(take($, 0))}{neg:len(takeLast($, -1))}"`
+		D int      `tagexpr:"take($, 1)"`
+		N int
+	}
+	var cases = []struct {
+		n     int
+		tests map[string]interface{}
+	}{
+		{2, map[string]interface{}{"A@first": 1.0, "A@last": 3.0, "A@len": 2.0, "A@lastLen": 2.0}},
+		{4, map[string]interface{}{"A@first": 1.0, "A@last": 1.0, "A@len": 4.0, "A@lastLen": 4.0}},
+		{6, map[string]interface{}{"A@first": 1.0, "A@last": 1.0, "A@len": 4.0, "A@lastLen": 4.0}},
+	}
+	vm := New("tagexpr")
+	for _, c := range cases {
+		v := &T{A: []int{1, 2, 3, 4}, B: [3]int{1, 2, 3}, C: []string{"a"}, N: c.n}
+		tagExpr, err := vm.Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("n=%d %s: got: %v, want: %v", c.n, k, r, want)
+			}
+		}
+		for k, want := range map[string]interface{}{"B@last": 3.0, "B@big": nil, "C@zero": 0.0, "C@neg": 0.0, "D@": nil} {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%s: got: %v, want: %v", k, r, want)
+			}
+		}
+	}
+}
+
+func TestBigNumber(t *testing.T) {
+	type T struct {
+		A *big.Int   `tagexpr:"{eq:$==123456789012345678901234567890}{gt:$>123456789012345678901234567889}{add:$+1}{mul:$*(B)$}{div:$/2}"`
+		B *big.Float `tagexpr:"{add:$+0.25}{lt:$<(A)$}{div:$/4}"`
+		C *big.Int   `tagexpr:"{nil:$==nil}"`
+	}
+	a, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	v := &T{A: a, B: big.NewFloat(2)}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"A@eq", "A@gt", "B@lt", "C@nil"} {
+		if r := tagExpr.Eval(k); r != true {
+			t.Fatalf("%s: got: %v, want: true", k, r)
+		}
+	}
+	for k, want := range map[string]string{
+		"A@add": "123456789012345678901234567891",
+		"A@mul": "246913578024691357802469135780",
+		"A@div": "61728394506172839450617283945",
+		"B@add": "2.25",
+		"B@div": "0.5",
+	} {
+		r := tagExpr.Eval(k)
+		var s string
+		switch x := r.(type) {
+		case *big.Int:
+			s = x.String()
+		case *big.Float:
+			s = x.Text('f', -1)
+		}
+		if s != want {
+			t.Fatalf("%s: got: %v, want: %s", k, r, want)
+		}
+	}
+	if a.String() != "123456789012345678901234567890" {
+		t.Fatalf("the field value is modified: %s", a)
+	}
+
+	// the large integral literals are float64, and they are compared and calculated with the big numbers exactly
+	type U struct {
+		A int64    `tagexpr:"{v:9007199254740993}{eq:$==9007199254740993}{ne:$==9007199254740992}{lit:9007199254740993>9007199254740992}"`
+		B *big.Int `tagexpr:"{add:$+9007199254740993}"`
+	}
+	u := &U{A: 9007199254740993, B: big.NewInt(1)}
+	tagExpr, err = New("tagexpr").Run(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@v"); r != 9007199254740992.0 {
+		t.Fatalf("A@v: got: %T %v, want: float64", r, r)
+	}
+	if r := tagExpr.EvalFloat("A@v"); r != 9007199254740992 {
+		t.Fatalf("EvalFloat: got: %v", r)
+	}
+	for k, want := range map[string]interface{}{"A@eq": true, "A@ne": false, "A@lit": true} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	if r, ok := tagExpr.Eval("B@add").(*big.Int); !ok || r.String() != "9007199254740994" {
+		t.Fatalf("B@add: got: %v", tagExpr.Eval("B@add"))
+	}
+}
+
+func TestUnknownFieldValue(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"{missing:(Missing)$}{sub:(A.B)$}{add:(Missing)$+1}{known:$}"`
+	}
+	var cases = []struct {
+		value interface{}
+		tests map[string]interface{}
+	}{
+		{nil, map[string]interface{}{"A@missing": nil, "A@sub": nil, "A@add": 1.0, "A@known": 2.0}},
+		{"", map[string]interface{}{"A@missing": "", "A@sub": "", "A@add": "", "A@known": 2.0}},
+		{10, map[string]interface{}{"A@missing": 10.0, "A@sub": 10.0, "A@add": 11.0, "A@known": 2.0}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetUnknownFieldValue(c.value).Run(&T{A: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%v %s: got: %v, want: %v", c.value, k, r, want)
+			}
+		}
+	}
+}
+
+func TestBatchRun(t *testing.T) {
+	type A struct {
+		X int `tagexpr:"$>0"`
+	}
+	type B struct {
+		S string `tagexpr:"len($)>1"`
+	}
+	values := make([]interface{}, 0, 100)
+	for i := 0; i < 48; i++ {
+		values = append(values, &A{X: i % 2}, &B{S: strconv.Itoa(i)})
+	}
+	values = append(values, nil, 1, A{}, &[]int{})
+	vm := New("tagexpr").SetBatchWorkers(4)
+	tagExprs, errs := vm.BatchRun(values)
+	if len(tagExprs) != len(values) || len(errs) != len(values) {
+		t.Fatalf("got %d results and %d errors, want %d", len(tagExprs), len(errs), len(values))
+	}
+	for i, v := range values {
+		if i >= 96 {
+			if errs[i] == nil || tagExprs[i] != nil {
+				t.Fatalf("%d: expect an error, got: %v", i, tagExprs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("%d: %v", i, errs[i])
+		}
+		var r, want interface{}
+		switch x := v.(type) {
+		case *A:
+			r, want = tagExprs[i].Eval("X@"), x.X > 0
+		case *B:
+			r, want = tagExprs[i].Eval("S@"), len(x.S) > 1
+		}
+		if r != want {
+			t.Fatalf("%d: got: %v, want: %v", i, r, want)
+		}
+	}
+	if tagExprs, errs = New("tagexpr").BatchRun(nil); len(tagExprs) != 0 || len(errs) != 0 {
+		t.Fatalf("got: %v, %v", tagExprs, errs)
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	type U struct {
+		Y string `tagexpr:"len($)>0"`
+	}
+	type T struct {
+		X int `tagexpr:"$%2==0"`
+		U U
+	}
+	vm := New("tagexpr").SetResultCache(true).SetMaxConcurrency(2)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tagExpr, err := vm.Run(&T{X: i + g, U: U{Y: "y"}})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if r := tagExpr.Eval("X@"); r != ((i+g)%2 == 0) || tagExpr.Eval("U.Y@") != true {
+					errs <- fmt.Errorf("%d: got: %v", i+g, r)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	values := make([]interface{}, 10)
+	for i := range values {
+		values[i] = &T{X: i}
+	}
+	tagExprs, batchErrs := vm.SetBatchWorkers(8).BatchRun(values)
+	for i := range values {
+		if batchErrs[i] != nil || tagExprs[i].Eval("X@") != (i%2 == 0) {
+			t.Fatalf("%d: got: %v, %v", i, tagExprs[i], batchErrs[i])
+		}
+	}
+}
+
+func TestEvalConcurrently(t *testing.T) {
+	type T struct {
+		A []int `tagexpr:"{total:$[0]+$[1]}"`
+		B int   `tagexpr:"{@:(A@total)$<=$}{in:$ in (S)$}{any:any((S)$, #v>(A)$[0])}"`
+		S []int
+	}
+	// the TagExpr does not keep the struct alive
+	v := &T{A: []int{1, 2}, B: 3, S: []int{3, 4}}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				for selector, want := range map[string]interface{}{"A@total": 3.0, "B@": true, "B@in": true, "B@any": true} {
+					if r := tagExpr.Eval(selector); r != want {
+						errs <- fmt.Errorf("%s: got: %v, want: %v", selector, r, want)
+						return
+					}
+				}
+				tagExpr.Range(func(selector string, eval func() interface{}) bool {
+					if _, ok := eval().(error); ok {
+						errs <- fmt.Errorf("%s: got: %v", selector, eval())
+						return false
+					}
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	runtime.KeepAlive(v)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	err := RegisterFunc("between", func(args ...interface{}) interface{} {
+		if len(args) != 3 {
+			return nil
+		}
+		v, _ := args[0].(float64)
+		min, _ := args[1].(float64)
+		max, _ := args[2].(float64)
+		return v >= min && v <= max
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterFunc("joinDash", func(args ...interface{}) interface{} {
+		var a []string
+		for _, arg := range args {
+			a = append(a, fmt.Sprint(arg))
+		}
+		return strings.Join(a, "-")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterFunc("width", func(args ...interface{}) interface{} { return len(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"len", "regexp", "isDigit", "true", "nil", "in", "", "1a", "a-b", "a("} {
+		if err := RegisterFunc(name, func(args ...interface{}) interface{} { return nil }); err == nil {
+			t.Fatalf("%q: expect an error", name)
+		}
+	}
+	type T struct {
+		A int    `tagexpr:"{in:between($, 1, 10)}{nested:between(len(joinDash($, (B)$)), 1+1, 3)}{empty:width()}"`
+		B string `tagexpr:"joinDash($, (A)$, true) == 'x-5-true'"`
+	}
+	tagExpr, err := New("tagexpr").Run(&T{A: 5, B: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"A@in": true, "A@nested": true, "A@empty": 0.0, "B@": true,
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	type U struct {
+		A int `tagexpr:"nope($) > 1"`
+	}
+	_, err = New("tagexpr").Run(&U{})
+	if err == nil || !strings.Contains(err.Error(), `undefined function "nope"`) {
+		t.Fatalf("got: %v", err)
+	}
+
+	// the results of the registered functions are not cached
+	var calls int
+	err = RegisterFunc("countCalls", func(args ...interface{}) interface{} {
+		calls++
+		return calls
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type V struct {
+		A int `tagexpr:"countCalls($)"`
+	}
+	tagExpr, err = New("tagexpr").SetResultCache(true).Run(&V{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1, r2 := tagExpr.Eval("A@"), tagExpr.Eval("A@"); r1 != 1.0 || r2 != 2.0 {
+		t.Fatalf("got: %v, %v, want: 1, 2", r1, r2)
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"{f:rand()}{i:randInt($)}{sample:rand() < 0.5}{bad:randInt(0)}"`
+	}
+	eval := func(seed int64) []interface{} {
+		tagExpr, err := New("tagexpr").SetRandSource(rand.NewSource(seed)).Run(&T{A: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []interface{}
+		for i := 0; i < 5; i++ {
+			r = append(r, tagExpr.Eval("A@f"), tagExpr.Eval("A@i"), tagExpr.Eval("A@sample"))
+		}
+		if v := tagExpr.Eval("A@bad"); v != nil {
+			t.Fatalf("randInt(0): got: %v, want: nil", v)
+		}
+		return r
+	}
+	r := eval(1)
+	if !reflect.DeepEqual(r, eval(1)) {
+		t.Fatalf("not deterministic: %v", r)
+	}
+	src := rand.New(rand.NewSource(1))
+	for i := 0; i < 5; i++ {
+		f, n := src.Float64(), float64(src.Intn(10))
+		if r[3*i] != f || r[3*i+1] != n || r[3*i+2] != (src.Float64() < 0.5) {
+			t.Fatalf("%d: got: %v, want: %v %v", i, r[3*i:3*i+3], f, n)
+		}
+	}
+	if reflect.DeepEqual(r, eval(2)) {
+		t.Fatalf("the seed is ignored: %v", r)
+	}
+}
+
+func TestFieldValueHook(t *testing.T) {
+	type U struct {
+		C string
+	}
+	type T struct {
+		A string `tagexpr:"{eq:$=='abc'}{len:len($)}{ref:(B.C)$==$}"`
+		B U
+		N int `tagexpr:"$==2"`
+	}
+	var paths []string
+	vm := New("tagexpr").SetFieldValueHook(func(path string, v interface{}) interface{} {
+		paths = append(paths, path)
+		if s, ok := v.(string); ok {
+			return strings.ToLower(strings.TrimSpace(s))
+		}
+		return v
+	})
+	tagExpr, err := vm.Run(&T{A: "  ABC ", B: U{C: "Abc"}, N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"A@eq": true, "A@len": 3.0, "A@ref": true, "N@": true,
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	if !strings.Contains(strings.Join(paths, ","), "B.C") {
+		t.Fatalf("paths: %v", paths)
+	}
+	tagExpr, err = New("tagexpr").Run(&T{A: "  ABC "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@eq"); r != false {
+		t.Fatalf("without hook: got: %v, want: false", r)
+	}
+}
+
+func TestCondExpr(t *testing.T) {
+	type T struct {
+		A bool
+		B []int  `tagexpr:"{pick:(A)$ ? $[0] : $[1]}{lazy:len($) > 5 ? $[5] + 1 : -1}"`
+		C string `tagexpr:"{max:len($) <= ((A)$ ? 3 : 5)}{nested:!(A)$ ? (len($) > 4 ? 'long' : 'short') : 'any'}"`
+	}
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{A: true, B: []int{1, 2}, C: "abcd"},
+			map[string]interface{}{"B@pick": 1.0, "B@lazy": -1.0, "C@max": false, "C@nested": "any"}},
+		{&T{B: []int{1, 2}, C: "abcd"},
+			map[string]interface{}{"B@pick": 2.0, "B@lazy": -1.0, "C@max": true, "C@nested": "short"}},
+		{&T{B: []int{1, 2, 3, 4, 5, 6}, C: "abcde"},
+			map[string]interface{}{"B@pick": 2.0, "B@lazy": 7.0, "C@max": true, "C@nested": "long"}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%+v %s: got: %v, want: %v", *c.v, k, r, want)
+			}
+		}
+	}
+	tokens, err := New("").Tokens("$ ? 1 : 2")
+	if err != nil || len(tokens) != 5 || tokens[1].Text != "?" || tokens[3].Text != ":" {
+		t.Fatalf("tokens: %v, %v", tokens, err)
+	}
+}
+
+func TestAllValid(t *testing.T) {
+	type U struct {
+		N int `tagexpr:"$>0"`
+	}
+	type T struct {
+		A int    `tagexpr:"{pos:$>0}{num:$+1}"`
+		B string `tagexpr:"{len:len($)>1}{name:$}"`
+		U U
+	}
+	vm := New("tagexpr")
+	var cases = []struct {
+		v     interface{}
+		valid bool
+	}{
+		{&T{A: 1, B: "ab", U: U{N: 1}}, true},
+		{&T{A: 0, B: "ab", U: U{N: 1}}, false},
+		{&T{A: 1, B: "a", U: U{N: 1}}, false},
+		{&T{A: 1, B: "ab"}, false},
+	}
+	for _, c := range cases {
+		valid, err := vm.AllValid(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != c.valid {
+			t.Fatalf("%+v: got: %v, want: %v", c.v, valid, c.valid)
+		}
+	}
+	type E struct {
+		A int `tagexpr:"$/0==1"`
+	}
+	if valid, err := New("tagexpr").SetIntegerMode(true).AllValid(&E{}); valid || err == nil {
+		t.Fatalf("got: %v, %v", valid, err)
+	}
+	if _, err := vm.AllValid(1); err == nil {
+		t.Fatal("expect an error")
+	}
+}
+
+type testStatus int
+
+func TestRegisterEnumType(t *testing.T) {
+	type T struct {
+		A testStatus  `tagexpr:"{active:$=='Active'}{not:'Banned'!=$}{unknown:$=='Unknown'}"`
+		B *testStatus `tagexpr:"{eq:$==(A)$}{active:($)=='Active'}"`
+		C testStatus
+		D int    `tagexpr:"$=='Active'"`
+		E string `tagexpr:"(C)$=='Banned'"`
+	}
+	for _, integerMode := range []bool{false, true} {
+		vm := New("tagexpr").SetIntegerMode(integerMode)
+		if err := vm.RegisterEnumType(reflect.TypeOf(testStatus(0)), map[string]int64{"Active": 1, "Banned": 2}); err != nil {
+			t.Fatal(err)
+		}
+		b := testStatus(1)
+		tagExpr, err := vm.Run(&T{A: 1, B: &b, C: 2, D: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range map[string]interface{}{
+			"A@active": true, "A@not": true, "A@unknown": false,
+			"B@eq": true, "B@active": true, "D@": false, "E@": true,
+		} {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("integer mode %v, %s: got: %v, want: %v", integerMode, k, r, want)
+			}
+		}
+	}
+	if err := New("tagexpr").RegisterEnumType(reflect.TypeOf(""), nil); err == nil {
+		t.Fatal("expect an error")
+	}
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	type T struct {
+		A int64 `tagexpr:"{add:$+(B)$}{sub:(C)$-$}{mul:$*2}{neg:(C)$*$}{div:(C)$/(D)$}{ok:$+(D)$}"`
+		B int64
+		C int64
+		D int64
+	}
+	v := &T{A: math.MaxInt64, B: 1, C: math.MinInt64, D: -1}
+	tagExpr, err := New("tagexpr").SetIntegerMode(true).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"A@add": int64(math.MaxInt64),
+		"A@sub": int64(math.MinInt64),
+		"A@mul": int64(math.MaxInt64),
+		"A@neg": int64(math.MinInt64),
+		"A@div": int64(math.MaxInt64),
+		"A@ok":  int64(math.MaxInt64 - 1),
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	tagExpr, err = New("tagexpr").SetIntegerMode(true).SetIntegerOverflow(OverflowError).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"A@add", "A@sub", "A@mul", "A@neg", "A@div"} {
+		if _, ok := tagExpr.Eval(k).(error); !ok {
+			t.Fatalf("%s: expect an error, got: %v", k, tagExpr.Eval(k))
+		}
+	}
+	if r := tagExpr.Eval("A@ok"); r != int64(math.MaxInt64-1) {
+		t.Fatalf("A@ok: got: %v", r)
+	}
+}
+
+func TestOperatorAliases(t *testing.T) {
+	type T struct {
+		A   int    `tagexpr:"{range:$ gt 0 AND $ lt 10}{not:NOT ($ gt 0)}{or:$ lt 0 OR (AND)$ eq 3}{str:'a AND b' + sprintf('%v', NOT true)}"`
+		AND int    `tagexpr:"$ in (1, 3)"`
+		B   string `tagexpr:"regexp('^gt$') AND $ ne 'lt'"`
+	}
+	vm := New("tagexpr").SetOperatorAliases(map[string]string{
+		"AND": "&&", "OR": "||", "NOT": "!", "gt": ">", "lt": "<", "eq": "==", "ne": "!=",
+	})
+	var cases = []struct {
+		v     *T
+		tests map[string]interface{}
+	}{
+		{&T{A: 5, AND: 3, B: "gt"}, map[string]interface{}{
+			"A@range": true, "A@not": false, "A@or": true, "A@str": "a AND bfalse", "AND@": true, "B@": true}},
+		{&T{A: 10, AND: 2, B: "lt"}, map[string]interface{}{
+			"A@range": false, "A@not": false, "A@or": false, "AND@": false, "B@": false}},
+		{&T{A: 0}, map[string]interface{}{"A@range": false, "A@not": true}},
+	}
+	for _, c := range cases {
+		tagExpr, err := vm.Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range c.tests {
+			if r := tagExpr.Eval(k); r != want {
+				t.Fatalf("%s: got: %v, want: %v", k, r, want)
+			}
+		}
+	}
+	// the words are not operators without the aliases or out of the operator position
+	if _, err := New("tagexpr").Run(&T{}); err == nil {
+		t.Fatal("want syntax error without the aliases")
+	}
+	if _, err := vm.Run(&struct {
+		A int `tagexpr:"$ AND AND 1"`
+	}{}); err == nil {
+		t.Fatal("want syntax error for the successive binary aliases")
+	}
+	tokens, err := vm.Tokens("$ gt 0 AND NOT (B)$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, token := range tokens {
+		if token.Kind == TokenOperator {
+			texts = append(texts, token.Text)
+		}
+	}
+	if want := []string{"gt", "AND", "NOT"}; !reflect.DeepEqual(texts, want) {
+		t.Fatalf("operator tokens: got: %q, want: %q", texts, want)
+	}
+}
+
+func TestExpressionAliases(t *testing.T) {
+	vm := New("tagexpr").SetExpressionAliases(map[string]string{
+		"positive": "$ > 0",
+		"small":    "$ < 100",
+		"range":    "#positive && #small",
+		"tag":      "'#positive'",
+	})
+	type T struct {
+		A int    `tagexpr:"{pos:#positive && $ < 100}{range:!#range}{or:#positive || (B)$ == #tag}"`
+		B string `tagexpr:"$=='#positive'"`
+	}
+	tagExpr, err := vm.Run(&T{A: 200, B: "#positive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{
+		"A@pos": false, "A@range": true, "A@or": true, "B@": true,
+	} {
+		if r := tagExpr.Eval(k); r != want {
+			t.Fatalf("%s: got: %v, want: %v", k, r, want)
+		}
+	}
+	if raw := tagExpr.RawExpr("A@pos"); raw != "#positive && $ < 100" {
+		t.Fatalf("raw: %q", raw)
+	}
+	tokens, err := vm.Tokens("#positive && #small")
+	if err != nil || len(tokens) != 3 || tokens[0].Kind != TokenSelector {
+		t.Fatalf("tokens: %v, %v", tokens, err)
+	}
+	vm = New("tagexpr").SetExpressionAliases(map[string]string{
+		"self": "#self || true",
+		"a":    "#b && $ > 0",
+		"b":    "$ < 10 && #a",
+	})
+	type U struct {
+		A int `tagexpr:"#self"`
+	}
+	type V struct {
+		A int `tagexpr:"$ > 1 && #a"`
+	}
+	for _, v := range []interface{}{&U{}, &V{}} {
+		if _, err := vm.Run(v); err == nil || !strings.Contains(err.Error(), "cyclic expression alias") {
+			t.Fatalf("%T: got: %v", v, err)
+		}
+	}
+}
+
+type testMethodInner struct {
+	N int
+}
+
+func (i testMethodInner) Validate() bool { return i.N > 0 }
+
+func (i *testMethodInner) Name() string { return "inner" + strconv.Itoa(i.N) }
+
+func (i testMethodInner) Check() (int, error) {
+	if i.N < 0 {
+		return 0, fmt.Errorf("negative")
+	}
+	return i.N * 2, nil
+}
+
+func TestPromotedMethod(t *testing.T) {
+	type Wrapper struct {
+		testMethodInner
+	}
+	type PtrWrapper struct {
+		*testMethodInner
+	}
+	type T struct {
+		W  Wrapper    `tagexpr:"$.Validate()"`
+		W2 Wrapper    `tagexpr:"$.Name()=='inner1'"`
+		W3 Wrapper    `tagexpr:"$.Check()+1"`
+		P  PtrWrapper `tagexpr:"$.Validate()"`
+		P2 PtrWrapper `tagexpr:"$.Name()=='inner2'"`
+		X  Wrapper    `tagexpr:"$.Missing()==nil"`
+	}
+	vm := New("tagexpr")
+	v := T{
+		W:  Wrapper{testMethodInner{N: 1}},
+		W2: Wrapper{testMethodInner{N: 1}},
+		W3: Wrapper{testMethodInner{N: 3}},
+		P:  PtrWrapper{&testMethodInner{N: 2}},
+		P2: PtrWrapper{&testMethodInner{N: 2}},
+	}
+	cases := map[string]interface{}{"W@": true, "W2@": true, "W3@": 7.0, "P@": true, "P2@": true, "X@": true}
+	te, err := vm.Run(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sel, want := range cases {
+		if got := te.Eval(sel); got != want {
+			t.Fatalf("%s: got %v, want %v", sel, got, want)
+		}
+	}
+	v.W.N = 0
+	v.P.testMethodInner = nil
+	te, err = vm.Run(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := te.Eval("W@"); got != false {
+		t.Fatalf("W: got %v, want false", got)
+	}
+	if got := te.Eval("P@"); got != nil {
+		t.Fatalf("P: got %v, want nil", got)
+	}
+	v.W3.N = -1
+	te, err = vm.Run(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := te.Eval("W3@").(error); !ok || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("W3: got %v", err)
+	}
+	// the methods of the unexported fields abort the evaluation
+	type U struct {
+		A struct{ inner testMethodInner } `tagexpr:"{v:$.inner.Validate()}{p:$.inner.Name()}"`
+	}
+	te, err = vm.Run(&U{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sel := range []string{"A@v", "A@p"} {
+		if err, ok := te.Eval(sel).(error); !ok || !strings.Contains(err.Error(), "unexported field") {
+			t.Fatalf("%s: got %v", sel, te.Eval(sel))
+		}
+	}
+}
+
+func TestMixedNumericComparison(t *testing.T) {
+	type T struct {
+		I   int     `tagexpr:"{f:$<(F)$}{i:$<(U8)$}"`
+		I8  int8    `tagexpr:"{f:$<(F)$}{i:$<(U16)$}"`
+		I16 int16   `tagexpr:"{f:$<(F)$}{i:$<(U32)$}"`
+		I32 int32   `tagexpr:"{f:$<(F)$}{i:$<(I64)$}"`
+		I64 int64   `tagexpr:"{f:$>(F)$}{i:$>(I8)$}"`
+		U   uint    `tagexpr:"{f:$>(F)$}{i:$>(I16)$}"`
+		U8  uint8   `tagexpr:"{f:$>(F)$}{i:$>(I32)$}"`
+		U16 uint16  `tagexpr:"{f:$>(F)$}{i:$>(U)$}"`
+		U32 uint32  `tagexpr:"{f:$>(F32)$}{i:$>(I)$}"`
+		U64 uint64  `tagexpr:"{f:$>(F)$}{max:$==18446744073709551615}{lt:$<18446744073709551616.5}{gt:$>18446744073709551614}{i:$>(I64)$}"`
+		F32 float32 `tagexpr:"{f:$<(F)$}{i:$>(I)$}"`
+		Ptr *int16  `tagexpr:"{f:$<(F)$}{i:$<(U8)$}"`
+		F   float64
+	}
+	var i16 int16 = -3
+	v := &T{
+		I: 2, I8: -2, I16: 2, I32: 2, I64: 3,
+		U: 3, U8: 3, U16: 4, U32: 3, U64: math.MaxUint64,
+		F32: 2.25, F: 2.5, Ptr: &i16,
+	}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagExpr.Range(func(selector string, eval func() interface{}) bool {
+		if r := eval(); r != true {
+			t.Fatalf("%s: got: %v, want: true", selector, r)
+		}
+		return true
+	})
+	// the large integers are compared exactly, not as the rounded float64
+	v.U64, v.I64 = math.MaxUint64-1, math.MaxInt64
+	for selector, want := range map[string]interface{}{"U64@max": false, "U64@gt": false, "U64@i": true, "I64@i": true} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("%s: got: %v, want: %v", selector, r, want)
+		}
+	}
+	// the numbers of the unexported fields
+	type W struct {
+		A struct{ n uint16 }             `tagexpr:"$.n"`
+		B map[string]struct{ f float32 } `tagexpr:"$['x'].f"`
+	}
+	tagExpr, err = New("tagexpr").Run(&W{B: map[string]struct{ f float32 }{"x": {f: 1.5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("A@"); r != 0.0 {
+		t.Fatalf("got: %v(%T)", r, r)
+	}
+	if r := tagExpr.Eval("B@"); r != 1.5 {
+		t.Fatalf("got: %v(%T)", r, r)
+	}
+	// the field values stay float64
+	type V struct {
+		I int64  `tagexpr:"{v:$}{div:$/0}{isStep:isStep($,1)}"`
+		U uint64 `tagexpr:"$"`
+	}
+	tagExpr, err = New("tagexpr").Run(&V{I: math.MaxInt64, U: math.MaxUint64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("I@v"); r != float64(math.MaxInt64) {
+		t.Fatalf("got: %v(%T)", r, r)
+	}
+	if r := tagExpr.EvalFloat("U@"); r != float64(math.MaxUint64) {
+		t.Fatalf("got: %v", r)
+	}
+	if r, ok := tagExpr.Eval("I@div").(float64); !ok || !math.IsNaN(r) {
+		t.Fatalf("got: %v(%T)", tagExpr.Eval("I@div"), tagExpr.Eval("I@div"))
+	}
+	if r := tagExpr.Eval("I@isStep"); r != true {
+		t.Fatalf("got: %v", r)
+	}
+}
+
+func TestEvalValid(t *testing.T) {
+	type U struct {
+		Zip string `tagexpr:"{min:len($)>=5}{pattern:regexp('^\\d+$')}"`
+	}
+	type T struct {
+		Code string `tagexpr:"{min:len($)>=2}{max:len($)<=4}{pattern:regexp('^[a-z]+$')}{msg:'invalid code'}"`
+		Num  int    `tagexpr:"{bad:$/(Zero)$}"`
+		Zero int
+		Addr U
+	}
+	var cases = []struct {
+		code  string
+		valid bool
+	}{
+		{"abc", true},
+		{"a", false},
+		{"abcde", false},
+		{"ab1", false},
+	}
+	vm := New("tagexpr").SetIntegerMode(true)
+	for _, c := range cases {
+		tagExpr, err := vm.Run(&T{Code: c.code, Addr: U{Zip: "12345"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := tagExpr.EvalValid("Code"); r != c.valid {
+			t.Fatalf("%q: got: %v, want: %v", c.code, r, c.valid)
+		}
+	}
+	tagExpr, err := vm.Run(&T{Addr: U{Zip: "1234x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagExpr.EvalValid("Addr.Zip") || tagExpr.EvalValid("Num") || !tagExpr.EvalValid("Zero") {
+		t.Fatal("want invalid Addr.Zip and Num, and valid Zero")
+	}
+}
+
+// testStringValue and testInt32Value have the shape of wrapperspb.StringValue and wrapperspb.Int32Value.
+type testStringValue struct {
+	state         struct{}
+	sizeCache     int32
+	unknownFields []byte
+	Value         string
+}
+
+func (x *testStringValue) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type testInt32Value struct {
+	state struct{}
+	Value int32
+}
+
+func (x *testInt32Value) GetValue() int32 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+// testOptValue has the shape of a wrapper type and its own tag expression.
+type testOptValue struct {
+	Value string `tagexpr:"len($)>0"`
+}
+
+func (x *testOptValue) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func TestWrapperType(t *testing.T) {
+	type T struct {
+		S  *testStringValue `tagexpr:"{eq:$=='x'}{nil:$==nil}{len:len($)}"`
+		I  *testInt32Value  `tagexpr:"{gt:$>(V)$}{nil:$==nil}"`
+		V  testInt32Value
+		VS testStringValue `tagexpr:"$+'!'"`
+	}
+	v := &T{S: &testStringValue{Value: "x"}, I: &testInt32Value{Value: 3}, V: testInt32Value{Value: 2}, VS: testStringValue{Value: "v"}}
+	tagExpr, err := New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string]interface{}{
+		"S@eq": true, "S@nil": false, "S@len": 1.0, "I@gt": true, "I@nil": false, "VS@": "v!",
+	} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("%s: got: %v, want: %v", selector, r, want)
+		}
+	}
+	v.S, v.I = nil, nil
+	for selector, want := range map[string]interface{}{
+		"S@eq": false, "S@nil": true, "S@len": nil, "I@gt": false, "I@nil": true,
+	} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("nil wrapper %s: got: %v, want: %v", selector, r, want)
+		}
+	}
+
+	// the tag expressions of the wrapper fields are kept
+	type U struct {
+		O  testOptValue
+		PO *testOptValue
+	}
+	u := &U{PO: &testOptValue{Value: "x"}}
+	tagExpr, err = New("tagexpr").Run(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("O.Value@"); r != false {
+		t.Fatalf("O.Value@: got: %v, want: false", r)
+	}
+	if r := tagExpr.Eval("PO.Value@"); r != true {
+		t.Fatalf("PO.Value@: got: %v, want: true", r)
+	}
+}
+
+func TestEvalObserver(t *testing.T) {
+	type U struct {
+		B string `tagexpr:"len($)>1"`
+	}
+	type T struct {
+		A    int `tagexpr:"{pos:$>0}{div:$/(Zero)$}"`
+		Zero int
+		U    U
+	}
+	var events []EvalEvent
+	vm := New("tagexpr").SetIntegerMode(true).SetEvalObserver(func(ev EvalEvent) {
+		events = append(events, ev)
+	})
+	tagExpr, err := vm.Run(&T{A: 1, U: U{B: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagExpr.Eval("A@pos")
+	tagExpr.Eval("A@none")
+	tagExpr.Range(func(selector string, eval func() interface{}) bool {
+		eval()
+		return true
+	})
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4: %v", len(events), events)
+	}
+	if ev := events[0]; ev.Field != "A" || ev.Selector != "A@pos" || ev.Result != true || ev.Err != nil || ev.Duration < 0 {
+		t.Fatalf("got: %+v", ev)
+	}
+	var failed, nested bool
+	for _, ev := range events[1:] {
+		switch ev.Selector {
+		case "A@div":
+			failed = ev.Err != nil && ev.Result == nil
+		case "U.B@":
+			nested = ev.Field == "U.B" && ev.Result == false
+		}
+	}
+	if !failed || !nested {
+		t.Fatalf("got: %+v", events)
+	}
+}
+
+// testNullString is a driver.Valuer like sql.NullString.
+type testNullString struct {
+	String string
+	Valid  bool
+}
+
+func (n testNullString) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.String, nil
+}
+
+// testUpper is a driver.Valuer with the pointer receiver, that fails if it is empty.
+type testUpper string
+
+func (u *testUpper) Value() (driver.Value, error) {
+	if *u == "" {
+		return nil, fmt.Errorf("empty")
+	}
+	return strings.ToUpper(string(*u)), nil
+}
+
+func TestValuer(t *testing.T) {
+	type T struct {
+		N  testNullString  `tagexpr:"{eq:$=='a'}{nil:$==nil}"`
+		U  testUpper       `tagexpr:"{eq:$=='AB'}{nil:$==nil}"`
+		P  *testUpper      `tagexpr:"$=='AB'"`
+		NP *testNullString `tagexpr:"$==nil"`
+	}
+	ab := testUpper("ab")
+	v := &T{N: testNullString{String: "a", Valid: true}, U: "ab", P: &ab}
+	var cases = []struct {
+		unwrap bool
+		tests  map[string]interface{}
+	}{
+		{false, map[string]interface{}{"N@eq": false, "U@eq": false, "P@": false, "NP@": true}},
+		{true, map[string]interface{}{"N@eq": true, "N@nil": false, "U@eq": true, "U@nil": false, "P@": true, "NP@": true}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetUnwrapValuer(c.unwrap).Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("unwrap: %v, selector: %q, got: %v, want: %v", c.unwrap, selector, val, value)
+			}
+		}
+	}
+	// the invalid value and the failed Value are nil
+	v.N.Valid, v.U = false, ""
+	tagExpr, err := New("tagexpr").SetUnwrapValuer(true).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range map[string]interface{}{"N@eq": false, "N@nil": true, "U@eq": false, "U@nil": true} {
+		if val := tagExpr.Eval(selector); val != value {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+type testMoney struct {
+	cents    int64
+	currency string
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	vm := New("tagexpr")
+	if err := vm.RegisterExtractor(reflect.TypeOf(&testMoney{}), func(reflect.Value) interface{} { return nil }); err == nil {
+		t.Fatal("want pointer type error")
+	}
+	err := vm.RegisterExtractor(reflect.TypeOf(testMoney{}), func(v reflect.Value) interface{} {
+		return v.Interface().(testMoney).cents
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type T struct {
+		Price  testMoney            `tagexpr:"{gt:$>100}{add:$+(Fee)$}"`
+		Fee    *testMoney           `tagexpr:"$==nil"`
+		Prices []testMoney          `tagexpr:"{first:$[0]==5}{big:findFirst($, '#>10')}"`
+		ByName map[string]testMoney `tagexpr:"$['a']<(Price)$"`
+	}
+	v := &T{
+		Price:  testMoney{cents: 150, currency: "USD"},
+		Prices: []testMoney{{cents: 5}, {cents: 20}},
+		ByName: map[string]testMoney{"a": {cents: 7}},
+	}
+	tagExpr, err := vm.Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string]interface{}{
+		"Price@gt": true, "Price@add": 150.0, "Fee@": true, "Prices@first": true, "Prices@big": 20.0, "ByName@": true,
+	} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("%s: got: %v, want: %v", selector, r, want)
+		}
+	}
+	v.Fee = &testMoney{cents: 50}
+	if tagExpr, err = vm.Run(v); err != nil {
+		t.Fatal(err)
+	}
+	if r := tagExpr.Eval("Price@add"); r != 200.0 {
+		t.Fatalf("got: %v, want: 200", r)
+	}
+}
+
+func TestNumCompareSpecialized(t *testing.T) {
+	type T struct {
+		A int      `tagexpr:"{gt:$>5}{ge:$>=5}{lt:$<5}{le:$<=5}{and:$>1 && $<=10}"`
+		B *uint8   `tagexpr:"$>=5"`
+		F float64  `tagexpr:"$<2.5"`
+		D benchInt `tagexpr:"$>5"`
+		U uint64   `tagexpr:"$>18446744073709551614"`
+	}
+	vm := New("tagexpr")
+	v := &T{A: 5, F: math.NaN(), D: 6, U: math.MaxUint64}
+	tagExpr, err := vm.Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, specialized := range map[string]bool{"A@gt": true, "B@": true, "F@": true, "D@": false} {
+		_, ok := tagExpr.s.exprs[selector].expr.RightOperand().(*numCompareExprNode)
+		if ok != specialized {
+			t.Fatalf("%s: got specialized: %v, want: %v", selector, ok, specialized)
+		}
+	}
+	var b uint8 = 7
+	var cases = []struct {
+		prepare func()
+		tests   map[string]interface{}
+	}{
+		{func() {}, map[string]interface{}{"A@gt": false, "A@ge": true, "A@lt": false, "A@le": true, "A@and": true, "B@": false, "F@": false, "D@": true, "U@": true}},
+		{func() { v.A, v.B, v.F = 6, &b, 2 }, map[string]interface{}{"A@gt": true, "A@ge": true, "A@lt": false, "A@le": false, "A@and": true, "B@": true, "F@": true}},
+		{func() { vm.SetIntegerMode(true) }, map[string]interface{}{"A@gt": true, "A@le": false, "B@": true}},
+		{func() {
+			vm.SetIntegerMode(false).SetFieldValueHook(func(path string, v interface{}) interface{} {
+				if path == "A" {
+					return 1.0
+				}
+				return v
+			})
+		}, map[string]interface{}{"A@gt": false, "A@lt": true, "B@": true}},
+	}
+	for i, c := range cases {
+		c.prepare()
+		for selector, want := range c.tests {
+			if r := tagExpr.Eval(selector); r != want {
+				t.Fatalf("case %d, %s: got: %v, want: %v", i, selector, r, want)
+			}
+		}
+	}
+}
+
+func TestResultConverter(t *testing.T) {
+	type wrapped struct {
+		selector string
+		result   interface{}
+	}
+	type T struct {
+		A int     `tagexpr:"$>1"`
+		B string  `tagexpr:"{len:len($)}{up:$+'!'}"`
+		C *string `tagexpr:"$"`
+	}
+	vm := New("tagexpr").SetResultConverter(func(selector string, result interface{}) interface{} {
+		return wrapped{selector: selector, result: result}
+	})
+	tagExpr, err := vm.Run(&T{A: 2, B: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]interface{}{
+		"A@":     true,
+		"B@len":  float64(2),
+		"B@up":   "go!",
+		"C@":     nil,
+		"none@x": nil,
+	}
+	for selector, want := range cases {
+		if r := tagExpr.Eval(selector); r != (wrapped{selector: selector, result: want}) {
+			t.Fatalf("%s: got %#v", selector, r)
+		}
+	}
+	var n int
+	tagExpr.Range(func(selector string, eval func() interface{}) bool {
+		if r, ok := eval().(wrapped); !ok || r.selector != selector {
+			t.Fatalf("%s: got %#v", selector, r)
+		}
+		n++
+		return true
+	})
+	if n != 4 {
+		t.Fatalf("ranged %d expressions", n)
+	}
+	// the internal results are not converted
+	if !tagExpr.EvalBool("A@") || tagExpr.EvalString("B@up") != "go!" {
+		t.Fatal("typed evaluations see the converted results")
+	}
+	if valid, err := vm.AllValid(&T{A: 2}); !valid || err != nil {
+		t.Fatalf("AllValid: %v, %v", valid, err)
+	}
+}
+
+func TestNumberFormatLocale(t *testing.T) {
+	type T struct {
+		A float64 `tagexpr:"{v:sprintf('%v', $)}{f:sprintf('%.2f|%12.1f|%-6.0f|', $, $, 999)}{other:sprintf('%s %x %v', 'n', 255, true)}"`
+	}
+	cases := []struct {
+		locale       string
+		v, f, others string
+	}{
+		{"", "1.234567891e+06", "1234567.89|   1234567.9|999   |", "n 0x1.fep+07 true"},
+		{"en-US", "1,234,567.891", "1,234,567.89| 1,234,567.9|999   |", "n 0x1.fep+07 true"},
+		{"de_DE", "1.234.567,891", "1.234.567,89| 1.234.567,9|999   |", "n 0x1.fep+07 true"},
+		{"xx", "1.234567891e+06", "1234567.89|   1234567.9|999   |", "n 0x1.fep+07 true"},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetNumberFormatLocale(c.locale).Run(&T{A: 1234567.891})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := tagExpr.Eval("A@v"); r != c.v {
+			t.Fatalf("%q: %%v: got: %q, want: %q", c.locale, r, c.v)
+		}
+		if r := tagExpr.Eval("A@f"); r != c.f {
+			t.Fatalf("%q: %%f: got: %q, want: %q", c.locale, r, c.f)
+		}
+		if r := tagExpr.Eval("A@other"); r != c.others {
+			t.Fatalf("%q: other verbs: got: %q, want: %q", c.locale, r, c.others)
+		}
+	}
+}
+
+type testPage struct {
+	Size int `tagexpr:"$>0"`
+}
+
+type testContainer[T any] struct {
+	Item  T   `tagexpr:"{set:$!=nil}"`
+	Items []T `tagexpr:"len($)<=(Limit)$"`
+	Limit int
+}
+
+func (c testContainer[T]) Count() int { return len(c.Items) }
+
+type testContainerHolder struct {
+	testContainer[testPage]
+	Total int `tagexpr:"(testContainer.Item.Size)$*(testContainer)$.Count()"`
+}
+
+func TestGenericStruct(t *testing.T) {
+	vm := New("tagexpr")
+	ints, err := vm.Run(&testContainer[int]{Item: 3, Items: []int{1, 2, 3}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err := vm.Run(&testContainer[testPage]{Items: []testPage{{}}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptrs, err := vm.Run(&testContainer[*testPage]{Item: &testPage{Size: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := vm.Run(&testContainerHolder{testContainer[testPage]{Item: testPage{Size: 5}, Items: make([]testPage, 3)}, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		tagExpr *TagExpr
+		tests   map[string]interface{}
+	}{
+		{ints, map[string]interface{}{"Item@set": true, "Items@": false}},
+		{pages, map[string]interface{}{"Item@set": true, "Item.Size@": false, "Items@": true}},
+		{ptrs, map[string]interface{}{"Item@set": true, "Item.Size@": true, "Items@": true}},
+		{holder, map[string]interface{}{"testContainer.Item.Size@": true, "Total@": 15.0}},
+	}
+	for i, c := range cases {
+		for k, want := range c.tests {
+			if r := c.tagExpr.Eval(k); r != want {
+				t.Fatalf("case %d: %s: got: %v, want: %v", i, k, r, want)
+			}
+		}
+	}
+	if _, ok := ints.s.exprs["Item.Size@"]; ok {
+		t.Fatal("the instantiations share the expressions")
+	}
+}
+
+type testTreeNode struct {
+	V        int `tagexpr:"{pos:$>0}{v:$}"`
+	Next     *testTreeNode
+	Children []testTreeNode
+	Named    map[string]*testTreeNode
+	Any      interface{}
+	parent   *testTreeNode
+}
+
+func TestRunRecursive(t *testing.T) {
+	root := &testTreeNode{V: 1}
+	root.Next = &testTreeNode{V: 2, Next: root}
+	root.Children = []testTreeNode{{V: 3, parent: root}, {V: 0, Next: root.Next}}
+	root.Named = map[string]*testTreeNode{"b": root, "a": {V: 4}}
+	root.Any = &testTreeNode{V: 5, Any: root}
+	tagExprs, err := New("tagexpr").RunRecursive(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []int64
+	for _, tagExpr := range tagExprs {
+		values = append(values, tagExpr.EvalInt("V@v"))
+	}
+	if want := []int64{1, 2, 3, 0, 4, 5}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("got: %v, want: %v", values, want)
+	}
+	if r := tagExprs[3].Eval("V@pos"); r != false {
+		t.Fatalf("Children[1]: got: %v", r)
+	}
+	_, err = New("tagexpr").SetRecursionGuard(RecursionError).RunRecursive(root)
+	if err == nil || err.Error() != "cycle detected at Next.Next: *tagexpr.testTreeNode" {
+		t.Fatalf("got error: %v", err)
+	}
+	// the shared nodes without a cycle
+	shared := &testTreeNode{V: 7}
+	dag := &testTreeNode{V: 6, Next: shared, Children: []testTreeNode{{V: 8, Next: shared}}}
+	tagExprs, err = New("tagexpr").SetRecursionGuard(RecursionError).RunRecursive(dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagExprs) != 3 {
+		t.Fatalf("got %d nodes, want 3", len(tagExprs))
+	}
+	if _, err = New("tagexpr").RunRecursive((*testTreeNode)(nil)); err == nil {
+		t.Fatal("want error for nil root")
+	}
+	// the index of the slice and array elements
+	type Item struct {
+		V int `tagexpr:"{idx:parentIndex()}{last:index()==count()-1}"`
+	}
+	type Outer struct {
+		Items []Item
+		Ptrs  [2]*Item
+		Item  *Item
+	}
+	tagExprs, err = New("tagexpr").RunRecursive(&Outer{Items: []Item{{}, {}, {}}, Ptrs: [2]*Item{{}, {}}, Item: &Item{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, tagExpr := range tagExprs[1:] {
+		got = append(got, tagExpr.Eval("V@idx"), tagExpr.Eval("V@last"))
+	}
+	if want := []interface{}{0.0, false, 1.0, false, 2.0, true, 0.0, false, 1.0, true, nil}; !reflect.DeepEqual(got[:len(want)], want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	if _, ok := got[len(got)-1].(error); !ok {
+		t.Fatalf("the field that is not an element: got: %v", got[len(got)-1])
+	}
+}
+
+func TestIsStep(t *testing.T) {
+	type T struct {
+		Price float64 `tagexpr:"isStep($, 0.25)"`
+		Qty   int     `tagexpr:"isStep($, (Step)$)"`
+		Step  int
+	}
+	type I struct {
+		Qty  int `tagexpr:"isStep($, (Step)$)"`
+		Step int
+	}
+	var cases = []struct {
+		v          interface{}
+		integer    bool
+		price, qty interface{}
+	}{
+		{&T{Price: 10.75, Qty: 12, Step: 4}, false, true, true},
+		{&T{Price: 10.7, Qty: 13, Step: 4}, false, false, false},
+		{&I{Qty: 12, Step: 4}, true, nil, true},
+		{&I{Qty: 13, Step: 4}, true, nil, false},
+	}
+	for i, c := range cases {
+		tagExpr, err := New("tagexpr").SetIntegerMode(c.integer).Run(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := tagExpr.Eval("Price@"); r != c.price {
+			t.Fatalf("case %d: Price: got: %v, want: %v", i, r, c.price)
+		}
+		if r := tagExpr.Eval("Qty@"); r != c.qty {
+			t.Fatalf("case %d: Qty: got: %v, want: %v", i, r, c.qty)
+		}
+	}
+	for _, step := range []int{0, -2} {
+		for _, v := range []interface{}{&T{Qty: 4, Step: step}, &I{Qty: 4, Step: step}} {
+			_, integer := v.(*I)
+			tagExpr, err := New("tagexpr").SetIntegerMode(integer).Run(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := tagExpr.Eval("Qty@").(error); !ok {
+				t.Fatalf("step %d: want error, got: %v", step, tagExpr.Eval("Qty@"))
+			}
+		}
+	}
+}
+
+func TestCurrFieldName(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"{@:$name}{msg:sprintf('%s: %v', $name, $)}"`
+		B struct {
+			C bool `tagexpr:"$name=='B.C' && !$"`
+		}
+	}
+	tagExpr, err := New("tagexpr").Run(&T{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string]interface{}{"A@": "A", "A@msg": "A: 1", "B.C@": true} {
+		if r := tagExpr.Eval(selector); r != want {
+			t.Fatalf("%s: got: %v, want: %v", selector, r, want)
+		}
+	}
+}
+
+func TestCompiledPlan(t *testing.T) {
+	type Sub struct {
+		N int `tagexpr:"$*2"`
+	}
+	type T struct {
+		A int     `tagexpr:"{gt:$>5}{arith:($+1)*2-$/4+$%3}{div:$/0}{and:$>1 && (B)$}{or:$<0 || (S)$}"`
+		B bool    `tagexpr:"$==true"`
+		S string  `tagexpr:"{lt:$<'b'}{eq:$=='abc' && $!=''}"`
+		F float64 `tagexpr:"{ne:$!=$}{cross:$>(A)$}"`
+		I int64   `tagexpr:"$>0"`
+		Sub
+		P *int  `tagexpr:"$>1"`
+		L []int `tagexpr:"len($)>0"`
+	}
+	vm := New("tagexpr")
+	tree := New("tagexpr").SetCompiledPlans(false)
+	values := []*T{
+		{A: 7, B: true, S: "abc", F: math.NaN(), I: 1 << 60, Sub: Sub{N: 3}},
+		{A: -3, F: 2.5, I: 2},
+		{A: 2, S: "a", F: 1},
+	}
+	for i, v := range values {
+		tagExpr, err := vm.Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := tree.Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			for _, selector := range tagExpr.s.selectorList {
+				compiled := selector != "P@" && selector != "L@"
+				if (tagExpr.s.plans[selector] != nil) != compiled {
+					t.Fatalf("%s: got compiled: %v, want: %v", selector, !compiled, compiled)
+				}
+			}
+		}
+		for _, selector := range tagExpr.s.selectorList {
+			if r, w := fmt.Sprintf("%T %v", tagExpr.Eval(selector), tagExpr.Eval(selector)),
+				fmt.Sprintf("%T %v", want.Eval(selector), want.Eval(selector)); r != w {
+				t.Fatalf("%d %s: got: %s, want: %s", i, selector, r, w)
+			}
+		}
+	}
+	tagExpr, err := vm.Run(values[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testing.AllocsPerRun(100, func() { tagExpr.Eval("A@and") }); n != 0 {
+		t.Fatalf("got allocs: %v, want: 0", n)
+	}
+
+	// the plan and the tree read the other fields the same way after the changes of the struct
+	type S struct {
+		A int
+		B int `tagexpr:"(A)$>3"`
+		C int `tagexpr:"sprintf('%v',(A)$)"`
+	}
+	for _, vm := range []*VM{vm, tree} {
+		v := &S{A: 5}
+		tagExpr, err := vm.Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tagExpr.s.plans["B@"] == nil {
+			t.Fatal("B@: want compiled")
+		}
+		if r := tagExpr.Eval("C@"); r != "5" {
+			t.Fatalf("got: %v", r)
+		}
+		v.A = 1
+		if r := tagExpr.Eval("B@"); r != false {
+			t.Fatalf("after the change: got: %v", r)
+		}
+		// within a Range, the fields are resolved once whatever the order
+		v.A = 5
+		var got []interface{}
+		tagExpr.Range(func(selector string, eval func() interface{}) bool {
+			got = append(got, eval())
+			v.A = 1
+			return true
+		})
+		if len(got) != 2 || got[0] != true || got[1] != "5" {
+			t.Fatalf("range: got: %v", got)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	type T struct {
+		A int `tagexpr:"{min:$>0}"`
+	}
+	tagExpr, err := New("tagexpr").Run(&T{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagExpr.Failure("A@min"); err != nil {
+		t.Fatalf("want nil without the factory, got: %v", err)
+	}
+	tagExpr, err = New("tagexpr").SetFailureFactory(func(field, selector, raw string) error {
+		return fmt.Errorf("%s|%s|%s", field, selector, raw)
+	}).Run(&T{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tagExpr.Failure("A@min"); err == nil || err.Error() != "A|A@min|$>0" {
+		t.Fatalf("got: %v", err)
+	}
+}
+
+func TestComparableStringsNumeric(t *testing.T) {
+	type T struct {
+		A string `tagexpr:"{gt:$>'1.9'}{lt:'file9'<$}{ge:$>='1.010'}"`
+		B string `tagexpr:"{gt:$>'file9'}{le:$<='file09'}"`
+	}
+	v := &T{A: "1.10", B: "file10"}
+	var cases = []struct {
+		numeric bool
+		tests   map[string]interface{}
+	}{
+		{false, map[string]interface{}{"A@gt": false, "A@lt": false, "A@ge": true, "B@gt": false, "B@le": false}},
+		{true, map[string]interface{}{"A@gt": true, "A@lt": false, "A@ge": true, "B@gt": true, "B@le": false}},
+	}
+	for _, c := range cases {
+		tagExpr, err := New("tagexpr").SetComparableStringsNumeric(c.numeric).Run(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for selector, value := range c.tests {
+			if val := tagExpr.Eval(selector); val != value {
+				t.Fatalf("numeric: %v, selector: %q, got: %v, want: %v", c.numeric, selector, val, value)
+			}
+		}
+	}
+}
+
+func TestIntegerMode(t *testing.T) {
+	type T struct {
+		A int64   `tagexpr:"{rem:$%3==0}{eq:$==9007199254740993}{gt:$>9007199254740992}{div:$/2}"`
+		B uint8   `tagexpr:"{idx:(C)$[$]}{len:len((C)$)+$}"`
+		C []int32 `tagexpr:"$[0]*2"`
+		D float64 `tagexpr:"$+1"`
+	}
+	v := &T{A: 9007199254740993, B: 1, C: []int32{2, 3}, D: 2}
+	var tests = map[string]interface{}{
+		"A@rem": true,
+		"A@eq":  true,
+		"A@gt":  true,
+		"A@div": int64(4503599627370496),
+		"B@idx": int64(3),
+		"B@len": int64(3),
+		"C@":    int64(4),
+		"D@":    int64(3),
+	}
+	tagExpr, err := New("tagexpr").SetIntegerMode(true).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, value := range tests {
+		val := tagExpr.Eval(selector)
+		if !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v(%T), want: %v(%T)", selector, val, val, value, value)
+		}
+	}
+	// float64 loses the precision of the arithmetic, but the comparisons are exact
+	tagExpr, err = New("tagexpr").Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagExpr.EvalBool("A@rem") {
+		t.Fatal("want inexact float64 result")
+	}
+	if !tagExpr.EvalBool("A@eq") || !tagExpr.EvalBool("A@gt") {
+		t.Fatal("want exact comparison")
+	}
+	// fractional field value
+	v.D = 1.5
+	tagExpr, err = New("tagexpr").SetIntegerMode(true).Run(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tagExpr.Eval("D@").(error); !ok {
+		t.Fatalf("want error, got: %v", tagExpr.Eval("D@"))
+	}
+	// fractional literal
+	type U struct {
+		A int `tagexpr:"$>1.5"`
+	}
+	if _, err = New("tagexpr").SetIntegerMode(true).Run(&U{}); err == nil {
+		t.Fatal("want fractional literal error")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	type T struct {
+		Card string `tagexpr:"luhn($)"`
+		IMEI int64  `tagexpr:"luhn($)"`
+	}
+	tagExpr, err := New("tagexpr").Run(&T{Card: "4012888888881881", IMEI: 490154203237518})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tagExpr.EvalBool("Card@") || !tagExpr.EvalBool("IMEI@") {
+		t.Fatal("want valid")
+	}
+	tagExpr, err = New("tagexpr").Run(&T{Card: "4012888888881882", IMEI: 490154203237517})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagExpr.EvalBool("Card@") || tagExpr.EvalBool("IMEI@") {
+		t.Fatal("want invalid")
+	}
+}
+
+func TestTuple(t *testing.T) {
+	type T struct {
+		A string
+		B int `tagexpr:"((A)$, $) == ((X)$, (Y)$)"`
+		X string
+		Y int
+	}
+	vm := New("tagexpr")
+	tagExpr, err := vm.Run(&T{A: "a", B: 1, X: "a", Y: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tagExpr.EvalBool("B@") {
+		t.Fatal("want equal tuples")
+	}
+	tagExpr, err = vm.Run(&T{A: "a", B: 1, X: "a", Y: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagExpr.EvalBool("B@") {
+		t.Fatal("want unequal tuples")
+	}
+}
+
+func TestTagKeyFunc(t *testing.T) {
+	type T struct {
+		A int `legacy:"1" old:"$>0"`
+		B int `new:"$<0"`
+		C int `tagexpr:"$==0"`
+	}
+	vm := New("tagexpr").SetTagKeyFunc(func(field reflect.StructField) string {
+		if _, ok := field.Tag.Lookup("legacy"); ok {
+			return "old"
+		}
+		if field.Name == "B" {
+			return "new"
+		}
+		return ""
+	})
+	tagExpr, err := vm.Run(&T{A: 1, B: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = map[string]interface{}{
+		"A@": true,
+		"B@": true,
+		"C@": true,
+	}
+	for selector, value := range tests {
+		val := tagExpr.Eval(selector)
+		if !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+}
+
+func TestNamedOutputReference(t *testing.T) {
+	type T struct {
+		B     int   `tagexpr:"{@:(A@total)$<=$}{half:(A@total)$/2}"`
+		A     []int `tagexpr:"{total:$[0]+$[1]}{pair:(($[0], $[1]))}"`
+		C     int   `tagexpr:"{first:(A@pair)$[0]}{missing:(A@none)$}"`
+		Cycle int   `tagexpr:"{x:(Cycle@y)$}{y:(Cycle@x)$+1}"`
+	}
+	tagExpr, err := New("tagexpr").Run(&T{A: []int{1, 2}, B: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = map[string]interface{}{
+		"B@":        true,
+		"B@half":    1.5,
+		"C@first":   1.0,
+		"C@missing": nil,
+		"A@total":   3.0,
+	}
+	for selector, value := range tests {
+		val := tagExpr.Eval(selector)
+		if !reflect.DeepEqual(val, value) {
+			t.Fatalf("selector: %q, got: %v, want: %v", selector, val, value)
+		}
+	}
+	if err, ok := tagExpr.Eval("Cycle@x").(error); !ok {
+		t.Fatal("want cyclic reference error")
+	} else {
+		t.Log(err)
+	}
+	if !tagExpr.EvalBool("B@") {
+		t.Fatal("the references should be released after an aborted evaluation")
+	}
+}
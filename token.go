@@ -0,0 +1,176 @@
+// Copyright 2019 Bytedance Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tagexpr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenKind the kind of expression token
+type TokenKind int
+
+// Token kinds
+const (
+	TokenSelector   TokenKind = iota + 1 // such as (X)$[0]
+	TokenOperator                        // such as +, &&, !
+	TokenString                          // such as 'S'
+	TokenNumber                          // such as 1.0
+	TokenBool                            // such as true, !false
+	TokenFunc                            // the function name, such as len
+	TokenLeftParen                       // (
+	TokenRightParen                      // )
+	TokenComma                           // ,
+	TokenNil                             // nil
+)
+
+// Token expression token with its byte range [Start, End) in the expression
+type Token struct {
+	Kind  TokenKind
+	Text  string
+	Start int
+	End   int
+}
+
+// Tokens returns the token stream of the expression, such as for a formatter.
+func (vm *VM) Tokens(expr string) ([]Token, error) {
+	if _, err := vm.parseExpr(expr); err != nil {
+		return nil, err
+	}
+	var p Expr
+	var tokens []Token
+	s := expr
+	for *trimLeftSpace(&s) != "" {
+		start := len(expr) - len(s)
+		var kind TokenKind
+		if vm.isOperatorAliasToken(expr, start, tokens) {
+			s, kind = expr[wordEnd(expr, start):], TokenOperator
+		} else {
+			kind = p.readToken(&s, tokens)
+		}
+		if kind == 0 {
+			return nil, fmt.Errorf("%q (syntax incorrect): parsing pos: %q", expr, s)
+		}
+		end := len(expr) - len(s)
+		tokens = append(tokens, Token{
+			Kind:  kind,
+			Text:  expr[start:end],
+			Start: start,
+			End:   end,
+		})
+	}
+	return tokens, nil
+}
+
+// readToken reads a token from the head of the expression, return 0 if failed.
+func (p *Expr) readToken(expr *string, last []Token) TokenKind {
+	// an operator follows an operand
+	if n := len(last); n > 0 {
+		// a pipe follows a function without arguments
+		if last[n-1].Kind == TokenFunc && strings.HasPrefix(*expr, "|>") {
+			*expr = (*expr)[2:]
+			return TokenOperator
+		}
+		switch last[n-1].Kind {
+		case TokenSelector, TokenString, TokenNumber, TokenBool, TokenNil, TokenRightParen:
+			if strings.HasPrefix(*expr, "|>") {
+				*expr = (*expr)[2:]
+				return TokenOperator
+			}
+			if c := (*expr)[0]; c == '?' || c == ':' {
+				*expr = (*expr)[1:]
+				return TokenOperator
+			}
+			if p.parseOperator(expr) != nil {
+				return TokenOperator
+			}
+		}
+	}
+	// a function follows a pipe
+	if n := len(last); n > 0 && last[n-1].Text == "|>" {
+		if name := pipeFnRegexp.FindString(*expr); name != "" {
+			*expr = (*expr)[len(name):]
+			return TokenFunc
+		}
+	}
+	if _, _, _, _, found := findSelector(expr); found {
+		return TokenSelector
+	}
+	if elemBindingRegexp.MatchString(*expr) && readElemExprNode(expr) != nil {
+		return TokenSelector
+	}
+	if ref := aliasRefRegexp.FindString(*expr); ref != "" {
+		*expr = (*expr)[len(ref):]
+		return TokenSelector
+	}
+	if readElemExprNode(expr) != nil {
+		return TokenSelector
+	}
+	if readCurrFieldNameExprNode(expr) != nil {
+		return TokenSelector
+	}
+	s := *expr
+	switch s[0] {
+	case '(':
+		*expr = s[1:]
+		return TokenLeftParen
+	case ')':
+		*expr = s[1:]
+		return TokenRightParen
+	case ',':
+		*expr = s[1:]
+		return TokenComma
+	}
+	if name := fnNameRegexp.FindString(s); name != "" {
+		*expr = s[len(name)-1:]
+		return TokenFunc
+	}
+	if readStringExprNode(expr) != nil {
+		return TokenString
+	}
+	if readDigitalExprNode(expr) != nil {
+		return TokenNumber
+	}
+	if readBoolExprNode(expr) != nil {
+		return TokenBool
+	}
+	if readNilExprNode(expr) != nil {
+		return TokenNil
+	}
+	if bang := strings.TrimLeft(s, "!"); len(bang) < len(s) {
+		*expr = bang
+		return TokenOperator
+	}
+	if p.parseOperator(expr) != nil {
+		return TokenOperator
+	}
+	return 0
+}
+
+// isOperatorAliasToken reports whether the word at expr[start:] is an operator alias of vm.SetOperatorAliases.
+func (vm *VM) isOperatorAliasToken(expr string, start int, last []Token) bool {
+	if len(vm.operatorAliases) == 0 || !isWordStart(expr[start]) {
+		return false
+	}
+	var afterOperand bool
+	if n := len(last); n > 0 {
+		switch last[n-1].Kind {
+		case TokenSelector, TokenString, TokenNumber, TokenBool, TokenNil, TokenRightParen:
+			afterOperand = true
+		}
+	}
+	_, ok := vm.operatorAlias(expr, start, wordEnd(expr, start), afterOperand)
+	return ok
+}
@@ -46,23 +46,100 @@ func (v *Validator) Validate(structPtr interface{}) error {
 		return err
 	}
 	var errSelector string
+	var evalErr error
 	expr.Range(func(selector string, eval func() interface{}) bool {
 		if !isMatchSelector(selector) {
 			return true
 		}
-		valid, _ := eval().(bool)
+		r := eval()
+		if err, ok := r.(error); ok {
+			evalErr = err
+			return false
+		}
+		valid, _ := r.(bool)
 		if !valid {
 			errSelector = selector
 		}
 		return valid
 	})
+	if evalErr != nil {
+		return evalErr
+	}
 	if errSelector == "" {
 		return nil
 	}
+	return v.newError(expr, errSelector)
+}
+
+// FieldError the failure of a field, see Validator.ValidateAll
+type FieldError struct {
+	Field    string // the field selector, such as A.B
+	Selector string // the failed expression selector, such as A.B@
+	Message  string // the rendered msg expression, the error of the factories, or the evaluation error
+	// Failure the error of the false expression, such as the one made by the factories, nil if Err is not
+	Failure error
+	// Err the error that aborts the evaluation, nil if the expression is false
+	Err error
+}
+
+// Error returns the message.
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the Failure or the Err, so that errors.As finds the error types of the factories.
+func (e *FieldError) Unwrap() error {
+	if e.Failure != nil {
+		return e.Failure
+	}
+	return e.Err
+}
+
+// ValidateAll validates all the fields of structPtr, and returns the failures in the field order,
+// nil if all of them are valid.
+// NOTE:
+//  The msg expressions are rendered like Validate, they can reference the field value by $
+//  and the field selector by $name, such as sprintf('%s must be positive, got %v', $name, $);
+//  if structPtr can not be run, the only FieldError has no field.
+func (v *Validator) ValidateAll(structPtr interface{}) []*FieldError {
+	expr, err := v.vm.Run(structPtr)
+	if err != nil {
+		return []*FieldError{{Message: err.Error(), Err: err}}
+	}
+	var errs []*FieldError
+	expr.Range(func(selector string, eval func() interface{}) bool {
+		if !isMatchSelector(selector) {
+			return true
+		}
+		fieldError := &FieldError{Field: selector[:len(selector)-1], Selector: selector}
+		switch r := eval().(type) {
+		case bool:
+			if r {
+				return true
+			}
+			fieldError.Failure = v.newError(expr, selector)
+			fieldError.Message = fieldError.Failure.Error()
+		case error:
+			fieldError.Message, fieldError.Err = r.Error(), r
+		default:
+			fieldError.Failure = v.newError(expr, selector)
+			fieldError.Message = fieldError.Failure.Error()
+		}
+		errs = append(errs, fieldError)
+		return true
+	})
+	return errs
+}
+
+// newError returns the error of the failed expression @errSelector.
+func (v *Validator) newError(expr *tagexpr.TagExpr, errSelector string) error {
 	errMsg := expr.EvalString(errSelector + errMsgExprName)
 	if errMsg != "" {
 		return errors.New(errMsg)
 	}
+	if err := expr.Failure(errSelector); err != nil {
+		return err
+	}
 	return v.errFactory(errSelector[:len(errSelector)-1])
 }
 
@@ -72,6 +149,16 @@ func (v *Validator) SetErrorFactory(errFactory func(fieldSelector string) error)
 	return v
 }
 
+// SetFailureFactory customizes the factory of validation error with more context by tagexpr.VM.SetFailureFactory,
+// it takes precedence over the factory set by SetErrorFactory.
+// NOTE:
+//  field is the field selector, selector is the failed expression selector,
+//  raw is the raw text of the failed expression.
+func (v *Validator) SetFailureFactory(failureFactory func(field, selector, raw string) error) *Validator {
+	v.vm.SetFailureFactory(failureFactory)
+	return v
+}
+
 func defaultErrorFactory(fieldSelector string) error {
 	return errors.New("Invalid parameter: " + fieldSelector)
 }
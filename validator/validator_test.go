@@ -0,0 +1,124 @@
+// Copyright 2019 Bytedance Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"errors"
+	"testing"
+)
+
+type testFailure struct {
+	field, selector, raw string
+}
+
+func (f *testFailure) Error() string {
+	return f.field + "|" + f.selector + "|" + f.raw
+}
+
+func TestFailureFactory(t *testing.T) {
+	vd := New("vd").SetFailureFactory(func(field, selector, raw string) error {
+		return &testFailure{field: field, selector: selector, raw: raw}
+	})
+	type T struct {
+		A int `vd:"$>0"`
+		B struct {
+			C string `vd:"{@:len($)>1}{msg:'C is too short'}"`
+		}
+	}
+	err := vd.Validate(&T{A: 0})
+	f, ok := err.(*testFailure)
+	if !ok {
+		t.Fatalf("want *testFailure, got: %T", err)
+	}
+	if f.field != "A" || f.selector != "A@" || f.raw != "$>0" {
+		t.Fatalf("got: %s", f.Error())
+	}
+	err = vd.Validate(&T{A: 1})
+	if err == nil || err.Error() != "C is too short" {
+		t.Fatalf("want msg error, got: %v", err)
+	}
+	if err = vd.Validate(&T{A: 1, B: struct {
+		C string `vd:"{@:len($)>1}{msg:'C is too short'}"`
+	}{C: "ok"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	vd := New("vd")
+	type T struct {
+		A string `vd:"regexp('^a+$')"`
+	}
+	if err := vd.Validate(&T{A: "aaa"}); err != nil {
+		t.Fatal(err)
+	}
+	vd.vm.SetStringFuncMaxLen(2)
+	if err := vd.Validate(&T{A: "aaa"}); err == nil {
+		t.Fatal("want evaluation error")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	vd := New("vd")
+	type T struct {
+		A int    `vd:"{@:$>=1 && $<=100}{msg:sprintf('%s must be between 1 and 100, got %v', $name, $)}"`
+		B string `vd:"len($)>0"`
+		C struct {
+			D float64 `vd:"{@:$>0}{msg:$name + ' must be positive'}"`
+		}
+		E string `vd:"regexp('^e+$')"`
+	}
+	if errs := vd.ValidateAll(&T{A: 1, B: "b", C: struct {
+		D float64 `vd:"{@:$>0}{msg:$name + ' must be positive'}"`
+	}{D: 1}, E: "ee"}); errs != nil {
+		t.Fatalf("want no errors, got: %v", errs)
+	}
+	vd.vm.SetStringFuncMaxLen(2)
+	errs := vd.ValidateAll(&T{A: 101, E: "eee"})
+	want := []FieldError{
+		{Field: "A", Selector: "A@", Message: "A must be between 1 and 100, got 101"},
+		{Field: "B", Selector: "B@", Message: "Invalid parameter: B"},
+		{Field: "C.D", Selector: "C.D@", Message: "C.D must be positive"},
+		{Field: "E", Selector: "E@", Message: "regexp: input length 3 exceeds the limit 2"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors: %v", len(errs), errs)
+	}
+	for i, e := range errs {
+		if e.Field != want[i].Field || e.Selector != want[i].Selector || e.Message != want[i].Message {
+			t.Fatalf("error %d: got: %+v, want: %+v", i, *e, want[i])
+		}
+		if (e.Err != nil) != (i == 3) {
+			t.Fatalf("error %d: Err: %v", i, e.Err)
+		}
+	}
+	if errs := vd.ValidateAll((*T)(nil)); len(errs) != 1 || errs[0].Field != "" || errs[0].Err == nil {
+		t.Fatalf("nil pointer: got: %v", errs)
+	}
+	// the error types of the failure factory
+	vd.SetFailureFactory(func(field, selector, raw string) error {
+		return &testFailure{field: field, selector: selector, raw: raw}
+	})
+	errs = vd.ValidateAll(&T{A: 101, E: "eee"})
+	var f *testFailure
+	if !errors.As(errs[1], &f) || f.field != "B" || f.raw != "len($)>0" {
+		t.Fatalf("want *testFailure, got: %#v", errs[1].Failure)
+	}
+	if errors.As(errs[0], &f) || errs[0].Failure == nil {
+		t.Fatalf("the msg takes precedence, got: %#v", errs[0].Failure)
+	}
+}